@@ -0,0 +1,263 @@
+// Package admin is the operator API for live editing sessions. Room state
+// and commands reach every node through room.RoomManager's Redis fan-out,
+// so it works whichever node the request lands on. All routes sit behind
+// auth.RequireAdmin and every action is audited.
+package admin
+
+import (
+	"context"
+	"errors"
+	"livescribble/internal/audit"
+	"livescribble/internal/room"
+	"livescribble/internal/utils"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// how long to wait for every node to answer
+const commandTimeout = 2 * time.Second
+
+const defaultReason = "removed by an administrator"
+
+type Handler struct {
+	db     *gorm.DB
+	logger *slog.Logger
+	rooms  *room.RoomManager
+	audit  *audit.Log
+}
+
+func NewHandler(db *gorm.DB, logger *slog.Logger, rooms *room.RoomManager, auditLog *audit.Log) *Handler {
+	return &Handler{
+		db:     db,
+		logger: logger,
+		rooms:  rooms,
+		audit:  auditLog,
+	}
+}
+
+// RoomSummary is a room across the cluster as listed by ListRooms.
+type RoomSummary struct {
+	DocId   string   `json:"doc_id"`
+	Title   string   `json:"title"`
+	Clients int      `json:"clients"`
+	Users   []string `json:"users"`
+	Nodes   []string `json:"nodes"`
+}
+
+// ListRooms lists every open room in the cluster, busiest first.
+func (h *Handler) ListRooms(ctx *gin.Context) {
+	result, ok := h.command(ctx, func(c context.Context) (*room.ClusterResult, error) {
+		return h.rooms.ListRooms(c, "")
+	})
+	if !ok {
+		return
+	}
+
+	byDoc := make(map[string]*RoomSummary)
+	for _, reply := range result.Replies {
+		for _, info := range reply.Rooms {
+			summary, exists := byDoc[info.DocId]
+			if !exists {
+				summary = &RoomSummary{DocId: info.DocId, Users: []string{}}
+				byDoc[info.DocId] = summary
+			}
+			summary.Nodes = append(summary.Nodes, info.Node)
+			summary.Clients += len(info.Clients)
+			for _, client := range info.Clients {
+				if !slices.Contains(summary.Users, client.UserId) {
+					summary.Users = append(summary.Users, client.UserId)
+				}
+			}
+		}
+	}
+	titles := h.titles(ctx, byDoc)
+	rooms := make([]*RoomSummary, 0, len(byDoc))
+	for _, summary := range byDoc {
+		summary.Title = titles[summary.DocId]
+		rooms = append(rooms, summary)
+	}
+	slices.SortFunc(rooms, func(a, b *RoomSummary) int {
+		if a.Clients != b.Clients {
+			return b.Clients - a.Clients
+		}
+		if a.DocId < b.DocId {
+			return -1
+		}
+		return 1
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"rooms":   rooms,
+		"nodes":   result.Nodes,
+		"partial": result.Partial,
+	})
+}
+
+// GetRoom shows one room's connections and counters on each node holding it.
+func (h *Handler) GetRoom(ctx *gin.Context) {
+	docId := ctx.Param("doc_id")
+	result, ok := h.command(ctx, func(c context.Context) (*room.ClusterResult, error) {
+		return h.rooms.ListRooms(c, docId)
+	})
+	if !ok {
+		return
+	}
+
+	nodes := make([]room.RoomInfo, 0)
+	clients := 0
+	for _, reply := range result.Replies {
+		for _, info := range reply.Rooms {
+			nodes = append(nodes, info)
+			clients += len(info.Clients)
+		}
+	}
+	if len(nodes) == 0 && !result.Partial {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "room not open",
+		})
+		return
+	}
+
+	var title string
+	if err := h.db.Model(utils.Document{}).Where("id = ?", docId).Pluck("title", &title).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to load document title", "error", err)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"doc_id":  docId,
+		"title":   title,
+		"clients": clients,
+		"nodes":   nodes,
+		"partial": result.Partial,
+	})
+}
+
+// Kick disconnects conn_id, or every connection of user_id, from the room.
+// The client is told reason and closed with code 4003. It may rejoin while
+// it still has access, revoke the share to keep it out.
+func (h *Handler) Kick(ctx *gin.Context) {
+	docId := ctx.Param("doc_id")
+	connId := ctx.PostForm("conn_id")
+	userId := ctx.PostForm("user_id")
+	if connId == "" && userId == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "conn_id or user_id is required",
+		})
+		return
+	}
+	reason := ctx.DefaultPostForm("reason", defaultReason)
+
+	result, ok := h.command(ctx, func(c context.Context) (*room.ClusterResult, error) {
+		return h.rooms.Kick(c, docId, connId, userId, reason)
+	})
+	if !ok {
+		return
+	}
+	kicked := affected(result)
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAdminKick, DocumentID: docId, TargetID: userId, Data: gin.H{
+		"conn_id": connId,
+		"reason":  reason,
+		"kicked":  kicked,
+	}})
+	if kicked == 0 && !result.Partial {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "no matching connection",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "connections closed",
+		"kicked":  kicked,
+		"partial": result.Partial,
+	})
+}
+
+// RequestSnapshot asks the room's clients to send a snapshot now.
+func (h *Handler) RequestSnapshot(ctx *gin.Context) {
+	docId := ctx.Param("doc_id")
+	result, ok := h.command(ctx, func(c context.Context) (*room.ClusterResult, error) {
+		return h.rooms.RequestSnapshot(c, docId)
+	})
+	if !ok {
+		return
+	}
+	nodes := affected(result)
+	if nodes == 0 && !result.Partial {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "room not open",
+		})
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAdminSnapshot, DocumentID: docId})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "snapshot requested",
+		"nodes":   nodes,
+		"partial": result.Partial,
+	})
+}
+
+// CloseRoom disconnects everyone in the room on every node with code 4001.
+func (h *Handler) CloseRoom(ctx *gin.Context) {
+	docId := ctx.Param("doc_id")
+	reason := ctx.DefaultPostForm("reason", defaultReason)
+
+	h.rooms.CloseRoom(docId, reason)
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAdminClose, DocumentID: docId, Data: gin.H{"reason": reason}})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "room closed",
+	})
+}
+
+// command runs a cluster command with commandTimeout and answers the
+// request itself when it fails.
+func (h *Handler) command(ctx *gin.Context, run func(context.Context) (*room.ClusterResult, error)) (*room.ClusterResult, bool) {
+	c, cancel := context.WithTimeout(ctx.Request.Context(), commandTimeout)
+	defer cancel()
+	result, err := run(c)
+	if err != nil {
+		if errors.Is(err, room.ErrNoNodes) {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{
+				"message": "no live nodes",
+			})
+		} else {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to reach nodes", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error reaching nodes",
+			})
+		}
+		return nil, false
+	}
+	return result, true
+}
+
+func (h *Handler) titles(ctx *gin.Context, byDoc map[string]*RoomSummary) map[string]string {
+	titles := make(map[string]string, len(byDoc))
+	if len(byDoc) == 0 {
+		return titles
+	}
+	ids := make([]string, 0, len(byDoc))
+	for id := range byDoc {
+		ids = append(ids, id)
+	}
+	var documents []utils.Document
+	if err := h.db.Model(utils.Document{}).Select("id, title").Where("id IN ?", ids).Find(&documents).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to load document titles", "error", err)
+		return titles
+	}
+	for _, document := range documents {
+		titles[document.ID] = document.Title
+	}
+	return titles
+}
+
+func affected(result *room.ClusterResult) int {
+	total := 0
+	for _, reply := range result.Replies {
+		total += reply.Affected
+	}
+	return total
+}
@@ -0,0 +1,152 @@
+// Package audit keeps the append-only record of security-relevant and
+// document events: logins, account and key changes, sharing, document
+// lifecycle and WebSocket joins. Owners read their documents' events,
+// admins export everything.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"livescribble/internal/logging"
+	"livescribble/internal/utils"
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Actions. Failed attempts use the same action with OutcomeFailure.
+const (
+	ActionLogin          = "auth.login"
+	ActionLoginTOTP      = "auth.login_2fa"
+	ActionRegister       = "auth.register"
+	ActionTempUser       = "auth.temp_user"
+	ActionPasswordChange = "account.password_changed"
+	ActionEmailChange    = "account.email_changed"
+	ActionAccountDelete  = "account.deleted"
+	ActionAccountExport  = "account.exported"
+	ActionTOTPEnable     = "account.2fa_enabled"
+	ActionTOTPDisable    = "account.2fa_disabled"
+	ActionAPIKeyCreate   = "api_key.created"
+	ActionAPIKeyDelete   = "api_key.deleted"
+
+	ActionDocumentCreate   = "document.created"
+	ActionDocumentShare    = "document.shared"
+	ActionDocumentMove     = "document.moved"
+	ActionDocumentTemplate = "document.template_set"
+	ActionDocumentTrash    = "document.trashed"
+	ActionDocumentRestore  = "document.restored"
+	ActionDocumentPurge    = "document.purged"
+	ActionDocumentExport   = "document.exported"
+	ActionDocumentJoin     = "document.joined"
+	ActionFolderShare      = "folder.shared"
+	ActionFolderDelete     = "folder.deleted"
+	ActionTrashAutoPurge   = "document.auto_purged"
+	ActionAuditExport      = "audit.exported"
+
+	ActionAdminKick     = "admin.room_kick"
+	ActionAdminSnapshot = "admin.room_snapshot"
+	ActionAdminClose    = "admin.room_close"
+
+	// operator commands, see internal/cli
+	ActionAdminUserCreate    = "admin.user_created"
+	ActionAdminUserDisable   = "admin.user_disabled"
+	ActionAdminUserEnable    = "admin.user_enabled"
+	ActionAdminPasswordReset = "admin.password_reset"
+	ActionAdminOwnerTransfer = "admin.document_transferred"
+	ActionAdminTempUserPurge = "admin.temp_user_purged"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is what a caller knows about an action. Empty fields stay empty.
+type Event struct {
+	Action     string
+	ActorID    string // defaults to the request's current user
+	DocumentID string
+	TargetID   string
+	Failed     bool
+	Data       interface{} // stored as JSON
+}
+
+type Log struct {
+	db     *gorm.DB
+	logger *slog.Logger
+}
+
+func NewLog(db *gorm.DB, logger *slog.Logger) *Log {
+	return &Log{db: db, logger: logger}
+}
+
+// Record stores event with the client address, user agent and request ID of
+// ctx. A failure to write is logged, it never fails the request itself.
+func (l *Log) Record(ctx *gin.Context, event Event) {
+	if event.ActorID == "" {
+		event.ActorID = ctx.GetString("current_user")
+	}
+	row := newRow(event)
+	row.IP = ctx.ClientIP()
+	row.UserAgent = truncate(ctx.Request.UserAgent(), 512)
+	row.RequestID = logging.RequestID(ctx.Request.Context())
+	if ctx.GetBool("api_key") {
+		row.Data = withAPIKey(row.Data)
+	}
+	l.insert(ctx.Request.Context(), row)
+}
+
+// RecordSystem stores an event that no request caused, e.g. the trash purge.
+func (l *Log) RecordSystem(ctx context.Context, event Event) {
+	l.insert(ctx, newRow(event))
+}
+
+func newRow(event Event) *utils.AuditEvent {
+	row := &utils.AuditEvent{
+		Action:  event.Action,
+		ActorID: event.ActorID,
+		Outcome: OutcomeSuccess,
+		Data:    "{}",
+	}
+	if event.Failed {
+		row.Outcome = OutcomeFailure
+	}
+	if event.DocumentID != "" {
+		row.DocumentID = &event.DocumentID
+	}
+	if event.TargetID != "" {
+		row.TargetID = &event.TargetID
+	}
+	if event.Data != nil {
+		if data, err := json.Marshal(event.Data); err == nil {
+			row.Data = string(data)
+		}
+	}
+	return row
+}
+
+// withAPIKey marks events done with an API key rather than a session.
+func withAPIKey(data string) string {
+	fields := make(map[string]interface{})
+	_ = json.Unmarshal([]byte(data), &fields)
+	fields["via_api_key"] = true
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return string(out)
+}
+
+func (l *Log) insert(ctx context.Context, row *utils.AuditEvent) {
+	if err := l.db.WithContext(ctx).Create(row).Error; err != nil {
+		l.logger.ErrorContext(ctx, "Failed to write audit event", "error", err, "action", row.Action, "actorId", row.ActorID)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
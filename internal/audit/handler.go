@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"livescribble/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+	exportBatchSize = 500
+)
+
+// DocumentEvents lists a document's events, newest first, to its owner.
+// Pages continue from next_cursor; action narrows to one action.
+func (l *Log) DocumentEvents(ctx *gin.Context) {
+	docId := ctx.Param("doc_id")
+	currentUser := ctx.GetString("current_user")
+
+	var document utils.Document
+	err := l.db.Model(utils.Document{}).Select("id, user_id").Where("id = ?", docId).First(&document).Error
+	if err != nil || document.UserID != currentUser {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			l.logger.ErrorContext(ctx.Request.Context(), "Failed to load document", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error retrieving audit log",
+			})
+			return
+		}
+		// same answer for missing and foreign documents
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "document not found",
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	query := l.db.Model(utils.AuditEvent{}).Where("document_id = ?", docId)
+	if action := ctx.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if raw := ctx.Query("cursor"); raw != "" {
+		cursor, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid cursor",
+			})
+			return
+		}
+		query = query.Where("id < ?", cursor)
+	}
+
+	events := make([]utils.AuditEvent, 0)
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&events).Error; err != nil {
+		l.logger.ErrorContext(ctx.Request.Context(), "Failed to list audit events", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving audit log",
+		})
+		return
+	}
+	nextCursor := ""
+	if len(events) > limit {
+		events = events[:limit]
+		nextCursor = strconv.FormatUint(uint64(events[limit-1].ID), 10)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"events":      events,
+		"next_cursor": nextCursor,
+	})
+}
+
+// Export streams every event matching the filters, oldest first, and is
+// served behind auth.RequireAdmin. Filters: actor, action (a trailing *
+// matches a prefix, e.g. "auth.*"), document_id, outcome, since and until
+// (RFC 3339). format is jsonl (default) or csv. The export itself is audited.
+func (l *Log) Export(ctx *gin.Context) {
+	query := l.db.Model(utils.AuditEvent{})
+	if actor := ctx.Query("actor"); actor != "" {
+		query = query.Where("actor_id = ?", actor)
+	}
+	if action := ctx.Query("action"); action != "" {
+		if prefix, ok := strings.CutSuffix(action, "*"); ok {
+			query = query.Where("action LIKE ?", escapeLike(prefix)+"%")
+		} else {
+			query = query.Where("action = ?", action)
+		}
+	}
+	if docId := ctx.Query("document_id"); docId != "" {
+		query = query.Where("document_id = ?", docId)
+	}
+	if outcome := ctx.Query("outcome"); outcome != "" {
+		query = query.Where("outcome = ?", outcome)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		raw := ctx.Query(param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid " + param + ", use RFC 3339",
+			})
+			return
+		}
+		query = query.Where("created "+op+" ?", t)
+	}
+
+	format := ctx.DefaultQuery("format", "jsonl")
+	var contentType string
+	var csvWriter *csv.Writer
+	var write func(*utils.AuditEvent) error
+	flush := func() error { return nil }
+	switch format {
+	case "jsonl":
+		contentType = "application/x-ndjson"
+		encoder := json.NewEncoder(ctx.Writer)
+		write = func(e *utils.AuditEvent) error { return encoder.Encode(e) }
+	case "csv":
+		contentType = "text/csv"
+		csvWriter = csv.NewWriter(ctx.Writer)
+		write = func(e *utils.AuditEvent) error { return csvWriter.Write(csvRow(e)) }
+		flush = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid format, use jsonl or csv",
+		})
+		return
+	}
+	l.Record(ctx, Event{Action: ActionAuditExport, Data: ctx.Request.URL.Query()})
+
+	ctx.Header("Content-Type", contentType)
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="livescribble-audit-%s.%s"`, time.Now().UTC().Format("20060102T150405Z"), format))
+	ctx.Status(http.StatusOK)
+	ctx.Writer.WriteHeaderNow()
+	if csvWriter != nil {
+		_ = csvWriter.Write(csvHeader)
+	}
+
+	// the status is sent, so a failure can only cut the export short
+	var batch []utils.AuditEvent
+	err := query.Order("id").FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if err := write(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		ctx.Writer.Flush()
+		return nil
+	}).Error
+	if err != nil {
+		l.logger.ErrorContext(ctx.Request.Context(), "Failed to export audit events", "error", err)
+	}
+}
+
+var csvHeader = []string{"id", "created", "action", "outcome", "actor_id", "document_id", "target_id", "ip", "user_agent", "request_id", "data"}
+
+func csvRow(e *utils.AuditEvent) []string {
+	deref := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	return []string{
+		strconv.FormatUint(uint64(e.ID), 10),
+		e.Created.UTC().Format(time.RFC3339),
+		e.Action,
+		e.Outcome,
+		e.ActorID,
+		deref(e.DocumentID),
+		deref(e.TargetID),
+		e.IP,
+		e.UserAgent,
+		e.RequestID,
+		e.Data,
+	}
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"livescribble/internal/audit"
+	"livescribble/internal/room"
+	"livescribble/internal/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	minPasswordLength = 8
+
+	// kickTimeout bounds waiting for the nodes to disconnect a deleted user
+	kickTimeout = 3 * time.Second
+)
+
+type AccountRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+	NewEmail    string `json:"new_email"`
+	TransferTo  string `json:"transfer_to"` // email of the user who inherits owned documents on deletion
+}
+
+// ChangePassword swaps the password and revokes every other session. The
+// caller gets a fresh cookie so they stay signed in.
+func (h *Handler) ChangePassword(ctx *gin.Context) {
+	user, req, ok := h.accountRequest(ctx)
+	if !ok {
+		return
+	}
+	err := SetPassword(h.db, user.ID, req.NewPassword)
+	if err != nil {
+		if errors.Is(err, ErrWeakPassword) {
+			ctx.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": fmt.Sprintf("Password must be at least %d characters", minPasswordLength)},
+			)
+			return
+		}
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to update password", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionPasswordChange})
+	h.issueSession(ctx, user.ID)
+}
+
+func (h *Handler) ChangeEmail(ctx *gin.Context) {
+	user, req, ok := h.accountRequest(ctx)
+	if !ok {
+		return
+	}
+	newEmail := strings.TrimSpace(req.NewEmail)
+	if newEmail == "" || !strings.Contains(newEmail, "@") {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Invalid email"},
+		)
+		return
+	}
+
+	var count int64
+	err := h.db.Model(utils.User{}).Where("email = ? AND id <> ?", newEmail, user.ID).Count(&count).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to check email", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if count > 0 {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Email already in use"},
+		)
+		return
+	}
+
+	oldEmail := user.Email
+	err = h.db.Model(user).Update("email", newEmail).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to update email", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionEmailChange, Data: gin.H{"from": oldEmail, "to": newEmail}})
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"message": "Email updated"},
+	)
+}
+
+// DeleteAccount removes the user along with their keys and recovery codes
+// and disconnects their live sessions. Owned documents and folders go to
+// transfer_to when given and are deleted otherwise.
+func (h *Handler) DeleteAccount(ctx *gin.Context) {
+	user, req, ok := h.accountRequest(ctx)
+	if !ok {
+		return
+	}
+
+	var heir utils.User
+	if req.TransferTo != "" {
+		err := h.db.Model(utils.User{}).Where("email = ?", req.TransferTo).First(&heir).Error
+		if err != nil || heir.ID == user.ID {
+			ctx.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Transfer recipient not found"},
+			)
+			return
+		}
+	}
+
+	deleted, err := DeleteUser(h.db, user.ID, heir.ID)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to delete account", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	for _, docId := range deleted {
+		h.rooms.CloseRoom(docId, "document deleted")
+	}
+	// sockets on transferred and shared documents stay open otherwise
+	kickCtx, cancel := context.WithTimeout(ctx.Request.Context(), kickTimeout)
+	result, err := h.rooms.Kick(kickCtx, "", "", user.ID, "account deleted")
+	cancel()
+	if err == nil && result.Partial {
+		err = fmt.Errorf("only %d of %d nodes answered", len(result.Replies), result.Nodes)
+	}
+	if err != nil && !errors.Is(err, room.ErrNoNodes) {
+		h.logger.WarnContext(ctx.Request.Context(), "Live sessions of deleted account may still be open", "error", err.Error())
+	}
+
+	data := gin.H{"email": user.Email}
+	if heir.ID != "" {
+		data["transferred_to"] = heir.ID
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAccountDelete, Data: data})
+	h.setCookie(ctx, "", -time.Second)
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"message": "Account deleted"},
+	)
+}
+
+// ExportAccount streams a zip with the user's profile, API key metadata and
+// every document they own, including the stored snapshot. Version history is
+// not included: the server keeps only each document's latest snapshot, and
+// the zip's manifest.json says so.
+func (h *Handler) ExportAccount(ctx *gin.Context) {
+	var user utils.User
+	err := h.db.Model(utils.User{}).Where("id = ?", ctx.GetString("current_user")).First(&user).Error
+	if err != nil {
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	var documents []utils.Document
+	if err := h.db.Model(utils.Document{}).Where("user_id = ?", user.ID).Find(&documents).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to load documents for export", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	var keys []utils.APIKey
+	if err := h.db.Model(utils.APIKey{}).Where("user_id = ?", user.ID).Find(&keys).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to load api keys for export", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAccountExport, Data: gin.H{"documents": len(documents)}})
+	ctx.Header("Content-Type", "application/zip")
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="livescribble-export-%s.zip"`, user.ID))
+	ctx.Status(http.StatusOK)
+
+	archive := zip.NewWriter(ctx.Writer)
+	err = writeExport(archive, &user, documents, keys)
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// headers are already sent, all we can do is log and cut the stream
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to write account export", "error", err, "userId", user.ID)
+	}
+}
+
+func writeExport(archive *zip.Writer, user *utils.User, documents []utils.Document, keys []utils.APIKey) error {
+	manifest := gin.H{
+		"exported_at":     time.Now().UTC(),
+		"documents":       len(documents),
+		"version_history": "not included, the server keeps only the latest snapshot of each document",
+	}
+	if err := writeJSONEntry(archive, "manifest.json", manifest); err != nil {
+		return err
+	}
+	profile := gin.H{
+		"id":           user.ID,
+		"email":        user.Email,
+		"totp_enabled": user.TOTPEnabled,
+	}
+	if err := writeJSONEntry(archive, "profile.json", profile); err != nil {
+		return err
+	}
+	if err := writeJSONEntry(archive, "api_keys.json", keys); err != nil {
+		return err
+	}
+	for _, document := range documents {
+		content := document.Content
+		document.Content = ""
+		if err := writeJSONEntry(archive, "documents/"+document.ID+".json", document); err != nil {
+			return err
+		}
+		w, err := archive.Create("documents/" + document.ID + ".snapshot")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeJSONEntry(archive *zip.Writer, name string, v interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// accountRequest parses the request and re-checks the password, which every
+// account change requires.
+func (h *Handler) accountRequest(ctx *gin.Context) (*utils.User, *AccountRequest, bool) {
+	var req AccountRequest
+	err := json.Unmarshal([]byte(ctx.PostForm("request")), &req)
+	if err != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Missing Request"},
+		)
+		return nil, nil, false
+	}
+
+	var user utils.User
+	err = h.db.Model(utils.User{}).Where("id = ?", ctx.GetString("current_user")).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "User not found"},
+			)
+		} else {
+			ctx.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Server error"},
+			)
+		}
+		return nil, nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Incorrect password"},
+		)
+		return nil, nil, false
+	}
+	return &user, &req, true
+}
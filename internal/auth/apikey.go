@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"livescribble/internal/audit"
+	"livescribble/internal/utils"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	apiKeyPrefix = "lsk_"
+
+	ScopeDocumentsRead  = "documents:read"  // GET requests only
+	ScopeDocumentsWrite = "documents:write" // every request to the document API
+	ScopeDocumentPrefix = "document:"       // document:<id> pins the key to a single document
+
+	// last_used_at is only written when it is older than this, so busy keys
+	// do not cost a write per request
+	lastUsedResolution = time.Minute
+)
+
+// apiKeyRoutes are the parts of /protected an API key can reach, whatever its
+// scopes: documents, folders and their sessions. The account, its keys,
+// notifications, webhooks and the admin API need a login session.
+var apiKeyRoutes = []string{
+	"/protected/document/",
+	"/protected/documents",
+	"/protected/search",
+	"/protected/folders",
+	"/protected/create-document",
+	"/protected/import",
+	"/protected/templates",
+	"/protected/delete-document",
+	"/protected/trash",
+	"/protected/ws/",
+}
+
+type APIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 means the key never expires
+}
+
+// CreateAPIKey mints a new key for the current user. The plaintext key is only
+// returned here, the database keeps a SHA-256 hash of it.
+func (h *Handler) CreateAPIKey(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var req APIKeyRequest
+	err := json.Unmarshal([]byte(ctx.PostForm("request")), &req)
+	if err != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Missing Request"},
+		)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Invalid key name"},
+		)
+		return
+	}
+	if !validScopes(req.Scopes) || req.ExpiresInDays < 0 {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Invalid scopes"},
+		)
+		return
+	}
+
+	keyID, err := utils.RandomString(10)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to generate api key id", "error", err)
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	secret, err := utils.RandomString(40)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to generate api key", "error", err)
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	plainKey := apiKeyPrefix + secret
+
+	scopes, _ := json.Marshal(req.Scopes)
+	key := utils.APIKey{
+		ID:     keyID,
+		UserID: currentUser,
+		Name:   req.Name,
+		Hash:   hashAPIKey(plainKey),
+		Scopes: string(scopes),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		key.ExpiresAt = &expiresAt
+	}
+
+	err = h.db.Create(&key).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to save api key", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAPIKeyCreate, TargetID: key.ID, Data: gin.H{"name": key.Name, "scopes": req.Scopes}})
+	ctx.JSON(
+		http.StatusCreated,
+		gin.H{
+			"message": "API key created",
+			"key":     plainKey,
+			"api_key": key,
+		},
+	)
+}
+
+func (h *Handler) ListAPIKeys(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var keys []utils.APIKey
+	err := h.db.Model(utils.APIKey{}).Where("user_id = ?", currentUser).Order("created desc").Find(&keys).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list api keys", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"api_keys": keys},
+	)
+}
+
+func (h *Handler) DeleteAPIKey(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	keyID := ctx.Param("key_id")
+
+	result := h.db.Where("id = ? AND user_id = ?", keyID, currentUser).Delete(&utils.APIKey{})
+	if result.Error != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to delete api key", "error", result.Error.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if result.RowsAffected == 0 {
+		ctx.JSON(
+			http.StatusNotFound,
+			gin.H{"message": "API key not found"},
+		)
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionAPIKeyDelete, TargetID: keyID})
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"message": "API key revoked"},
+	)
+}
+
+// authenticateAPIKey resolves a bearer key to its owner and scopes.
+func authenticateAPIKey(ctx context.Context, DB *gorm.DB, plainKey string) (*utils.APIKey, error) {
+	if !strings.HasPrefix(plainKey, apiKeyPrefix) {
+		return nil, errors.New("not an api key")
+	}
+	var key utils.APIKey
+	err := DB.Model(utils.APIKey{}).Where("hash = ?", hashAPIKey(plainKey)).First(&key).Error
+	if err != nil {
+		return nil, err
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("api key expired")
+	}
+	var disabled bool
+	if err := DB.Model(utils.User{}).Where("id = ?", key.UserID).Pluck("disabled", &disabled).Error; err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, errors.New("account disabled")
+	}
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > lastUsedResolution {
+		if err := DB.Model(&key).Update("last_used_at", time.Now()).Error; err != nil {
+			slog.WarnContext(ctx, "Failed to record api key use", "key_id", key.ID, "error", err.Error())
+		}
+	}
+	return &key, nil
+}
+
+// allowedByScopes reports whether a request is within what the key's scopes permit.
+func allowedByScopes(ctx *gin.Context, scopes []string) bool {
+	path := ctx.FullPath()
+	if !slices.ContainsFunc(apiKeyRoutes, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+		return false
+	}
+	canRead, canWrite := false, false
+	var pinnedDocs []string
+	for _, scope := range scopes {
+		switch {
+		case scope == ScopeDocumentsRead:
+			canRead = true
+		case scope == ScopeDocumentsWrite:
+			canRead, canWrite = true, true
+		case strings.HasPrefix(scope, ScopeDocumentPrefix):
+			pinnedDocs = append(pinnedDocs, strings.TrimPrefix(scope, ScopeDocumentPrefix))
+		}
+	}
+
+	if len(pinnedDocs) > 0 && !slices.Contains(pinnedDocs, ctx.Param("doc_id")) {
+		return false
+	}
+	switch ctx.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		// websocket sessions can edit, so they need write access
+		if strings.HasPrefix(path, "/protected/ws/") {
+			return canWrite
+		}
+		return canRead
+	default:
+		return canWrite
+	}
+}
+
+func validScopes(scopes []string) bool {
+	hasAccess := false
+	for _, scope := range scopes {
+		switch {
+		case scope == ScopeDocumentsRead, scope == ScopeDocumentsWrite:
+			hasAccess = true
+		case strings.HasPrefix(scope, ScopeDocumentPrefix) && len(scope) > len(ScopeDocumentPrefix):
+		default:
+			return false
+		}
+	}
+	return hasAccess
+}
+
+func hashAPIKey(plainKey string) string {
+	sum := sha256.Sum256([]byte(plainKey))
+	return hex.EncodeToString(sum[:])
+}
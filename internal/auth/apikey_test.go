@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowedByScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	read := []string{ScopeDocumentsRead}
+	write := []string{ScopeDocumentsWrite}
+	pinnedRead := []string{ScopeDocumentsRead, ScopeDocumentPrefix + "doc1"}
+	pinnedWrite := []string{ScopeDocumentsWrite, ScopeDocumentPrefix + "doc1"}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		scopes []string
+		want   bool
+	}{
+		{"read key reads a document", http.MethodGet, "/protected/document/doc2", read, true},
+		{"read key lists documents", http.MethodGet, "/protected/documents", read, true},
+		{"read key cannot create", http.MethodPost, "/protected/create-document", read, false},
+		{"write key creates", http.MethodPost, "/protected/create-document", write, true},
+		{"write key changes a document", http.MethodPost, "/protected/document/doc2/title", write, true},
+		{"read key cannot change a document", http.MethodPost, "/protected/document/doc2/title", read, false},
+		{"read key cannot open a socket", http.MethodGet, "/protected/ws/doc1", read, false},
+		{"write key opens a socket", http.MethodGet, "/protected/ws/doc1", write, true},
+		{"pinned key reads its document", http.MethodGet, "/protected/document/doc1", pinnedRead, true},
+		{"pinned key cannot read another document", http.MethodGet, "/protected/document/doc2", pinnedRead, false},
+		{"pinned key cannot list documents", http.MethodGet, "/protected/documents", pinnedRead, false},
+		{"pinned write key opens its socket", http.MethodGet, "/protected/ws/doc1", pinnedWrite, true},
+		{"pinned write key cannot open another socket", http.MethodGet, "/protected/ws/doc2", pinnedWrite, false},
+		{"pin alone grants nothing", http.MethodGet, "/protected/document/doc1", []string{ScopeDocumentPrefix + "doc1"}, false},
+		{"no scopes", http.MethodGet, "/protected/documents", nil, false},
+		{"account routes are refused", http.MethodGet, "/protected/api-keys", write, false},
+		{"webhooks are refused", http.MethodGet, "/protected/webhooks", write, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			r := documentRoutes(func(ctx *gin.Context) {
+				got = allowedByScopes(ctx, tt.scopes)
+			})
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			if got != tt.want {
+				t.Errorf("allowedByScopes(%s %s, %q) = %t, want %t", tt.method, tt.path, tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
+
+// documentRoutes registers handler on a few routes shaped like the real ones,
+// allowedByScopes looks at the route and its doc_id.
+func documentRoutes(handler gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	r.GET("/protected/document/:doc_id", handler)
+	r.POST("/protected/document/:doc_id/title", handler)
+	r.GET("/protected/documents", handler)
+	r.POST("/protected/create-document", handler)
+	r.GET("/protected/ws/:doc_id", handler)
+	r.GET("/protected/api-keys", handler)
+	r.GET("/protected/webhooks", handler)
+	return r
+}
+
+func TestValidScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		want   bool
+	}{
+		{"read", []string{ScopeDocumentsRead}, true},
+		{"write", []string{ScopeDocumentsWrite}, true},
+		{"pinned", []string{ScopeDocumentsRead, ScopeDocumentPrefix + "doc1"}, true},
+		{"pin without access", []string{ScopeDocumentPrefix + "doc1"}, false},
+		{"empty pin", []string{ScopeDocumentsRead, ScopeDocumentPrefix}, false},
+		{"unknown scope", []string{ScopeDocumentsRead, "admin"}, false},
+		{"none", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validScopes(tt.scopes); got != tt.want {
+				t.Errorf("validScopes(%q) = %t, want %t", tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"livescribble/internal/audit"
+	"livescribble/internal/ratelimit"
+	"livescribble/internal/room"
 	"livescribble/internal/utils"
 	"log/slog"
 	"net/http"
@@ -10,25 +15,47 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type Handler struct {
-	db     *gorm.DB
-	jwtKey []byte
-	logger *slog.Logger
+	db            *gorm.DB
+	redisClient   *redis.Client
+	keys          *KeySet
+	logger        *slog.Logger
+	lockout       *ratelimit.AccountLockout
+	audit         *audit.Log
+	rooms         Rooms
+	secureCookies string // auto, always or never
 }
+
+// Rooms is the part of room.RoomManager the handler needs.
+type Rooms interface {
+	// CloseRoom disconnects everyone editing a document.
+	CloseRoom(docId string, reason string)
+	// Kick disconnects a user from a document's room, or from every room
+	// when docId is empty, on whichever node holds it.
+	Kick(ctx context.Context, docId string, connId string, userId string, reason string) (*room.ClusterResult, error)
+}
+
 type Claims struct {
-	ID string `json:"id"`
+	ID      string `json:"id"`
+	Purpose string `json:"purpose,omitempty"` // empty for session tokens
 	jwt.RegisteredClaims
 }
 
-func NewHandler(db *gorm.DB, jwtKey []byte, logger *slog.Logger) *Handler {
+func NewHandler(db *gorm.DB, redisClient *redis.Client, keys *KeySet, logger *slog.Logger, lockout *ratelimit.AccountLockout, auditLog *audit.Log, rooms Rooms, secureCookies string) *Handler {
 	return &Handler{
-		db:     db,
-		jwtKey: jwtKey,
-		logger: logger,
+		db:            db,
+		redisClient:   redisClient,
+		keys:          keys,
+		logger:        logger,
+		lockout:       lockout,
+		audit:         auditLog,
+		rooms:         rooms,
+		secureCookies: secureCookies,
 	}
 }
 
@@ -49,9 +76,10 @@ func (h *Handler) Login(ctx *gin.Context) {
 	}
 
 	var user utils.User
-	err = h.db.Model(utils.User{}).Where("email = ?", req.Email).Error
+	err = h.db.Model(utils.User{}).Where("email = ?", req.Email).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			h.audit.Record(ctx, audit.Event{Action: audit.ActionLogin, Failed: true, Data: gin.H{"email": req.Email, "reason": "unknown_email"}})
 			ctx.JSON(
 				http.StatusBadRequest,
 				gin.H{"message": "User not found"},
@@ -65,8 +93,14 @@ func (h *Handler) Login(ctx *gin.Context) {
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(req.Password), []byte(user.Password))
+	if h.rejectLockedAccount(ctx, user.ID) {
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionLogin, ActorID: user.ID, Failed: true, Data: gin.H{"reason": "locked"}})
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
+		h.recordFailedAttempt(ctx, user.ID)
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionLogin, ActorID: user.ID, Failed: true, Data: gin.H{"reason": "password"}})
 		ctx.JSON(
 			http.StatusBadRequest,
 			gin.H{"message": "Incorrect password"},
@@ -74,10 +108,47 @@ func (h *Handler) Login(ctx *gin.Context) {
 		return
 	}
 
-	//Password and Email Correct
-	token, err := createToken(user.ID, h.jwtKey, 7)
+	if user.Disabled {
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionLogin, ActorID: user.ID, Failed: true, Data: gin.H{"reason": "disabled"}})
+		ctx.JSON(
+			http.StatusForbidden,
+			gin.H{"message": "Account disabled"},
+		)
+		return
+	}
+
+	//Password and Email Correct, second factor still pending
+	if user.TOTPEnabled {
+		mfaToken, err := createMFAToken(user.ID, h.keys)
+		if err != nil {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to create mfa token", "error", err.Error())
+			ctx.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Server error"},
+			)
+			return
+		}
+		ctx.JSON(
+			http.StatusOK,
+			gin.H{
+				"message":      "Two-factor code required",
+				"mfa_required": true,
+				"mfa_token":    mfaToken,
+			},
+		)
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionLogin, ActorID: user.ID})
+	h.issueSession(ctx, user.ID)
+}
+
+// issueSession sets the 7 day auth cookie once every login step has passed.
+func (h *Handler) issueSession(ctx *gin.Context, userID string) {
+	h.lockout.Reset(ctx.Request.Context(), userID)
+	token, err := createToken(userID, h.keys, 7)
 	if err != nil {
-		h.logger.Error("Failed to create token", "error", err.Error())
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create token", "error", err.Error())
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
@@ -105,7 +176,7 @@ func (h *Handler) CreateTempUser(ctx *gin.Context) {
 
 	tempID, err := generateTempID()
 	if err != nil {
-		h.logger.Error("Failed to generate temp user id", "error", err)
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to generate temp user id", "error", err)
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
@@ -114,12 +185,12 @@ func (h *Handler) CreateTempUser(ctx *gin.Context) {
 	}
 
 	// Add "temp" prefix to the ID
-	tempUserID := "temp" + tempID
+	tempUserID := TempUserPrefix + tempID
 
 	// Hash the password before storing
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		h.logger.Error("Failed to hash password", "error", err)
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to hash password", "error", err)
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
@@ -139,7 +210,7 @@ func (h *Handler) CreateTempUser(ctx *gin.Context) {
 
 	err = h.db.Create(&tempUser).Error
 	if err != nil {
-		h.logger.Error("Failed to create temp user", "error", err.Error())
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create temp user", "error", err.Error())
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
@@ -148,9 +219,9 @@ func (h *Handler) CreateTempUser(ctx *gin.Context) {
 	}
 
 	// Create token that lasts 1 day
-	token, err := createToken(tempUser.ID, h.jwtKey, 1)
+	token, err := createToken(tempUser.ID, h.keys, 1)
 	if err != nil {
-		h.logger.Error("Failed to create token for temp user", "error", err.Error())
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create token for temp user", "error", err.Error())
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
@@ -158,6 +229,7 @@ func (h *Handler) CreateTempUser(ctx *gin.Context) {
 		return
 	}
 
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionTempUser, ActorID: tempUser.ID})
 	h.setCookie(ctx, token, 24*time.Hour)
 	ctx.JSON(
 		http.StatusOK,
@@ -179,51 +251,32 @@ func (h *Handler) Register(ctx *gin.Context) {
 		return
 	}
 
-	var checkUser utils.User
-	err = h.db.Model(utils.User{}).Where("email = ?", req.Email).First(&checkUser).Error
-	if err == nil {
-		ctx.JSON(
-			http.StatusBadRequest,
-			gin.H{"message": "User already exists"},
-		)
-		return
-	}
-	//user doesnt exist, create
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		h.logger.Error("Failed to hash password", "error", err)
-		ctx.JSON(
-			http.StatusInternalServerError,
-			gin.H{"message": "Server error"},
-		)
-		return
-	}
-	userID, err := generateUserID()
-	if err != nil {
-		h.logger.Error("Failed to generate user id", "error", err)
-		ctx.JSON(
-			http.StatusInternalServerError,
-			gin.H{"message": "Server error"},
-		)
-		return
-	}
-	newUser := utils.User{
-		ID:       userID,
-		Email:    req.Email,
-		Password: string(hashedPassword),
-	}
-	err = h.db.Create(&newUser).Error
+	newUser, err := CreateUser(h.db, req.Email, req.Password, false)
 	if err != nil {
-		h.logger.Error("Failed to save user", "error", err.Error())
+		if errors.Is(err, ErrWeakPassword) {
+			ctx.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": fmt.Sprintf("Password must be at least %d characters", minPasswordLength)},
+			)
+			return
+		}
+		if errors.Is(err, ErrEmailTaken) {
+			ctx.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "User already exists"},
+			)
+			return
+		}
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to save user", "error", err.Error())
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
 		)
 		return
 	}
-	token, err := createToken(newUser.ID, h.jwtKey, 7)
+	token, err := createToken(newUser.ID, h.keys, 7)
 	if err != nil {
-		h.logger.Error("Failed to generate access token ", "error", err.Error())
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to generate access token ", "error", err.Error())
 		ctx.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Server error"},
@@ -231,6 +284,7 @@ func (h *Handler) Register(ctx *gin.Context) {
 		return
 	}
 
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionRegister, ActorID: newUser.ID})
 	h.setCookie(ctx, token, 7*24*time.Hour)
 	ctx.JSON(
 		http.StatusOK,
@@ -238,15 +292,39 @@ func (h *Handler) Register(ctx *gin.Context) {
 	)
 }
 
-func createToken(id string, secretKey []byte, duration int) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+// rejectLockedAccount answers 429 with Retry-After while the account is
+// locked out from repeated failures.
+func (h *Handler) rejectLockedAccount(ctx *gin.Context, userID string) bool {
+	wait, err := h.lockout.Locked(ctx.Request.Context(), userID)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to check account lockout", "error", err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+	ratelimit.SetRetryAfter(ctx, wait)
+	ctx.JSON(
+		http.StatusTooManyRequests,
+		gin.H{"message": "Too many failed attempts, account temporarily locked"},
+	)
+	return true
+}
+
+func (h *Handler) recordFailedAttempt(ctx *gin.Context, userID string) {
+	if _, err := h.lockout.RecordFailure(ctx.Request.Context(), userID); err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to record failed login", "error", err)
+	}
+}
+
+func createToken(id string, keys *KeySet, duration int) (string, error) {
+	tokenString, err := keys.Sign(Claims{
 		ID: id,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24 * time.Duration(duration))),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	})
-	tokenString, err := token.SignedString(secretKey)
 	if err != nil {
 		return "", err
 	}
@@ -261,15 +339,34 @@ func generateTempID() (string, error) {
 	return utils.RandomString(6)
 }
 
+// setCookie marks the cookie Secure whenever the client reached us over
+// HTTPS. Cross-site frontends need SameSite=None, which browsers only
+// accept on Secure cookies, so plain HTTP (local development) gets Lax.
 func (h *Handler) setCookie(ctx *gin.Context, token string, maxAge time.Duration) {
-    ctx.SetSameSite(http.SameSiteNoneMode)  // TODO:change
+	secure := h.secureCookie(ctx)
+	if secure {
+		ctx.SetSameSite(http.SameSiteNoneMode)
+	} else {
+		ctx.SetSameSite(http.SameSiteLaxMode)
+	}
 	ctx.SetCookie(
-		"auth_token",          
-		token,                 
-		int(maxAge.Seconds()), 
-		"/",                   
-		"",                    
-		true,                 
-		true,                 	
+		"auth_token",
+		token,
+		int(maxAge.Seconds()),
+		"/",
+		"",
+		secure,
+		true,
 	)
 }
+
+func (h *Handler) secureCookie(ctx *gin.Context) bool {
+	switch h.secureCookies {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	// behind a TLS-terminating proxy the request itself is plain HTTP
+	return ctx.Request.TLS != nil || ctx.GetHeader("X-Forwarded-Proto") == "https"
+}
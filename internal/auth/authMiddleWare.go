@@ -1,16 +1,42 @@
 package auth
 
 import (
+	"encoding/json"
 	"livescribble/internal/utils"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"gorm.io/gorm"
 )
 
-func MiddleWare(jwtKey []byte, DB *gorm.DB) gin.HandlerFunc {
+func MiddleWare(keys *KeySet, DB *gorm.DB) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		//scripts and bots authenticate with an API key instead of the cookie
+		if bearer, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer "); ok {
+			key, err := authenticateAPIKey(ctx.Request.Context(), DB, strings.TrimSpace(bearer))
+			if err != nil {
+				ctx.JSON(http.StatusUnauthorized, gin.H{
+					"message": "Invalid API key",
+				})
+				ctx.Abort()
+				return
+			}
+			var scopes []string
+			if err := json.Unmarshal([]byte(key.Scopes), &scopes); err != nil || !allowedByScopes(ctx, scopes) {
+				ctx.JSON(http.StatusForbidden, gin.H{
+					"message": "API key scope does not allow this request",
+				})
+				ctx.Abort()
+				return
+			}
+			ctx.Set("current_user", key.UserID)
+			ctx.Set("api_key", true)
+			ctx.Set("api_key_scopes", scopes)
+			ctx.Next()
+			return
+		}
+
 		//get the jwt token from cookie
 		tokenString, err := ctx.Cookie("auth_token")
 		if err != nil || tokenString == "" {
@@ -22,23 +48,18 @@ func MiddleWare(jwtKey []byte, DB *gorm.DB) gin.HandlerFunc {
 		}
 
 		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(
-			tokenString,
-			claims,
-			func(t *jwt.Token) (interface{}, error) {
-				return jwtKey, nil
-			},
-		)
+		token, err := keys.Parse(tokenString, claims)
 		//throw error for invalid token or error
-		if err != nil || !token.Valid {
+		if err != nil || !token.Valid || claims.Purpose != "" {
 			ctx.JSON(http.StatusUnauthorized, gin.H{
 				"message": "Invalid Authorization Token",
 			})
 			ctx.Abort()
+			return
 		}
 		var user utils.User
 		err = DB.Model(utils.User{}).Where("id = ?", claims.ID).First(&user).Error
-		if err != nil {
+		if err != nil || user.Disabled || sessionRevoked(&user, claims) {
 			ctx.JSON(
 				http.StatusUnauthorized, gin.H{
 					"message": "Invalid Authorization Token",
@@ -51,3 +72,42 @@ func MiddleWare(jwtKey []byte, DB *gorm.DB) gin.HandlerFunc {
 		ctx.Next()
 	}
 }
+
+func sessionRevoked(user *utils.User, claims *Claims) bool {
+	if user.SessionsValidAfter.IsZero() {
+		return false
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(user.SessionsValidAfter)
+}
+
+// RequireSession refuses API keys. It runs after MiddleWare, in front of
+// routes that act on the account as a whole rather than on documents, and
+// is the only place that keeps keys away from them.
+func RequireSession() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.GetBool("api_key") {
+			ctx.AbortWithStatusJSON(
+				http.StatusForbidden,
+				gin.H{"message": "This action requires a login session"},
+			)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireAdmin lets only admins through. It runs after MiddleWare.
+func RequireAdmin(DB *gorm.DB) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var user utils.User
+		err := DB.Model(utils.User{}).Select("id, admin").Where("id = ?", ctx.GetString("current_user")).First(&user).Error
+		if err != nil || !user.Admin {
+			ctx.JSON(http.StatusForbidden, gin.H{
+				"message": "admin access required",
+			})
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -1,28 +1,23 @@
 package auth
 
 import (
-
-	"os"
+	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func CORSMiddleware(allowedOrigins []string ) gin.HandlerFunc {
+func CORSMiddleware(allowedOrigins []string, allowAll bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		origin := c.Request.Header.Get("Origin")
 		allowed := false
 
 		// Check if origin is empty (same-origin request)
-		if origin == ""  || os.Getenv("ALLOW_ALL_ORIGINS")=="true" {
+		if origin == "" || allowAll {
 			allowed = true
 		} else {
-			// Check against allowed origins list
-			for _, allowedOrigin := range allowedOrigins {
-				if origin == allowedOrigin {
-					allowed = true
-					break
-				}
-			}
+			allowed = originListed(origin, allowedOrigins)
 		}
 
 		if !allowed {
@@ -33,9 +28,9 @@ func CORSMiddleware(allowedOrigins []string ) gin.HandlerFunc {
 		if origin != "" {
 			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
 			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Upgrade, Connection, Sec-WebSocket-Key, Sec-WebSocket-Version, Sec-WebSocket-Protocol")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Upgrade, Connection, Sec-WebSocket-Key, Sec-WebSocket-Version, Sec-WebSocket-Protocol, X-Request-ID")
 			c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-			c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length")
+			c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Request-ID")
 			c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
 		}
 
@@ -46,4 +41,28 @@ func CORSMiddleware(allowedOrigins []string ) gin.HandlerFunc {
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// CheckOrigin is the WebSocket upgrader's origin check. Browsers send the
+// session cookie cross-site, so only the configured origins and the server's
+// own host may open a socket. Requests without an Origin do not come from a
+// browser and are let through.
+func CheckOrigin(allowedOrigins []string, allowAll bool) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowAll || originListed(origin, allowedOrigins) {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+func originListed(origin string, allowedOrigins []string) bool {
+	for _, allowedOrigin := range allowedOrigins {
+		if origin == allowedOrigin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKid names the key built from JWT_KEY. Tokens issued before key
+// rotation have no kid header and are checked against it.
+const legacyKid = "legacy"
+
+// KeyConfig describes one JWT key, an entry of auth.jwt_keys or JWT_KEYS.
+// HS256 keys carry a secret, EdDSA and RS256 keys point at PEM files. A key
+// with only a public key file can verify tokens but never signs them, which
+// is how a retired key is kept around until its tokens expire.
+type KeyConfig struct {
+	Kid            string `json:"kid"`
+	Alg            string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private interface{} // []byte for HMAC, crypto.Signer otherwise, nil if verify-only
+	public  interface{} // []byte for HMAC, crypto.PublicKey otherwise
+}
+
+// KeySet holds every key tokens may be verified against and the one new
+// tokens are signed with.
+type KeySet struct {
+	keys   map[string]*signingKey
+	active *signingKey
+}
+
+// LoadKeySet builds the key set from the configured keys, the signing kid
+// and the legacy HS256 secret. Without a signing kid the first configured
+// key that can sign is used, falling back to the legacy secret.
+func LoadKeySet(configs []KeyConfig, legacy string, signingKid string) (*KeySet, error) {
+	configs = append([]KeyConfig(nil), configs...)
+	if legacy != "" {
+		configs = append(configs, KeyConfig{Kid: legacyKid, Alg: "HS256", Secret: legacy})
+	}
+	return NewKeySet(configs, signingKid)
+}
+
+func NewKeySet(configs []KeyConfig, signingKid string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*signingKey)}
+	for _, cfg := range configs {
+		key, err := parseKeyConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", cfg.Kid, err)
+		}
+		if _, exists := ks.keys[key.kid]; exists {
+			return nil, fmt.Errorf("duplicate jwt kid %q", key.kid)
+		}
+		ks.keys[key.kid] = key
+		if ks.active == nil && key.private != nil && (signingKid == "" || signingKid == key.kid) {
+			ks.active = key
+		}
+	}
+	if ks.active == nil {
+		if signingKid != "" {
+			return nil, fmt.Errorf("signing kid %q not found or has no private key", signingKid)
+		}
+		return nil, errors.New("no JWT signing key configured, set JWT_KEYS or JWT_KEY")
+	}
+	return ks, nil
+}
+
+func parseKeyConfig(cfg KeyConfig) (*signingKey, error) {
+	if cfg.Kid == "" {
+		return nil, errors.New("missing kid")
+	}
+	key := &signingKey{kid: cfg.Kid}
+	switch cfg.Alg {
+	case "HS256":
+		if cfg.Secret == "" {
+			return nil, errors.New("HS256 key needs a secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.private = []byte(cfg.Secret)
+		key.public = []byte(cfg.Secret)
+		return key, nil
+	case "EdDSA":
+		key.method = jwt.SigningMethodEdDSA
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", cfg.Alg)
+	}
+
+	if cfg.PrivateKeyFile != "" {
+		block, err := readPEM(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing private key: %w", err)
+			}
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("private key cannot sign")
+		}
+		key.private = signer
+		key.public = signer.Public()
+	} else if cfg.PublicKeyFile != "" {
+		block, err := readPEM(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key: %w", err)
+		}
+		key.public = public
+	} else {
+		return nil, errors.New("needs a private_key_file or public_key_file")
+	}
+
+	switch key.public.(type) {
+	case ed25519.PublicKey:
+		if cfg.Alg != "EdDSA" {
+			return nil, errors.New("ed25519 key used with " + cfg.Alg)
+		}
+	case *rsa.PublicKey:
+		if cfg.Alg != "RS256" {
+			return nil, errors.New("rsa key used with " + cfg.Alg)
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+	return block, nil
+}
+
+// Sign issues a token with the active key and stamps its kid in the header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.kid
+	return token.SignedString(ks.active.private)
+}
+
+// Parse verifies a token against the key named by its kid header. The token's
+// alg has to match the key's, so a public key can never be used as an HMAC
+// secret.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			kid = legacyKid
+		}
+		key, ok := ks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected alg %q for kid %q", t.Method.Alg(), kid)
+		}
+		return key.public, nil
+	})
+}
+
+// JWKS serves the public half of every asymmetric key so other services can
+// verify our tokens. HMAC secrets are never published.
+func (ks *KeySet) JWKS(ctx *gin.Context) {
+	jwks := make([]gin.H, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, gin.H{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": key.kid,
+				"alg": key.method.Alg(),
+				"use": "sig",
+				"x":   base64.RawURLEncoding.EncodeToString(public),
+			})
+		case *rsa.PublicKey:
+			jwks = append(jwks, gin.H{
+				"kty": "RSA",
+				"kid": key.kid,
+				"alg": key.method.Alg(),
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"keys": jwks})
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM stores der as a PEM file in dir and returns its path.
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testKeys writes an Ed25519 key pair and an RSA private key and returns
+// configs for them: "ed" signs, "ed-retired" only verifies and "rsa" signs.
+func testKeys(t *testing.T) (ed KeyConfig, edRetired KeyConfig, rsaKey KeyConfig, edPublic ed25519.PublicKey) {
+	t.Helper()
+	dir := t.TempDir()
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(edPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed = KeyConfig{Kid: "ed", Alg: "EdDSA", PrivateKeyFile: writePEM(t, dir, "ed.pem", "PRIVATE KEY", privateDER)}
+	edRetired = KeyConfig{Kid: "ed-retired", Alg: "EdDSA", PublicKeyFile: writePEM(t, dir, "ed.pub", "PUBLIC KEY", publicDER)}
+	rsaKey = KeyConfig{Kid: "rsa", Alg: "RS256", PrivateKeyFile: writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaPrivate))}
+	return ed, edRetired, rsaKey, edPublic
+}
+
+func TestLoadKeySet(t *testing.T) {
+	ed, edRetired, rsaKey, _ := testKeys(t)
+
+	tests := []struct {
+		name       string
+		configs    []KeyConfig
+		legacy     string
+		signingKid string
+		wantKid    string // empty when loading should fail
+	}{
+		{"legacy only", nil, "secret", "", legacyKid},
+		{"first key that can sign", []KeyConfig{edRetired, rsaKey, ed}, "secret", "", "rsa"},
+		{"signing kid", []KeyConfig{ed, rsaKey}, "secret", "rsa", "rsa"},
+		{"signing kid is legacy", []KeyConfig{ed}, "secret", legacyKid, legacyKid},
+		{"signing kid without private key", []KeyConfig{edRetired}, "secret", "ed-retired", ""},
+		{"unknown signing kid", []KeyConfig{ed}, "", "missing", ""},
+		{"nothing can sign", []KeyConfig{edRetired}, "", "", ""},
+		{"duplicate kid", []KeyConfig{ed, ed}, "", "", ""},
+		{"missing kid", []KeyConfig{{Alg: "HS256", Secret: "s"}}, "", "", ""},
+		{"unsupported alg", []KeyConfig{{Kid: "a", Alg: "none", Secret: "s"}}, "", "", ""},
+		{"HS256 without secret", []KeyConfig{{Kid: "a", Alg: "HS256"}}, "", "", ""},
+		{"alg does not match key", []KeyConfig{{Kid: "a", Alg: "RS256", PrivateKeyFile: ed.PrivateKeyFile}}, "", "", ""},
+		{"no key file", []KeyConfig{{Kid: "a", Alg: "EdDSA"}}, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks, err := LoadKeySet(tt.configs, tt.legacy, tt.signingKid)
+			if tt.wantKid == "" {
+				if err == nil {
+					t.Fatalf("LoadKeySet succeeded with signing key %q", ks.active.kid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadKeySet: %v", err)
+			}
+			if ks.active.kid != tt.wantKid {
+				t.Errorf("signing kid = %q, want %q", ks.active.kid, tt.wantKid)
+			}
+		})
+	}
+}
+
+func TestKeySetParse(t *testing.T) {
+	ed, edRetired, rsaKey, edPublic := testKeys(t)
+	ks, err := LoadKeySet([]KeyConfig{ed, edRetired, rsaKey}, "secret", "ed")
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	signed, err := ks.Sign(&Claims{ID: "user"})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	// the same private key stands behind "ed" and "ed-retired"
+	retired := signWith(t, jwt.SigningMethodEdDSA, "ed-retired", ks.keys["ed"].private)
+	rsaSigned := signWith(t, jwt.SigningMethodRS256, "rsa", ks.keys["rsa"].private)
+	legacy := signWith(t, jwt.SigningMethodHS256, "", []byte("secret"))
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"active key", signed, true},
+		{"verify-only key", retired, true},
+		{"other configured key", rsaSigned, true},
+		{"no kid checks the legacy key", legacy, true},
+		{"unknown kid", signWith(t, jwt.SigningMethodHS256, "missing", []byte("secret")), false},
+		{"wrong secret", signWith(t, jwt.SigningMethodHS256, legacyKid, []byte("other")), false},
+		{"public key as HMAC secret", signWith(t, jwt.SigningMethodHS256, "ed", []byte(edPublic)), false},
+		{"alg other than the key's", signWith(t, jwt.SigningMethodHS384, legacyKid, []byte("secret")), false},
+		{"kid of another key", signWith(t, jwt.SigningMethodEdDSA, "rsa", ks.keys["ed"].private), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims Claims
+			_, err := ks.Parse(tt.token, &claims)
+			if tt.valid && err != nil {
+				t.Errorf("Parse: %v", err)
+			}
+			if tt.valid && claims.ID != "user" {
+				t.Errorf("claims.ID = %q, want %q", claims.ID, "user")
+			}
+			if !tt.valid && err == nil {
+				t.Error("Parse accepted the token")
+			}
+		})
+	}
+}
+
+// signWith signs a token for "user" with key, setting kid unless it is empty.
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, &Claims{ID: "user"})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
@@ -0,0 +1,402 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"livescribble/internal/audit"
+	"livescribble/internal/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	totpIssuer        = "LiveScribble"
+	mfaTokenPurpose   = "mfa"
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+
+	// totpPeriod is how long each code lasts. One step either side of now is
+	// accepted for clock drift, as totp.Validate does.
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
+// claimTOTPStep records the time step of an accepted code as the user's last
+// and refuses a step at or before the last one, so a code cannot be used
+// twice. The record expires once its step has left the accepted window.
+var claimTOTPStep = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[1]) or '-1')
+local step = tonumber(ARGV[1])
+if step <= last then
+	return 0
+end
+redis.call('SET', KEYS[1], step, 'PX', ARGV[2])
+return 1
+`)
+
+type TOTPRequest struct {
+	Code     string `json:"code"`
+	MFAToken string `json:"mfa_token"`
+	Password string `json:"password"`
+}
+
+// EnrollTOTP generates a fresh secret for the current user. 2FA stays disabled
+// until the user proves they can produce a code through VerifyTOTP.
+func (h *Handler) EnrollTOTP(ctx *gin.Context) {
+	var user utils.User
+	err := h.db.Model(utils.User{}).Where("id = ?", ctx.GetString("current_user")).First(&user).Error
+	if err != nil {
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if user.TOTPEnabled {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Two-factor authentication is already enabled"},
+		)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to generate totp secret", "error", err)
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	err = h.db.Model(&user).Update("totp_secret", key.Secret()).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to save totp secret", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{
+			"secret":           key.Secret(),
+			"provisioning_uri": key.URL(),
+		},
+	)
+}
+
+// VerifyTOTP confirms enrollment with a code from the authenticator app, turns
+// 2FA on and hands back the one-time recovery codes.
+func (h *Handler) VerifyTOTP(ctx *gin.Context) {
+	var req TOTPRequest
+	err := json.Unmarshal([]byte(ctx.PostForm("request")), &req)
+	if err != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Missing Request"},
+		)
+		return
+	}
+
+	var user utils.User
+	err = h.db.Model(utils.User{}).Where("id = ?", ctx.GetString("current_user")).First(&user).Error
+	if err != nil {
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "No pending two-factor enrollment"},
+		)
+		return
+	}
+	ok, err := h.validateTOTP(ctx.Request.Context(), &user, strings.TrimSpace(req.Code))
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to check totp code", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if !ok {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Invalid code"},
+		)
+		return
+	}
+
+	var codes []string
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("totp_enabled", true).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to enable totp", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionTOTPEnable})
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{
+			"message":        "Two-factor authentication enabled",
+			"recovery_codes": codes,
+		},
+	)
+}
+
+// DisableTOTP turns 2FA off. It asks for the password and a current code (or
+// recovery code) so a stolen session alone is not enough.
+func (h *Handler) DisableTOTP(ctx *gin.Context) {
+	var req TOTPRequest
+	err := json.Unmarshal([]byte(ctx.PostForm("request")), &req)
+	if err != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Missing Request"},
+		)
+		return
+	}
+
+	var user utils.User
+	err = h.db.Model(utils.User{}).Where("id = ?", ctx.GetString("current_user")).First(&user).Error
+	if err != nil {
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if !user.TOTPEnabled {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Two-factor authentication is not enabled"},
+		)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Incorrect password"},
+		)
+		return
+	}
+	ok, err := h.checkSecondFactor(ctx.Request.Context(), &user, req.Code)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to check second factor", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if !ok {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Invalid code"},
+		)
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&utils.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled": false,
+			"totp_secret":  "",
+		}).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to disable totp", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionTOTPDisable})
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"message": "Two-factor authentication disabled"},
+	)
+}
+
+// LoginTOTP is the second step of Login for accounts with 2FA. It trades the
+// short-lived mfa_token plus a TOTP or recovery code for the session cookie.
+func (h *Handler) LoginTOTP(ctx *gin.Context) {
+	var req TOTPRequest
+	err := json.Unmarshal([]byte(ctx.PostForm("request")), &req)
+	if err != nil {
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Missing Request"},
+		)
+		return
+	}
+
+	claims := &Claims{}
+	token, err := h.keys.Parse(req.MFAToken, claims)
+	if err != nil || !token.Valid || claims.Purpose != mfaTokenPurpose {
+		ctx.JSON(
+			http.StatusUnauthorized,
+			gin.H{"message": "Login step expired, sign in again"},
+		)
+		return
+	}
+
+	var user utils.User
+	err = h.db.Model(utils.User{}).Where("id = ?", claims.ID).First(&user).Error
+	if err != nil || !user.TOTPEnabled || user.Disabled {
+		ctx.JSON(
+			http.StatusUnauthorized,
+			gin.H{"message": "Login step expired, sign in again"},
+		)
+		return
+	}
+
+	if h.rejectLockedAccount(ctx, user.ID) {
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionLoginTOTP, ActorID: user.ID, Failed: true, Data: gin.H{"reason": "locked"}})
+		return
+	}
+	ok, err := h.checkSecondFactor(ctx.Request.Context(), &user, req.Code)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to check second factor", "error", err.Error())
+		ctx.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Server error"},
+		)
+		return
+	}
+	if !ok {
+		h.recordFailedAttempt(ctx, user.ID)
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionLoginTOTP, ActorID: user.ID, Failed: true, Data: gin.H{"reason": "code"}})
+		ctx.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Invalid code"},
+		)
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionLoginTOTP, ActorID: user.ID})
+	h.issueSession(ctx, user.ID)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both are single use.
+func (h *Handler) checkSecondFactor(ctx context.Context, user *utils.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if ok, err := h.validateTOTP(ctx, user, code); ok || err != nil {
+		return ok, err
+	}
+
+	var recoveryCodes []utils.RecoveryCode
+	err := h.db.Model(utils.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Find(&recoveryCodes).Error
+	if err != nil {
+		return false, err
+	}
+	for _, rc := range recoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(rc.Hash), []byte(strings.ToLower(code))) == nil {
+			result := h.db.Model(&rc).Where("used_at IS NULL").Update("used_at", time.Now())
+			if result.Error != nil {
+				return false, result.Error
+			}
+			return result.RowsAffected == 1, nil
+		}
+	}
+	return false, nil
+}
+
+// validateTOTP checks code against the user's secret and, when it matches,
+// claims its time step so the same code, or an older one, is refused later.
+func (h *Handler) validateTOTP(ctx context.Context, user *utils.User, code string) (bool, error) {
+	now := time.Now()
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		ok, _ := totp.ValidateCustom(code, user.TOTPSecret, t, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if !ok {
+			continue
+		}
+		step := t.Unix() / totpPeriod
+		ttl := time.Duration(2*totpSkew+1) * totpPeriod * time.Second
+		claimed, err := claimTOTPStep.Run(ctx, h.redisClient, []string{"totp:" + user.ID}, step, ttl.Milliseconds()).Int()
+		return claimed == 1, err
+	}
+	return false, nil
+}
+
+// replaceRecoveryCodes drops any existing codes for the user and stores a new
+// hashed set, returning the plaintext codes.
+func replaceRecoveryCodes(tx *gorm.DB, userID string) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&utils.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(raw)
+		code = code[:5] + "-" + code[5:]
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&utils.RecoveryCode{UserID: userID, Hash: string(hash)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func createMFAToken(id string, keys *KeySet) (string, error) {
+	return keys.Sign(Claims{
+		ID:      id,
+		Purpose: mfaTokenPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+}
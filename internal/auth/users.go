@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"livescribble/internal/document"
+	"livescribble/internal/utils"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// TempUserPrefix starts the ID of every account made by CreateTempUser.
+const TempUserPrefix = utils.TempUserPrefix
+
+var (
+	ErrEmailTaken   = errors.New("email already in use")
+	ErrWeakPassword = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+)
+
+// CheckPassword rejects passwords shorter than the minimum length.
+func CheckPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return ErrWeakPassword
+	}
+	return nil
+}
+
+// CreateUser registers a new account. It returns ErrWeakPassword for a
+// password CheckPassword rejects and ErrEmailTaken when another account has
+// the email.
+func CreateUser(db *gorm.DB, email string, password string, admin bool) (*utils.User, error) {
+	if err := CheckPassword(password); err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := db.Model(utils.User{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrEmailTaken
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := generateUserID()
+	if err != nil {
+		return nil, err
+	}
+	user := &utils.User{
+		ID:       userID,
+		Email:    email,
+		Password: string(hashedPassword),
+		Admin:    admin,
+	}
+	if err := db.Create(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// FindUser looks a user up by ID or, when the value holds an @, by email.
+func FindUser(db *gorm.DB, idOrEmail string) (*utils.User, error) {
+	column := "id"
+	if strings.Contains(idOrEmail, "@") {
+		column = "email"
+	}
+	var user utils.User
+	if err := db.Model(utils.User{}).Where(column+" = ?", idOrEmail).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetPassword replaces the user's password and revokes every session
+// issued before now.
+func SetPassword(db *gorm.DB, userID string, password string) error {
+	if err := CheckPassword(password); err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return db.Model(utils.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"password":             string(hashedPassword),
+		"sessions_valid_after": time.Now().Truncate(time.Second),
+	}).Error
+}
+
+// SetDisabled blocks or unblocks an account. Disabling also revokes its
+// sessions, so it stays signed out when enabled again.
+func SetDisabled(db *gorm.DB, userID string, disabled bool) error {
+	updates := map[string]interface{}{"disabled": disabled}
+	if disabled {
+		updates["sessions_valid_after"] = time.Now().Truncate(time.Second)
+	}
+	return db.Model(utils.User{}).Where("id = ?", userID).Updates(updates).Error
+}
+
+// DeleteUser removes the user along with their keys, recovery codes,
+// notifications and webhooks, and takes them off everything shared with
+// them. Owned documents and folders go to heirID when set and are deleted
+// otherwise; the IDs of deleted documents are returned so their rooms can be
+// closed. Their comments are deleted, threads they started that others
+// replied to stay without an author.
+func DeleteUser(db *gorm.DB, userID string, heirID string) ([]string, error) {
+	var deleted []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if heirID != "" {
+			if err := tx.Model(utils.Document{}).Where("user_id = ?", userID).Update("user_id", heirID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(utils.Folder{}).Where("user_id = ?", userID).Update("user_id", heirID).Error; err != nil {
+				return err
+			}
+		} else {
+			if err := tx.Model(utils.Document{}).Where("user_id = ?", userID).Pluck("id", &deleted).Error; err != nil {
+				return err
+			}
+			threads := tx.Model(utils.CommentThread{}).Select("id").Where("document_id IN ?", deleted)
+			if err := tx.Where("thread_id IN (?)", threads).Delete(&utils.Comment{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("document_id IN ?", deleted).Delete(&utils.CommentThread{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", userID).Delete(&utils.Document{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", userID).Delete(&utils.Folder{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := document.RemoveUserAccess(tx, userID); err != nil {
+			return err
+		}
+		if err := deleteComments(tx, userID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&utils.APIKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&utils.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&utils.Notification{}).Error; err != nil {
+			return err
+		}
+		hooks := tx.Model(utils.Webhook{}).Select("id").Where("user_id = ?", userID)
+		if err := tx.Where("webhook_id IN (?)", hooks).Delete(&utils.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&utils.Webhook{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", userID).Delete(&utils.User{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// deleteComments deletes the user's comments on documents that stay. As
+// when a comment is deleted by hand, threads left empty go with them.
+func deleteComments(tx *gorm.DB, userID string) error {
+	var threadIDs []string
+	err := tx.Model(utils.CommentThread{}).Where("user_id = ?", userID).
+		Or("id IN (?)", tx.Model(utils.Comment{}).Select("thread_id").Where("user_id = ?", userID)).
+		Pluck("id", &threadIDs).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&utils.Comment{}).Error; err != nil {
+		return err
+	}
+	err = tx.Where("id IN ? AND NOT EXISTS (SELECT 1 FROM comments WHERE comments.thread_id = comment_threads.id)", threadIDs).
+		Delete(&utils.CommentThread{}).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(utils.CommentThread{}).Where("user_id = ?", userID).Update("user_id", "").Error; err != nil {
+		return err
+	}
+	return tx.Model(utils.CommentThread{}).Where("resolved_by = ?", userID).Update("resolved_by", nil).Error
+}
+
+// ExpiredTempUsers lists the temporary accounts whose day ran out before
+// cutoff.
+func ExpiredTempUsers(db *gorm.DB, cutoff time.Time) ([]utils.User, error) {
+	var users []utils.User
+	err := db.Model(utils.User{}).Select("id, email, deleted_at").
+		Where("id LIKE ? AND deleted_at IS NOT NULL AND deleted_at < ?", TempUserPrefix+"%", cutoff).
+		Order("deleted_at").Find(&users).Error
+	return users, err
+}
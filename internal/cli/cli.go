@@ -0,0 +1,289 @@
+// Package cli is the operator side of the binary: commands that fix
+// accounts, documents and rooms through the same code the server runs,
+// instead of raw SQL. They read the server's configuration, and every
+// change they make is audited with the actor "cli:<os user>".
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"livescribble/internal/audit"
+	"livescribble/internal/config"
+	"livescribble/internal/database"
+	"livescribble/internal/room"
+	"livescribble/internal/utils"
+	"log/slog"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// how long to wait for the nodes to answer a room command
+const clusterTimeout = 3 * time.Second
+
+type command struct {
+	name string // one word, or a group and a word
+	args string // shown after the name in the help
+	help string
+	run  func(e *env, args []string) error
+}
+
+var commands = []command{
+	{"migrate", "", "create or update the database schema", migrate},
+	{"user create", "-email EMAIL [-admin]", "create an account, the password is read from stdin", userCreate},
+	{"user disable", "USER", "block logins, sessions and API keys and disconnect the user's live sessions", userDisable},
+	{"user enable", "USER", "let a disabled user sign in again", userEnable},
+	{"user reset-password", "[-generate] USER", "set a new password from stdin, or a generated one, and sign the user out", userResetPassword},
+	{"doc export", "[-format md|html|txt] [-o FILE] DOC_ID", "render a document to stdout or FILE", docExport},
+	{"doc import", "-owner USER [-title TITLE] FILE...", "create documents from Markdown, HTML or text files", docImport},
+	{"doc transfer-owner", "[-previous-role ROLE] DOC_ID USER", "give a document to another user", docTransferOwner},
+	{"rooms list", "[-doc DOC_ID] [-json]", "show the open rooms on every node", roomsList},
+	{"purge-temp-users", "[-older-than DURATION] [-dry-run]", "delete expired temporary accounts and their documents", purgeTempUsers},
+}
+
+// Usage lists the commands. USER is a user ID or an email address.
+func Usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: livescribble [flags] [command [arguments]]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintf(w, "  %-22s %s\n", "serve", "run the server (the default)")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-22s %s\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "USER is a user ID or an email address. Run a command with -h for its arguments,")
+	fmt.Fprintln(w, "and livescribble -h for the configuration flags, which go before the command.")
+}
+
+// Run runs the command named at the start of args.
+func Run(cfg *config.Config, args []string) error {
+	cmd, rest := lookup(args)
+	if cmd == nil {
+		Usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+
+	e := &env{
+		cmd:    cmd,
+		cfg:    cfg,
+		ctx:    context.Background(),
+		in:     os.Stdin,
+		out:    os.Stdout,
+		errOut: os.Stderr,
+		actor:  operator(),
+		// only trouble is worth printing next to a command's output
+		logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	}
+	defer e.close()
+
+	err := cmd.run(e, rest)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+func lookup(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// env holds what a command needs. Connections open on first use.
+type env struct {
+	cmd    *command
+	cfg    *config.Config
+	ctx    context.Context
+	in     io.Reader
+	out    io.Writer
+	errOut io.Writer
+	actor  string
+	logger *slog.Logger
+
+	db       *database.Manager
+	auditLog *audit.Log
+	redis    *redis.Client
+}
+
+func (e *env) database() (*gorm.DB, error) {
+	if e.db != nil {
+		return e.db.DB, nil
+	}
+	db := database.NewDatabaseManager()
+	// errors are returned, GORM need not print them as well
+	if err := db.Open(e.cfg.Database.URL, gormlogger.Discard); err != nil {
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	e.db = db
+	e.auditLog = audit.NewLog(db.DB, e.logger)
+	return db.DB, nil
+}
+
+func (e *env) redisClient() (*redis.Client, error) {
+	if e.redis != nil {
+		return e.redis, nil
+	}
+	client := utils.NewRedisClient(e.cfg.Redis.Addr, e.cfg.Redis.Password, e.cfg.Redis.DB)
+	if err := client.Ping(e.ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	e.redis = client
+	return client, nil
+}
+
+func (e *env) cluster() (*room.Cluster, error) {
+	client, err := e.redisClient()
+	if err != nil {
+		return nil, err
+	}
+	return room.NewCluster(client, e.logger), nil
+}
+
+// record audits a change made by the operator.
+func (e *env) record(event audit.Event) {
+	event.ActorID = e.actor
+	e.auditLog.RecordSystem(e.ctx, event)
+}
+
+// kick disconnects userId from docId's room, or from every room when docId
+// is empty. The database change already happened, so failing to reach the
+// nodes is only a warning.
+func (e *env) kick(docId string, userId string, reason string) {
+	cluster, err := e.cluster()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(e.ctx, clusterTimeout)
+		defer cancel()
+		var result *room.ClusterResult
+		result, err = cluster.Kick(ctx, docId, "", userId, reason)
+		if err == nil && result.Partial {
+			err = fmt.Errorf("only %d of %d nodes answered", len(result.Replies), result.Nodes)
+		}
+	}
+	if err != nil && !errors.Is(err, room.ErrNoNodes) {
+		e.warn("live sessions may still be open: %v", err)
+	}
+}
+
+// closeRooms disconnects everyone editing the deleted documents. Like kick,
+// failing to reach Redis is only a warning.
+func (e *env) closeRooms(docIds []string, reason string) {
+	if len(docIds) == 0 {
+		return
+	}
+	cluster, err := e.cluster()
+	if err != nil {
+		e.warn("live sessions may still be open: %v", err)
+		return
+	}
+	for _, docId := range docIds {
+		cluster.CloseRoom(docId, reason)
+	}
+}
+
+func (e *env) warn(format string, args ...interface{}) {
+	fmt.Fprintf(e.errOut, "warning: "+format+"\n", args...)
+}
+
+func (e *env) close() {
+	if e.db != nil {
+		if err := e.db.Close(); err != nil {
+			e.warn("closing database: %v", err)
+		}
+	}
+	if e.redis != nil {
+		if err := e.redis.Close(); err != nil {
+			e.warn("closing redis: %v", err)
+		}
+	}
+}
+
+// readPassword reads one line from stdin, prompting when it is a terminal.
+// Taking it from stdin keeps it out of the shell history and ps.
+func (e *env) readPassword() (string, error) {
+	if f, ok := e.in.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(e.errOut, "Password: ")
+		}
+	}
+	line, err := bufio.NewReader(e.in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// flags makes the flag set of the running command, its usage names the
+// command's arguments.
+func (e *env) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet(e.cmd.name, flag.ContinueOnError)
+	flags.SetOutput(e.errOut)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: livescribble %s %s\n\n%s\n", e.cmd.name, e.cmd.args, e.cmd.help)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs parses flags wherever they appear among the positional
+// arguments, where the flag package alone stops at the first one. It fails
+// unless there are between least and most positional arguments, most < 0
+// means no limit.
+func parseArgs(flags *flag.FlagSet, args []string, least int, most int) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) < least || (most >= 0 && len(positional) > most) {
+		flags.Usage()
+		return nil, fmt.Errorf("%s: wrong number of arguments", flags.Name())
+	}
+	return positional, nil
+}
+
+// operator names whoever runs the command in the audit log.
+func operator() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return "cli:" + name
+}
+
+func migrate(e *env, args []string) error {
+	if _, err := parseArgs(e.flags(), args, 0, 0); err != nil {
+		return err
+	}
+	if _, err := e.database(); err != nil {
+		return err
+	}
+	if err := e.db.Migrate(); err != nil {
+		return err
+	}
+	fmt.Fprintln(e.out, "schema is up to date")
+	return nil
+}
@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"livescribble/internal/audit"
+	"livescribble/internal/document"
+	"livescribble/internal/utils"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+)
+
+func docExport(e *env, args []string) error {
+	flags := e.flags()
+	format := flags.String("format", "md", "md, html or txt")
+	output := flags.String("o", "", "write to this file instead of stdout")
+	positional, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	// trashed documents too, an operator may be rescuing one
+	var doc utils.Document
+	err = db.Model(utils.Document{}).Where("id = ?", positional[0]).First(&doc).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("document %q not found", positional[0])
+	}
+	if err != nil {
+		return err
+	}
+	body, err := document.Render(&doc, *format)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = fmt.Fprint(e.out, body)
+	} else {
+		err = os.WriteFile(*output, []byte(body), 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	e.record(audit.Event{Action: audit.ActionDocumentExport, DocumentID: doc.ID, Data: map[string]interface{}{"format": *format}})
+	return nil
+}
+
+func docImport(e *env, args []string) error {
+	flags := e.flags()
+	owner := flags.String("owner", "", "USER who owns the new documents")
+	title := flags.String("title", "", "title for a single file, the file name by default")
+	files, err := parseArgs(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	if *owner == "" || (*title != "" && len(files) > 1) {
+		flags.Usage()
+		return errors.New("-owner is required and -title takes a single file")
+	}
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	user, err := findUser(db, *owner)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		doc, err := document.ImportFile(db, user.ID, filepath.Base(file), data, *title)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		e.record(audit.Event{Action: audit.ActionDocumentCreate, DocumentID: doc.ID, TargetID: user.ID, Data: map[string]interface{}{"imported": true}})
+		fmt.Fprintf(e.out, "%s\t%s\n", doc.ID, doc.Title)
+	}
+	return nil
+}
+
+func docTransferOwner(e *env, args []string) error {
+	flags := e.flags()
+	previousRole := flags.String("previous-role", document.RoleEditor, "the previous owner's role afterwards: editor, commenter, viewer or none")
+	positional, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if *previousRole == "none" {
+		*previousRole = ""
+	} else if !document.ValidShareRole(*previousRole) {
+		flags.Usage()
+		return fmt.Errorf("invalid -previous-role %q", *previousRole)
+	}
+	docId := positional[0]
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	newOwner, err := findUser(db, positional[1])
+	if err != nil {
+		return err
+	}
+
+	previousOwner, err := document.TransferOwner(db, docId, newOwner.ID, *previousRole)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("document %q not found", docId)
+	}
+	if err != nil {
+		return err
+	}
+	if !document.CanEdit(*previousRole) {
+		// open sessions were authorized with the old role
+		e.kick(docId, previousOwner, "ownership transferred")
+	}
+	e.record(audit.Event{Action: audit.ActionAdminOwnerTransfer, DocumentID: docId, TargetID: newOwner.ID, Data: map[string]interface{}{
+		"from":          previousOwner,
+		"previous_role": *previousRole,
+	}})
+	fmt.Fprintf(e.out, "transferred %s from %s to %s (%s)\n", docId, previousOwner, newOwner.ID, newOwner.Email)
+	return nil
+}
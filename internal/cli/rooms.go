@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"livescribble/internal/room"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func roomsList(e *env, args []string) error {
+	flags := e.flags()
+	docId := flags.String("doc", "", "only this document's room")
+	asJSON := flags.Bool("json", false, "print every node's full reply as JSON")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	cluster, err := e.cluster()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, clusterTimeout)
+	defer cancel()
+	result, err := cluster.ListRooms(ctx, *docId)
+	if errors.Is(err, room.ErrNoNodes) {
+		fmt.Fprintln(e.out, "no live nodes")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if result.Partial {
+		e.warn("only %d of %d nodes answered", len(result.Replies), result.Nodes)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(e.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	var rooms []room.RoomInfo
+	for _, reply := range result.Replies {
+		rooms = append(rooms, reply.Rooms...)
+	}
+	slices.SortFunc(rooms, func(a, b room.RoomInfo) int {
+		if n := len(b.Clients) - len(a.Clients); n != 0 {
+			return n
+		}
+		return strings.Compare(a.DocId+a.Node, b.DocId+b.Node)
+	})
+	w := tabwriter.NewWriter(e.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DOCUMENT\tNODE\tCLIENTS\tUSERS\tOPEN FOR\tFRAMES IN/OUT")
+	for _, info := range rooms {
+		var users []string
+		for _, client := range info.Clients {
+			if !slices.Contains(users, client.UserId) {
+				users = append(users, client.UserId)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d/%d\n", info.DocId, info.Node, len(info.Clients), strings.Join(users, ","),
+			time.Since(info.Created).Truncate(time.Second), info.FramesIn, info.FramesOut)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.out, "%d rooms on %d nodes\n", len(rooms), result.Nodes)
+	return nil
+}
@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"livescribble/internal/audit"
+	"livescribble/internal/auth"
+	"livescribble/internal/utils"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func userCreate(e *env, args []string) error {
+	flags := e.flags()
+	email := flags.String("email", "", "the new account's email")
+	admin := flags.Bool("admin", false, "give the account access to the admin API")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	*email = strings.TrimSpace(*email)
+	if !strings.Contains(*email, "@") {
+		flags.Usage()
+		return errors.New("-email must be an email address")
+	}
+	password, err := e.readPassword()
+	if err != nil {
+		return err
+	}
+	if err := auth.CheckPassword(password); err != nil {
+		return err
+	}
+
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	user, err := auth.CreateUser(db, *email, password, *admin)
+	if err != nil {
+		return err
+	}
+	e.record(audit.Event{Action: audit.ActionAdminUserCreate, TargetID: user.ID, Data: map[string]interface{}{
+		"email": user.Email,
+		"admin": user.Admin,
+	}})
+	fmt.Fprintf(e.out, "created user %s (%s)\n", user.ID, user.Email)
+	return nil
+}
+
+func userDisable(e *env, args []string) error {
+	return setDisabled(e, args, true)
+}
+
+func userEnable(e *env, args []string) error {
+	return setDisabled(e, args, false)
+}
+
+func setDisabled(e *env, args []string, disabled bool) error {
+	positional, err := parseArgs(e.flags(), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	user, err := findUser(db, positional[0])
+	if err != nil {
+		return err
+	}
+	if err := auth.SetDisabled(db, user.ID, disabled); err != nil {
+		return err
+	}
+
+	action, done := audit.ActionAdminUserEnable, "enabled"
+	if disabled {
+		action, done = audit.ActionAdminUserDisable, "disabled"
+		e.kick("", user.ID, "account disabled")
+	}
+	e.record(audit.Event{Action: action, TargetID: user.ID, Data: map[string]interface{}{"email": user.Email}})
+	fmt.Fprintf(e.out, "%s user %s (%s)\n", done, user.ID, user.Email)
+	return nil
+}
+
+func userResetPassword(e *env, args []string) error {
+	flags := e.flags()
+	generate := flags.Bool("generate", false, "generate a password and print it instead of reading one")
+	positional, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	user, err := findUser(db, positional[0])
+	if err != nil {
+		return err
+	}
+
+	var password string
+	if *generate {
+		password, err = utils.RandomString(16)
+	} else {
+		password, err = e.readPassword()
+	}
+	if err != nil {
+		return err
+	}
+	if err := auth.SetPassword(db, user.ID, password); err != nil {
+		return err
+	}
+	e.record(audit.Event{Action: audit.ActionAdminPasswordReset, TargetID: user.ID, Data: map[string]interface{}{
+		"email":     user.Email,
+		"generated": *generate,
+	}})
+	fmt.Fprintf(e.out, "reset the password of %s (%s), every session is signed out\n", user.ID, user.Email)
+	if *generate {
+		fmt.Fprintln(e.out, password)
+	}
+	return nil
+}
+
+// purgeTempUsers deletes temporary accounts whose day ran out, with their
+// documents. Nothing else removes them.
+func purgeTempUsers(e *env, args []string) error {
+	flags := e.flags()
+	olderThan := flags.Duration("older-than", 0, "only accounts that expired at least this long ago")
+	dryRun := flags.Bool("dry-run", false, "list the accounts without deleting them")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	users, err := auth.ExpiredTempUsers(db, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+
+	purged := 0
+	for _, user := range users {
+		if *dryRun {
+			fmt.Fprintf(e.out, "%s\texpired %s\n", user.ID, user.DeletedAt.Format(time.RFC3339))
+			continue
+		}
+		deleted, err := auth.DeleteUser(db, user.ID, "")
+		if err != nil {
+			return fmt.Errorf("deleting %s after %d purged: %w", user.ID, purged, err)
+		}
+		e.closeRooms(deleted, "document deleted")
+		e.record(audit.Event{Action: audit.ActionAdminTempUserPurge, TargetID: user.ID, Data: map[string]interface{}{"documents": len(deleted)}})
+		purged++
+	}
+	if *dryRun {
+		fmt.Fprintf(e.out, "%d temporary users would be purged\n", len(users))
+	} else {
+		fmt.Fprintf(e.out, "purged %d temporary users\n", purged)
+	}
+	return nil
+}
+
+func findUser(db *gorm.DB, idOrEmail string) (*utils.User, error) {
+	user, err := auth.FindUser(db, idOrEmail)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("user %q not found", idOrEmail)
+	}
+	return user, err
+}
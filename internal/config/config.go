@@ -0,0 +1,296 @@
+// Package config is the server configuration. Values come from, in
+// increasing order of precedence: the defaults below, a YAML or TOML file,
+// environment variables and command-line flags. Each setting's environment
+// variable is named in its env tag; its flag is its dotted file path, e.g.
+// -server.addr.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Server        ServerConfig        `yaml:"server" toml:"server"`
+	Database      DatabaseConfig      `yaml:"database" toml:"database"`
+	Redis         RedisConfig         `yaml:"redis" toml:"redis"`
+	Auth          AuthConfig          `yaml:"auth" toml:"auth"`
+	RateLimit     RateLimitConfig     `yaml:"ratelimit" toml:"ratelimit"`
+	CORS          CORSConfig          `yaml:"cors" toml:"cors"`
+	WebSocket     WebSocketConfig     `yaml:"websocket" toml:"websocket"`
+	Documents     DocumentsConfig     `yaml:"documents" toml:"documents"`
+	Notifications NotificationsConfig `yaml:"notifications" toml:"notifications"`
+	Webhooks      WebhooksConfig      `yaml:"webhooks" toml:"webhooks"`
+	TLS           TLSConfig           `yaml:"tls" toml:"tls"`
+	Log           LogConfig           `yaml:"log" toml:"log"`
+	Tracing       TracingConfig       `yaml:"tracing" toml:"tracing"`
+
+	File        string   `yaml:"-" toml:"-"` // the file the config was read from, if any
+	PrintConfig bool     `yaml:"-" toml:"-"` // -print-config: print the effective config and exit
+	Args        []string `yaml:"-" toml:"-"` // what follows the flags: a command and its own arguments
+}
+
+type ServerConfig struct {
+	Addr                   string `yaml:"addr" toml:"addr" env:"LISTEN_ADDR"`
+	ShutdownTimeoutSeconds int    `yaml:"shutdown_timeout_seconds" toml:"shutdown_timeout_seconds" env:"SHUTDOWN_TIMEOUT_SECONDS"`
+	EnableTempUser         bool   `yaml:"enable_temp_user" toml:"enable_temp_user" env:"ENABLE_TEMP_USER"`
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-For is
+	// believed. Client IPs feed the rate limits and the audit log, so by
+	// default no proxy is trusted.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// MetricsAddr serves /metrics apart from the public listener, empty
+	// turns it off. The endpoint has no authentication.
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr" env:"METRICS_ADDR"`
+}
+
+type DatabaseConfig struct {
+	URL string `yaml:"url" toml:"url" env:"DATABASE_URL" secret:"true"` // may hold the password
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr" toml:"addr" env:"REDIS_ADDR"`
+	Password string `yaml:"password" toml:"password" env:"REDIS_PW" secret:"true"`
+	DB       int    `yaml:"db" toml:"db" env:"REDIS_DB"`
+}
+
+type AuthConfig struct {
+	JWTKey        string   `yaml:"jwt_key" toml:"jwt_key" env:"JWT_KEY" secret:"true"` // legacy HS256 secret
+	JWTKeys       []JWTKey `yaml:"jwt_keys" toml:"jwt_keys" env:"JWT_KEYS"`
+	JWTSigningKid string   `yaml:"jwt_signing_kid" toml:"jwt_signing_kid" env:"JWT_SIGNING_KID"`
+}
+
+// JWTKey mirrors auth.KeyConfig so the two convert into each other.
+type JWTKey struct {
+	Kid            string `yaml:"kid" toml:"kid" json:"kid"`
+	Alg            string `yaml:"alg" toml:"alg" json:"alg"`
+	Secret         string `yaml:"secret,omitempty" toml:"secret,omitempty" json:"secret,omitempty" secret:"true"`
+	PrivateKeyFile string `yaml:"private_key_file,omitempty" toml:"private_key_file,omitempty" json:"private_key_file,omitempty"`
+	PublicKeyFile  string `yaml:"public_key_file,omitempty" toml:"public_key_file,omitempty" json:"public_key_file,omitempty"`
+}
+
+// RateLimitConfig sets how many requests each client IP may make to the
+// unauthenticated routes per window, and when repeated failed passwords or
+// 2FA codes lock an account.
+type RateLimitConfig struct {
+	Login           int      `yaml:"login" toml:"login" env:"RATE_LIMIT_LOGIN"`
+	LoginWindow     Duration `yaml:"login_window" toml:"login_window" env:"RATE_LIMIT_LOGIN_WINDOW"`
+	Login2FA        int      `yaml:"login_2fa" toml:"login_2fa" env:"RATE_LIMIT_LOGIN_2FA"`
+	Login2FAWindow  Duration `yaml:"login_2fa_window" toml:"login_2fa_window" env:"RATE_LIMIT_LOGIN_2FA_WINDOW"`
+	Register        int      `yaml:"register" toml:"register" env:"RATE_LIMIT_REGISTER"`
+	RegisterWindow  Duration `yaml:"register_window" toml:"register_window" env:"RATE_LIMIT_REGISTER_WINDOW"`
+	TempUser        int      `yaml:"temp_user" toml:"temp_user" env:"RATE_LIMIT_TEMP_USER"`
+	TempUserWindow  Duration `yaml:"temp_user_window" toml:"temp_user_window" env:"RATE_LIMIT_TEMP_USER_WINDOW"`
+	LockoutFailures int      `yaml:"lockout_failures" toml:"lockout_failures" env:"LOCKOUT_FAILURES"` // failures within lockout_window that lock the account
+	LockoutWindow   Duration `yaml:"lockout_window" toml:"lockout_window" env:"LOCKOUT_WINDOW"`
+	LockoutDuration Duration `yaml:"lockout_duration" toml:"lockout_duration" env:"LOCKOUT_DURATION"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins  []string `yaml:"allowed_origins" toml:"allowed_origins" env:"ALLOWED_ORIGINS"`
+	AllowAllOrigins bool     `yaml:"allow_all_origins" toml:"allow_all_origins" env:"ALLOW_ALL_ORIGINS"`
+}
+
+type WebSocketConfig struct {
+	ReadBufferSize   int      `yaml:"read_buffer_size" toml:"read_buffer_size" env:"WS_READ_BUFFER_SIZE"`
+	WriteBufferSize  int      `yaml:"write_buffer_size" toml:"write_buffer_size" env:"WS_WRITE_BUFFER_SIZE"`
+	WriteTimeout     Duration `yaml:"write_timeout" toml:"write_timeout" env:"WS_WRITE_TIMEOUT"`
+	SnapshotInterval Duration `yaml:"snapshot_interval" toml:"snapshot_interval" env:"SNAPSHOT_INTERVAL"`
+}
+
+type DocumentsConfig struct {
+	TrashRetentionDays int `yaml:"trash_retention_days" toml:"trash_retention_days" env:"TRASH_RETENTION_DAYS"`
+}
+
+type NotificationsConfig struct {
+	DigestHours  int    `yaml:"digest_hours" toml:"digest_hours" env:"NOTIFICATION_DIGEST_HOURS"`
+	SMTPAddr     string `yaml:"smtp_addr" toml:"smtp_addr" env:"SMTP_ADDR"` // empty logs emails instead of sending them
+	SMTPFrom     string `yaml:"smtp_from" toml:"smtp_from" env:"SMTP_FROM"`
+	SMTPUsername string `yaml:"smtp_username" toml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" toml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+}
+
+type WebhooksConfig struct {
+	AllowPrivate bool `yaml:"allow_private" toml:"allow_private" env:"WEBHOOK_ALLOW_PRIVATE"`
+}
+
+// TLSConfig turns on TLS (and HTTP/2) in the server itself when a
+// certificate is set. Leave it empty behind a TLS-terminating proxy.
+type TLSConfig struct {
+	CertFile       string   `yaml:"cert_file" toml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile        string   `yaml:"key_file" toml:"key_file" env:"TLS_KEY_FILE"`
+	ReloadInterval Duration `yaml:"reload_interval" toml:"reload_interval" env:"TLS_RELOAD_INTERVAL"` // how often the files are checked for changes
+	RedirectAddr   string   `yaml:"redirect_addr" toml:"redirect_addr" env:"TLS_REDIRECT_ADDR"`       // e.g. ":80", empty for no HTTP listener
+	// SecureCookies is "auto" (Secure when the request came over HTTPS,
+	// directly or per X-Forwarded-Proto), "always" or "never".
+	SecureCookies string `yaml:"secure_cookies" toml:"secure_cookies" env:"SECURE_COOKIES"`
+}
+
+// Enabled reports whether the server terminates TLS itself.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+type LogConfig struct {
+	Level     string   `yaml:"level" toml:"level" env:"LOG_LEVEL"`    // debug, info, warn or error; debug includes every SQL statement
+	Format    string   `yaml:"format" toml:"format" env:"LOG_FORMAT"` // json or text
+	File      string   `yaml:"file" toml:"file" env:"LOG_FILE"`       // appended to, empty for none
+	Stdout    bool     `yaml:"stdout" toml:"stdout" env:"LOG_STDOUT"`
+	SlowQuery Duration `yaml:"slow_query" toml:"slow_query" env:"LOG_SLOW_QUERY"` // SQL slower than this is logged as a warning
+}
+
+// TracingConfig picks where spans go. The OTLP exporter, sampler and service
+// name still follow the standard OTEL_* variables.
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" toml:"exporter" env:"OTEL_TRACES_EXPORTER"` // none, otlp, stdout or file
+	File     string `yaml:"file" toml:"file" env:"OTEL_TRACES_FILE"`             // JSON lines appended to by the file exporter
+}
+
+// Duration is a time.Duration written as "30s" or "5m" in files,
+// environment variables and flags.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Default is the configuration before any file, variable or flag is applied.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:                   ":8081",
+			ShutdownTimeoutSeconds: 15,
+			MetricsAddr:            "127.0.0.1:9464",
+		},
+		RateLimit: RateLimitConfig{
+			Login:           10,
+			LoginWindow:     Duration{time.Minute},
+			Login2FA:        10,
+			Login2FAWindow:  Duration{time.Minute},
+			Register:        5,
+			RegisterWindow:  Duration{time.Hour},
+			TempUser:        3,
+			TempUserWindow:  Duration{time.Hour},
+			LockoutFailures: 5,
+			LockoutWindow:   Duration{15 * time.Minute},
+			LockoutDuration: Duration{15 * time.Minute},
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:   1024,
+			WriteBufferSize:  1024,
+			WriteTimeout:     Duration{5 * time.Second},
+			SnapshotInterval: Duration{30 * time.Second},
+		},
+		Documents: DocumentsConfig{
+			TrashRetentionDays: 30,
+		},
+		Notifications: NotificationsConfig{
+			DigestHours: 24,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: Duration{time.Minute},
+			SecureCookies:  "auto",
+		},
+		Log: LogConfig{
+			Level:     "info",
+			Format:    "json",
+			File:      "app.log",
+			Stdout:    true,
+			SlowQuery: Duration{200 * time.Millisecond},
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+			File:     "traces.jsonl",
+		},
+	}
+}
+
+// Validate reports every setting that cannot work, not just the first.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Server.Addr != "", "server.addr must be set")
+	check(c.Server.ShutdownTimeoutSeconds > 0, "server.shutdown_timeout_seconds must be positive")
+	for _, proxy := range c.Server.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(cidrErr == nil || net.ParseIP(proxy) != nil, "server.trusted_proxies: %q is not an IP address or CIDR", proxy)
+	}
+	check(c.Database.URL != "", "database.url (DATABASE_URL) must be set")
+	check(c.Redis.Addr != "", "redis.addr (REDIS_ADDR) must be set")
+	check(c.Redis.DB >= 0, "redis.db must not be negative")
+	check(c.Auth.JWTKey != "" || len(c.Auth.JWTKeys) > 0, "auth.jwt_key (JWT_KEY) or auth.jwt_keys (JWT_KEYS) must be set")
+	for _, route := range []struct {
+		name   string
+		limit  int
+		window Duration
+	}{
+		{"login", c.RateLimit.Login, c.RateLimit.LoginWindow},
+		{"login_2fa", c.RateLimit.Login2FA, c.RateLimit.Login2FAWindow},
+		{"register", c.RateLimit.Register, c.RateLimit.RegisterWindow},
+		{"temp_user", c.RateLimit.TempUser, c.RateLimit.TempUserWindow},
+	} {
+		check(route.limit > 0, "ratelimit.%s must be positive", route.name)
+		check(route.window.Duration >= time.Second, "ratelimit.%s_window must be at least 1s", route.name)
+	}
+	check(c.RateLimit.LockoutFailures > 0, "ratelimit.lockout_failures must be positive")
+	check(c.RateLimit.LockoutWindow.Duration >= time.Second, "ratelimit.lockout_window must be at least 1s")
+	check(c.RateLimit.LockoutDuration.Duration >= time.Second, "ratelimit.lockout_duration must be at least 1s")
+	check(c.WebSocket.ReadBufferSize > 0, "websocket.read_buffer_size must be positive")
+	check(c.WebSocket.WriteBufferSize > 0, "websocket.write_buffer_size must be positive")
+	check(c.WebSocket.WriteTimeout.Duration > 0, "websocket.write_timeout must be positive")
+	check(c.WebSocket.SnapshotInterval.Duration >= time.Second, "websocket.snapshot_interval must be at least 1s")
+	check(c.Documents.TrashRetentionDays > 0, "documents.trash_retention_days must be positive")
+	check(c.Notifications.DigestHours > 0, "notifications.digest_hours must be positive")
+	check(c.Notifications.SMTPAddr == "" || c.Notifications.SMTPFrom != "", "notifications.smtp_from must be set with smtp_addr")
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(c.TLS.RedirectAddr == "" || c.TLS.Enabled(), "tls.redirect_addr needs tls.cert_file")
+	check(c.TLS.RedirectAddr == "" || c.TLS.RedirectAddr != c.Server.Addr, "tls.redirect_addr must differ from server.addr")
+	check(c.Server.MetricsAddr == "" || (c.Server.MetricsAddr != c.Server.Addr && c.Server.MetricsAddr != c.TLS.RedirectAddr),
+		"server.metrics_addr must differ from server.addr and tls.redirect_addr")
+	check(c.TLS.ReloadInterval.Duration >= time.Second, "tls.reload_interval must be at least 1s")
+	check(c.TLS.SecureCookies == "auto" || c.TLS.SecureCookies == "always" || c.TLS.SecureCookies == "never",
+		"tls.secure_cookies must be auto, always or never")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level must be debug, info, warn or error")
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be json or text")
+	check(c.Log.File != "" || c.Log.Stdout, "log.file or log.stdout must be set")
+	check(c.Log.SlowQuery.Duration >= 0, "log.slow_query must not be negative")
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	case "file":
+		check(c.Tracing.File != "", "tracing.file must be set for the file exporter")
+	default:
+		check(false, "tracing.exporter must be none, otlp, stdout or file")
+	}
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration as YAML with every secret replaced.
+func (c *Config) Print(w io.Writer) error {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// setting is one leaf of the configuration.
+type setting struct {
+	path  string // dotted file path, also the flag name
+	env   string
+	value reflect.Value
+}
+
+// Load builds the configuration from args (without the program name) and the
+// environment, then validates it. The file is taken from -config or
+// LIVESCRIBBLE_CONFIG; without either only defaults, variables and flags
+// apply. Arguments after the flags are kept in Args.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := collect(reflect.ValueOf(cfg).Elem(), "")
+
+	flags := flag.NewFlagSet("livescribble", flag.ContinueOnError)
+	flags.StringVar(&cfg.File, "config", os.Getenv("LIVESCRIBBLE_CONFIG"), "YAML or TOML config file")
+	flags.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: livescribble [flags] [command [arguments]]\n\nRun \"livescribble help\" for the commands. Flags:")
+		flags.PrintDefaults()
+	}
+	overrides := make(map[string]string)
+	for _, s := range settings {
+		if s.value.Kind() == reflect.Slice && s.value.Type().Elem().Kind() != reflect.String {
+			continue // lists of keys only come from the file or the environment
+		}
+		path := s.path
+		usage := "overrides " + path
+		if s.env != "" {
+			usage += " and $" + s.env
+		}
+		flags.Func(path, usage, func(raw string) error {
+			overrides[path] = raw
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.Args = flags.Args()
+
+	if cfg.File != "" {
+		if err := loadFile(cfg, cfg.File); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if raw := os.Getenv(s.env); s.env != "" && raw != "" {
+			if err := set(s.value, raw, true); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if raw, ok := overrides[s.path]; ok {
+			if err := set(s.value, raw, false); err != nil {
+				return nil, fmt.Errorf("-%s: %w", s.path, err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config file %s: use a .yaml, .yml or .toml extension", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// collect lists the settings under v, a struct, recursing into nested
+// sections.
+func collect(v reflect.Value, prefix string) []setting {
+	var settings []setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if _, ok := value.Addr().Interface().(encoding.TextUnmarshaler); !ok && field.Type.Kind() == reflect.Struct {
+			settings = append(settings, collect(value, prefix+name+".")...)
+			continue
+		}
+		settings = append(settings, setting{
+			path:  prefix + name,
+			env:   field.Tag.Get("env"),
+			value: value,
+		})
+	}
+	return settings
+}
+
+// set parses raw into v. Lists are JSON arrays in the environment, as
+// ALLOWED_ORIGINS and JWT_KEYS always were, and comma separated in flags.
+func set(v reflect.Value, raw string, fromEnv bool) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if fromEnv {
+			list := reflect.New(v.Type())
+			if err := json.Unmarshal([]byte(raw), list.Interface()); err != nil {
+				return fmt.Errorf("not a JSON array: %w", err)
+			}
+			v.Set(list.Elem())
+			return nil
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with every non-empty secret
+// replaced by "[redacted]".
+func (c *Config) Redacted() *Config {
+	out := *c
+	redact(reflect.ValueOf(&out).Elem())
+	return &out
+}
+
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			if t.Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String {
+				if field.String() != "" {
+					field.SetString(redacted)
+				}
+				continue
+			}
+			redact(field)
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return
+		}
+		// copy first, the original shares the backing array
+		clone := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(clone, v)
+		v.Set(clone)
+		for i := 0; i < clone.Len(); i++ {
+			redact(clone.Index(i))
+		}
+	}
+}
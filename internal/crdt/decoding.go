@@ -0,0 +1,201 @@
+package crdt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+var (
+	errUnexpectedEOF = errors.New("crdt: unexpected end of update")
+	errTooDeep       = errors.New("crdt: update nested too deep")
+)
+
+// decoder reads the lib0 binary encoding used by Yjs updates.
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) readUint8() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, errUnexpectedEOF
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) readVarUint() (uint64, error) {
+	var num uint64
+	var shift uint
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+		num |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return num, nil
+		}
+		shift += 7
+		if shift > 63 {
+			return 0, errors.New("crdt: varuint overflow")
+		}
+	}
+}
+
+func (d *decoder) readVarInt() (int64, error) {
+	b, err := d.readUint8()
+	if err != nil {
+		return 0, err
+	}
+	num := int64(b & 0x3f)
+	negative := b&0x40 != 0
+	shift := uint(6)
+	for b&0x80 != 0 {
+		if b, err = d.readUint8(); err != nil {
+			return 0, err
+		}
+		num |= int64(b&0x7f) << shift
+		shift += 7
+		if shift > 63 {
+			return 0, errors.New("crdt: varint overflow")
+		}
+	}
+	if negative {
+		num = -num
+	}
+	return num, nil
+}
+
+// readCount reads how many entries follow. Every entry takes at least one
+// byte, so a count larger than what is left is rejected before anything is
+// sized from it.
+func (d *decoder) readCount() (uint64, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.buf)-d.pos) {
+		return 0, errUnexpectedEOF
+	}
+	return n, nil
+}
+
+func (d *decoder) readBytes(n uint64) ([]byte, error) {
+	if uint64(len(d.buf)-d.pos) < n {
+		return nil, errUnexpectedEOF
+	}
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *decoder) readVarBytes() ([]byte, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(n)
+}
+
+func (d *decoder) readVarString() (string, error) {
+	b, err := d.readVarBytes()
+	return string(b), err
+}
+
+func (d *decoder) readJSON() (interface{}, error) {
+	s, err := d.readVarString()
+	if err != nil {
+		return nil, err
+	}
+	if s == "undefined" {
+		return nil, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readAny decodes a value written by lib0's encoding.writeAny. depth counts
+// the objects and arrays it is nested in.
+func (d *decoder) readAny(depth int) (interface{}, error) {
+	t, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case 127, 126: // undefined, null
+		return nil, nil
+	case 125:
+		return d.readVarInt()
+	case 124:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 123:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 122:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case 121:
+		return false, nil
+	case 120:
+		return true, nil
+	case 119:
+		return d.readVarString()
+	case 118:
+		if depth >= maxAnyDepth {
+			return nil, errTooDeep
+		}
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			if obj[key], err = d.readAny(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case 117:
+		if depth >= maxAnyDepth {
+			return nil, errTooDeep
+		}
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, 0)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.readAny(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 116:
+		return d.readVarBytes()
+	default:
+		return nil, errors.New("crdt: unknown any type")
+	}
+}
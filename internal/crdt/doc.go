@@ -0,0 +1,679 @@
+// Package crdt decodes the Yjs documents clients store in Document.Content.
+//
+// Only what the server needs to read a saved snapshot is implemented: the
+// update v1 binary format, YATA integration to recover item order, and the
+// delete set. It is not a general purpose Yjs implementation.
+package crdt
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Yjs content refs.
+const (
+	refGC      = 0
+	refDeleted = 1
+	refJSON    = 2
+	refBinary  = 3
+	refString  = 4
+	refEmbed   = 5
+	refFormat  = 6
+	refType    = 7
+	refAny     = 8
+	refDoc     = 9
+	refSkip    = 10
+)
+
+// Yjs type refs.
+const (
+	TypeArray       = 0
+	TypeMap         = 1
+	TypeText        = 2
+	TypeXmlElement  = 3
+	TypeXmlFragment = 4
+	TypeXmlHook     = 5
+	TypeXmlText     = 6
+
+	typeUnknown = -1 // root types carry no ref, it is inferred from their content
+)
+
+// Nesting limits, so a crafted update cannot exhaust the stack. Real
+// documents stay far below them.
+const (
+	maxAnyDepth        = 64    // objects and arrays within one lib0 any value
+	maxTypeDepth       = 128   // types within types, e.g. nested XML elements
+	maxDependencyDepth = 10000 // clients integrated ahead of the one that needs them
+)
+
+type ID struct {
+	Client uint64
+	Clock  uint64
+}
+
+// Content is the payload of an item. Which fields are set depends on ref.
+type Content struct {
+	ref    int
+	str    []uint16 // UTF-16 code units, Yjs counts string length in them
+	length int      // for deleted content
+	values []interface{}
+	key    string
+	value  interface{}
+	typ    *Type
+}
+
+func (c *Content) len() int {
+	switch c.ref {
+	case refString:
+		return len(c.str)
+	case refDeleted:
+		return c.length
+	case refJSON, refAny:
+		return len(c.values)
+	default:
+		return 1
+	}
+}
+
+func (c *Content) countable() bool {
+	return c.ref != refDeleted && c.ref != refFormat
+}
+
+// splice cuts the content at offset, keeping the head and returning the tail.
+func (c *Content) splice(offset int) Content {
+	tail := *c
+	switch c.ref {
+	case refString:
+		tail.str = c.str[offset:]
+		c.str = c.str[:offset]
+	case refDeleted:
+		tail.length = c.length - offset
+		c.length = offset
+	case refJSON, refAny:
+		tail.values = c.values[offset:]
+		c.values = c.values[:offset]
+	}
+	return tail
+}
+
+type Item struct {
+	id          ID
+	length      int
+	gc          bool
+	origin      *ID
+	rightOrigin *ID
+	left        *Item
+	right       *Item
+	parent      *Type
+	parentID    *ID
+	parentKey   string
+	parentSub   string
+	hasSub      bool
+	content     Content
+	deleted     bool
+}
+
+// Type is a shared type: a root, or the content of an item such as an
+// XmlElement.
+type Type struct {
+	Ref      int
+	NodeName string
+	start    *Item
+	entries  map[string]*Item
+	item     *Item
+}
+
+// Doc is a decoded snapshot.
+type Doc struct {
+	clients   map[uint64][]*Item
+	roots     map[string]*Type
+	rootOrder []string
+}
+
+// Decode parses a Yjs update (v1 encoding) into a document.
+func Decode(update []byte) (*Doc, error) {
+	doc := &Doc{
+		clients: make(map[uint64][]*Item),
+		roots:   make(map[string]*Type),
+	}
+	d := &decoder{buf: update}
+	pending, err := doc.readStructs(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.integrateAll(pending); err != nil {
+		return nil, err
+	}
+	if err := doc.applyDeleteSet(d); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// DecodeSnapshot decodes Document.Content. Snapshots are stored as sent by the
+// client, which is either the raw update or the update in base64.
+func DecodeSnapshot(content string) (*Doc, error) {
+	if content == "" {
+		return nil, errors.New("crdt: empty snapshot")
+	}
+	doc, err := Decode([]byte(content))
+	if err == nil {
+		return doc, nil
+	}
+	raw, b64err := base64.StdEncoding.DecodeString(content)
+	if b64err != nil {
+		return nil, err
+	}
+	return Decode(raw)
+}
+
+// Root returns the root type with the given name, or nil.
+func (doc *Doc) Root(name string) *Type {
+	return doc.roots[name]
+}
+
+// RootNames lists root types in the order they first appear in the update.
+func (doc *Doc) RootNames() []string {
+	return doc.rootOrder
+}
+
+func (doc *Doc) root(name string) *Type {
+	t, ok := doc.roots[name]
+	if !ok {
+		t = &Type{Ref: typeUnknown}
+		doc.roots[name] = t
+		doc.rootOrder = append(doc.rootOrder, name)
+	}
+	return t
+}
+
+func (doc *Doc) readStructs(d *decoder) (map[uint64][]*Item, error) {
+	pending := make(map[uint64][]*Item)
+	numClients, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		numStructs, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numStructs; j++ {
+			item, err := doc.readStruct(d, ID{Client: client, Clock: clock})
+			if err != nil {
+				return nil, err
+			}
+			if item.content.ref != refSkip {
+				pending[client] = append(pending[client], item)
+			}
+			clock += uint64(item.length)
+		}
+	}
+	return pending, nil
+}
+
+func readID(d *decoder) (*ID, error) {
+	client, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	clock, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return &ID{Client: client, Clock: clock}, nil
+}
+
+func (doc *Doc) readStruct(d *decoder, id ID) (*Item, error) {
+	info, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{id: id}
+	switch info & 0x1f {
+	case refGC, refSkip:
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		item.gc = info&0x1f == refGC
+		item.content.ref = int(info & 0x1f)
+		item.length = int(n)
+		return item, nil
+	}
+
+	if info&0x80 != 0 {
+		if item.origin, err = readID(d); err != nil {
+			return nil, err
+		}
+	}
+	if info&0x40 != 0 {
+		if item.rightOrigin, err = readID(d); err != nil {
+			return nil, err
+		}
+	}
+	if info&0xc0 == 0 {
+		isKey, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if isKey == 1 {
+			if item.parentKey, err = d.readVarString(); err != nil {
+				return nil, err
+			}
+			doc.root(item.parentKey)
+		} else if item.parentID, err = readID(d); err != nil {
+			return nil, err
+		}
+		if info&0x20 != 0 {
+			if item.parentSub, err = d.readVarString(); err != nil {
+				return nil, err
+			}
+			item.hasSub = true
+		}
+	}
+	if item.content, err = readContent(d, int(info&0x1f)); err != nil {
+		return nil, err
+	}
+	item.length = item.content.len()
+	return item, nil
+}
+
+func readContent(d *decoder, ref int) (Content, error) {
+	c := Content{ref: ref}
+	switch ref {
+	case refDeleted:
+		n, err := d.readVarUint()
+		c.length = int(n)
+		return c, err
+	case refJSON:
+		n, err := d.readCount()
+		if err != nil {
+			return c, err
+		}
+		for i := uint64(0); i < n; i++ {
+			v, err := d.readJSON()
+			if err != nil {
+				return c, err
+			}
+			c.values = append(c.values, v)
+		}
+		return c, nil
+	case refBinary:
+		b, err := d.readVarBytes()
+		c.value = b
+		return c, err
+	case refString:
+		s, err := d.readVarString()
+		c.str = encodeUTF16(s)
+		return c, err
+	case refEmbed:
+		v, err := d.readJSON()
+		c.value = v
+		return c, err
+	case refFormat:
+		key, err := d.readVarString()
+		if err != nil {
+			return c, err
+		}
+		c.key = key
+		c.value, err = d.readJSON()
+		return c, err
+	case refType:
+		typeRef, err := d.readVarUint()
+		if err != nil {
+			return c, err
+		}
+		c.typ = &Type{Ref: int(typeRef)}
+		if typeRef == TypeXmlElement || typeRef == TypeXmlHook {
+			if c.typ.NodeName, err = d.readVarString(); err != nil {
+				return c, err
+			}
+		}
+		return c, nil
+	case refAny:
+		n, err := d.readCount()
+		if err != nil {
+			return c, err
+		}
+		for i := uint64(0); i < n; i++ {
+			v, err := d.readAny(0)
+			if err != nil {
+				return c, err
+			}
+			c.values = append(c.values, v)
+		}
+		return c, nil
+	case refDoc:
+		guid, err := d.readVarString()
+		if err != nil {
+			return c, err
+		}
+		c.key = guid
+		c.value, err = d.readAny(0)
+		return c, err
+	default:
+		return c, fmt.Errorf("crdt: unknown content ref %d", ref)
+	}
+}
+
+// integrateAll integrates pending structs client by client. Items whose
+// origins belong to another client pull that client's structs in first, so
+// every item is integrated after what it depends on.
+func (doc *Doc) integrateAll(pending map[uint64][]*Item) error {
+	clients := make([]uint64, 0, len(pending))
+	for client := range pending {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+
+	inProgress := make(map[uint64]bool)
+	depth := 0
+	var ensure func(id ID) error
+	integrateNext := func(client uint64) error {
+		item := pending[client][0]
+		if depth >= maxDependencyDepth {
+			return errTooDeep
+		}
+		depth++
+		defer func() { depth-- }()
+		inProgress[client] = true
+		for _, dep := range []*ID{item.origin, item.rightOrigin, item.parentID} {
+			if dep != nil && dep.Client != client {
+				if err := ensure(*dep); err != nil {
+					return err
+				}
+			}
+		}
+		inProgress[client] = false
+		pending[client] = pending[client][1:]
+		doc.integrate(item)
+		return nil
+	}
+	ensure = func(id ID) error {
+		for doc.state(id.Client) <= id.Clock {
+			if len(pending[id.Client]) == 0 {
+				return fmt.Errorf("crdt: missing struct %d:%d", id.Client, id.Clock)
+			}
+			if inProgress[id.Client] {
+				return errors.New("crdt: circular struct dependency")
+			}
+			if err := integrateNext(id.Client); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, client := range clients {
+		for len(pending[client]) > 0 {
+			if err := integrateNext(client); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// state is the next clock expected from client.
+func (doc *Doc) state(client uint64) uint64 {
+	structs := doc.clients[client]
+	if len(structs) == 0 {
+		return 0
+	}
+	last := structs[len(structs)-1]
+	return last.id.Clock + uint64(last.length)
+}
+
+func (doc *Doc) findIndex(client uint64, clock uint64) int {
+	structs := doc.clients[client]
+	i := sort.Search(len(structs), func(i int) bool {
+		return structs[i].id.Clock+uint64(structs[i].length) > clock
+	})
+	if i == len(structs) || structs[i].id.Clock > clock {
+		return -1
+	}
+	return i
+}
+
+func (doc *Doc) getItem(id ID) *Item {
+	i := doc.findIndex(id.Client, id.Clock)
+	if i < 0 {
+		return nil
+	}
+	return doc.clients[id.Client][i]
+}
+
+// getItemCleanStart returns the item starting exactly at id, splitting if needed.
+func (doc *Doc) getItemCleanStart(id ID) *Item {
+	i := doc.findIndex(id.Client, id.Clock)
+	if i < 0 {
+		return nil
+	}
+	item := doc.clients[id.Client][i]
+	if item.id.Clock < id.Clock && !item.gc {
+		return doc.split(i, item, int(id.Clock-item.id.Clock))
+	}
+	return item
+}
+
+// getItemCleanEnd returns the item ending exactly at id, splitting if needed.
+func (doc *Doc) getItemCleanEnd(id ID) *Item {
+	i := doc.findIndex(id.Client, id.Clock)
+	if i < 0 {
+		return nil
+	}
+	item := doc.clients[id.Client][i]
+	if id.Clock != item.id.Clock+uint64(item.length)-1 && !item.gc {
+		doc.split(i, item, int(id.Clock-item.id.Clock)+1)
+	}
+	return item
+}
+
+func (doc *Doc) split(index int, left *Item, diff int) *Item {
+	right := &Item{
+		id:          ID{Client: left.id.Client, Clock: left.id.Clock + uint64(diff)},
+		origin:      &ID{Client: left.id.Client, Clock: left.id.Clock + uint64(diff) - 1},
+		rightOrigin: left.rightOrigin,
+		left:        left,
+		right:       left.right,
+		parent:      left.parent,
+		parentSub:   left.parentSub,
+		hasSub:      left.hasSub,
+		deleted:     left.deleted,
+	}
+	right.content = left.content.splice(diff)
+	right.length = right.content.len()
+	left.length = left.content.len()
+	left.right = right
+	if right.right != nil {
+		right.right.left = right
+	}
+	structs := doc.clients[left.id.Client]
+	structs = append(structs, nil)
+	copy(structs[index+2:], structs[index+1:])
+	structs[index+1] = right
+	doc.clients[left.id.Client] = structs
+	return right
+}
+
+func sameID(a, b *ID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// integrate places item in its parent following the YATA rules Yjs uses, so
+// concurrent inserts end up in the same order they have on the clients.
+func (doc *Doc) integrate(item *Item) {
+	if item.gc {
+		doc.clients[item.id.Client] = append(doc.clients[item.id.Client], item)
+		return
+	}
+	if item.origin != nil {
+		item.left = doc.getItemCleanEnd(*item.origin)
+	}
+	if item.rightOrigin != nil {
+		item.right = doc.getItemCleanStart(*item.rightOrigin)
+	}
+
+	switch {
+	case (item.left != nil && item.left.gc) || (item.right != nil && item.right.gc):
+		item.parent = nil
+	case item.parentKey != "":
+		item.parent = doc.root(item.parentKey)
+	case item.parentID != nil:
+		if parentItem := doc.getItem(*item.parentID); parentItem != nil && parentItem.content.ref == refType {
+			item.parent = parentItem.content.typ
+		}
+	case item.left != nil:
+		item.parent, item.parentSub, item.hasSub = item.left.parent, item.left.parentSub, item.left.hasSub
+	case item.right != nil:
+		item.parent, item.parentSub, item.hasSub = item.right.parent, item.right.parentSub, item.right.hasSub
+	}
+	if item.parent == nil {
+		// the parent was garbage collected, so is this item
+		item.gc = true
+		item.content = Content{ref: refGC}
+		doc.clients[item.id.Client] = append(doc.clients[item.id.Client], item)
+		return
+	}
+	parent := item.parent
+
+	if (item.left == nil && (item.right == nil || item.right.left != nil)) || (item.left != nil && item.left.right != item.right) {
+		left := item.left
+		var o *Item
+		switch {
+		case left != nil:
+			o = left.right
+		case item.hasSub:
+			o = parent.entries[item.parentSub]
+			for o != nil && o.left != nil {
+				o = o.left
+			}
+		default:
+			o = parent.start
+		}
+		conflicting := make(map[*Item]bool)
+		beforeOrigin := make(map[*Item]bool)
+		for o != nil && o != item.right {
+			beforeOrigin[o] = true
+			conflicting[o] = true
+			if sameID(item.origin, o.origin) {
+				if o.id.Client < item.id.Client {
+					left = o
+					clear(conflicting)
+				} else if sameID(item.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if o.origin != nil && beforeOrigin[doc.getItem(*o.origin)] {
+				if !conflicting[doc.getItem(*o.origin)] {
+					left = o
+					clear(conflicting)
+				}
+			} else {
+				break
+			}
+			o = o.right
+		}
+		item.left = left
+	}
+
+	if item.left != nil {
+		item.right = item.left.right
+		item.left.right = item
+	} else {
+		var r *Item
+		if item.hasSub {
+			r = parent.entries[item.parentSub]
+			for r != nil && r.left != nil {
+				r = r.left
+			}
+		} else {
+			r = parent.start
+			parent.start = item
+		}
+		item.right = r
+	}
+	if item.right != nil {
+		item.right.left = item
+	} else if item.hasSub {
+		if parent.entries == nil {
+			parent.entries = make(map[string]*Item)
+		}
+		parent.entries[item.parentSub] = item
+		if item.left != nil {
+			item.left.deleted = true
+		}
+	}
+
+	doc.clients[item.id.Client] = append(doc.clients[item.id.Client], item)
+	if item.content.ref == refType {
+		item.content.typ.item = item
+	}
+	if item.content.ref == refDeleted || (parent.item != nil && parent.item.deleted) || (item.hasSub && item.right != nil) {
+		item.deleted = true
+	}
+}
+
+func (doc *Doc) applyDeleteSet(d *decoder) error {
+	if d.pos >= len(d.buf) {
+		return nil
+	}
+	numClients, err := d.readCount()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return err
+		}
+		numDeletes, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < numDeletes; j++ {
+			clock, err := d.readVarUint()
+			if err != nil {
+				return err
+			}
+			length, err := d.readVarUint()
+			if err != nil {
+				return err
+			}
+			doc.deleteRange(client, clock, clock+length)
+		}
+	}
+	return nil
+}
+
+func (doc *Doc) deleteRange(client uint64, start, end uint64) {
+	if start >= end || doc.findIndex(client, start) < 0 {
+		return
+	}
+	doc.getItemCleanStart(ID{Client: client, Clock: start})
+	for clock := start; clock < end; {
+		i := doc.findIndex(client, clock)
+		if i < 0 {
+			return
+		}
+		item := doc.clients[client][i]
+		if item.id.Clock+uint64(item.length) > end {
+			doc.getItemCleanEnd(ID{Client: client, Clock: end - 1})
+		}
+		item.deleted = true
+		clock = item.id.Clock + uint64(item.length)
+	}
+}
@@ -0,0 +1,242 @@
+package crdt
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+// The fixtures are what Y.encodeStateAsUpdate (update v1) returns for the
+// Yjs calls above each one, with doc.clientID set so the bytes are stable.
+// Structs are grouped by client, highest client first, and end with the
+// delete set.
+var (
+	// client 1: doc.getText('t').insert(0, 'hello')
+	textUpdate = []byte{
+		1,       // one client
+		1, 1, 0, // one struct, client 1, clock 0
+		0x04, 1, 1, 't', 5, 'h', 'e', 'l', 'l', 'o', // string, parent root "t"
+		0, // empty delete set
+	}
+
+	// client 1: text.insert(0, 'abc'); client 2, after syncing:
+	// text.insert(1, 'X'). Client 2's insert splits "abc" in its copy.
+	concurrentUpdate = []byte{
+		2,
+		1, 2, 0,
+		0xc4, 1, 0, 1, 1, 1, 'X', // string, origin 1:0, right origin 1:1
+		2, 1, 0,
+		0x04, 1, 1, 't', 1, 'a',
+		0x84, 1, 0, 2, 'b', 'c', // the split off tail, origin 1:0
+		0,
+	}
+
+	// client 1: text.insert(0, 'abc'); text.delete(1, 1). The deleted
+	// character is garbage collected into ContentDeleted.
+	deleteUpdate = []byte{
+		1,
+		3, 1, 0,
+		0x04, 1, 1, 't', 1, 'a',
+		0x81, 1, 0, 1, // deleted, length 1
+		0x84, 1, 1, 1, 'c',
+		1, 1, 1, 1, 1, // client 1 deleted clock 1, length 1
+	}
+
+	// client 1: text.insert(0, 'abc') merged with a later update that
+	// deletes 'b' from another peer, the delete set splits the item.
+	mergedDeleteUpdate = []byte{
+		1,
+		1, 1, 0,
+		0x04, 1, 1, 't', 3, 'a', 'b', 'c',
+		1, 1, 1, 1, 1,
+	}
+
+	// client 1: text.insert(0, 'hi '); text.insert(3, 'there', {bold: true})
+	formatUpdate = []byte{
+		1,
+		4, 1, 0,
+		0x04, 1, 1, 't', 3, 'h', 'i', ' ',
+		0x86, 1, 2, 4, 'b', 'o', 'l', 'd', 4, 't', 'r', 'u', 'e', // format bold=true
+		0x84, 1, 3, 5, 't', 'h', 'e', 'r', 'e',
+		0x86, 1, 8, 4, 'b', 'o', 'l', 'd', 4, 'n', 'u', 'l', 'l', // format bold=null
+		0,
+	}
+
+	// client 1: doc.getMap('m').set('k', {a: [1, 'x', -5], b: 'y'})
+	anyUpdate = []byte{
+		1,
+		1, 1, 0,
+		0x28, 1, 1, 'm', 1, 'k', // any with parent sub, root "m", key "k"
+		1,      // one value
+		118, 2, // object, two keys
+		1, 'a', 117, 3, 125, 0x01, 119, 1, 'x', 125, 0x45, // [1, 'x', -5]
+		1, 'b', 119, 1, 'y',
+		0,
+	}
+
+	// client 1: a ProseMirror paragraph holding "Hi" in the "default"
+	// XmlFragment.
+	xmlUpdate = []byte{
+		1,
+		3, 1, 0,
+		0x07, 1, 7, 'd', 'e', 'f', 'a', 'u', 'l', 't', 3, 9, 'p', 'a', 'r', 'a', 'g', 'r', 'a', 'p', 'h',
+		0x07, 0, 1, 0, 6, // XmlText inside 1:0
+		0x04, 0, 1, 1, 2, 'H', 'i', // string inside 1:1
+		0,
+	}
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+		want   string
+	}{
+		{"insert", textUpdate, "hello"},
+		{"concurrent insert", concurrentUpdate, "aXbc"},
+		{"delete", deleteUpdate, "ac"},
+		{"delete inside an item", mergedDeleteUpdate, "ac"},
+		{"formatting", formatUpdate, "hi there"},
+		{"xml", xmlUpdate, "Hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := Decode(tt.update)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if got := doc.PlainText(); got != tt.want {
+				t.Errorf("PlainText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeNodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+		want   []Node
+	}{
+		{"formatting", formatUpdate, []Node{
+			{Text: "hi ", Marks: map[string]interface{}{}},
+			{Text: "there", Marks: map[string]interface{}{"bold": true}},
+		}},
+		{"delete", deleteUpdate, []Node{
+			{Text: "ac", Marks: map[string]interface{}{}},
+		}},
+		{"xml", xmlUpdate, []Node{
+			{Name: "paragraph", Attrs: map[string]interface{}{}, Children: []Node{
+				{Text: "Hi", Marks: map[string]interface{}{}},
+			}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := Decode(tt.update)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if got := doc.Nodes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Nodes() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeAny(t *testing.T) {
+	doc, err := Decode(anyUpdate)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	root := doc.Root("m")
+	if root == nil {
+		t.Fatal(`Root("m") = nil`)
+	}
+	got, ok := root.Attr("k")
+	if !ok {
+		t.Fatal(`Attr("k") not found`)
+	}
+	want := map[string]interface{}{
+		"a": []interface{}{int64(1), "x", int64(-5)},
+		"b": "y",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf(`Attr("k") = %#v, want %#v`, got, want)
+	}
+}
+
+func TestDecodeSnapshot(t *testing.T) {
+	for _, content := range []string{string(textUpdate), base64.StdEncoding.EncodeToString(textUpdate)} {
+		doc, err := DecodeSnapshot(content)
+		if err != nil {
+			t.Fatalf("DecodeSnapshot(%q): %v", content, err)
+		}
+		if got := doc.PlainText(); got != "hello" {
+			t.Errorf("PlainText() = %q, want %q", got, "hello")
+		}
+	}
+	if _, err := DecodeSnapshot(""); err == nil {
+		t.Error("DecodeSnapshot of an empty snapshot succeeded")
+	}
+}
+
+// nestedArrays is an any value of n arrays, each holding the next.
+func nestedArrays(n int) []byte {
+	update := []byte{1, 1, 1, 0, 0x08, 1, 1, 'a', 1}
+	for i := 0; i < n; i++ {
+		update = append(update, 117, 1)
+	}
+	return append(update, 126, 0)
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+	}{
+		{"empty", nil},
+		{"truncated", textUpdate[:8]},
+		{"unknown content ref", []byte{1, 1, 1, 0, 0x0b, 1, 1, 't', 0}},
+		{"unknown any type", []byte{1, 1, 1, 0, 0x08, 1, 1, 'a', 1, 100, 0}},
+		{"huge object", []byte{1, 1, 1, 0, 0x08, 1, 1, 'a', 1, 118, 0xff, 0xff, 0xff, 0xff, 0x07, 0}},
+		{"huge array", []byte{1, 1, 1, 0, 0x08, 1, 1, 'a', 1, 117, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0}},
+		{"huge client count", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"nested too deep", nestedArrays(maxAnyDepth + 1)},
+		{"missing origin", []byte{1, 1, 1, 0, 0x84, 2, 0, 1, 'a', 0}},
+		{"circular origins", []byte{
+			2,
+			1, 2, 0, 0x84, 1, 0, 1, 'a',
+			1, 1, 0, 0x84, 2, 0, 1, 'b',
+			0,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.update); err == nil {
+				t.Error("Decode succeeded")
+			}
+		})
+	}
+
+	if _, err := Decode(nestedArrays(maxAnyDepth)); err != nil {
+		t.Errorf("Decode of %d nested arrays: %v", maxAnyDepth, err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, update := range [][]byte{
+		textUpdate, concurrentUpdate, deleteUpdate, mergedDeleteUpdate,
+		formatUpdate, anyUpdate, xmlUpdate, nestedArrays(3),
+	} {
+		f.Add(update)
+	}
+	f.Fuzz(func(t *testing.T, update []byte) {
+		doc, err := Decode(update)
+		if err != nil {
+			return
+		}
+		doc.PlainText()
+		doc.Nodes()
+	})
+}
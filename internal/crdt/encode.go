@@ -0,0 +1,216 @@
+package crdt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"reflect"
+	"sort"
+)
+
+// DefaultRoot is the Y.XmlFragment ProseMirror bindings edit by default.
+const DefaultRoot = "default"
+
+// Encode builds a Yjs update (v1 encoding) that creates the given tree in the
+// DefaultRoot XmlFragment. Elements become Y.XmlElements; runs of text inside
+// an element share one Y.XmlText, with marks written as formatting
+// attributes the way y-prosemirror does.
+//
+// All structs belong to one fresh client, so the update applies cleanly to
+// an empty document.
+func Encode(nodes []Node) ([]byte, error) {
+	w := &updateWriter{client: newClientID()}
+	if err := w.writeChildren(nil, nodes); err != nil {
+		return nil, err
+	}
+
+	e := &encoder{}
+	if w.clock == 0 {
+		e.writeVarUint(0)
+	} else {
+		e.writeVarUint(1)
+		e.writeVarUint(uint64(len(w.structs)))
+		e.writeVarUint(w.client)
+		e.writeVarUint(0)
+		e.buf = append(e.buf, w.body.buf...)
+	}
+	e.writeVarUint(0) // empty delete set
+	return e.buf, nil
+}
+
+// newClientID picks a random 32 bit client ID, as Yjs does.
+func newClientID() uint64 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return uint64(binary.BigEndian.Uint32(b[:]))
+}
+
+type updateWriter struct {
+	client  uint64
+	clock   uint64
+	structs []ID
+	body    encoder
+}
+
+// writeItem appends one item. left is the last ID of the preceding sibling,
+// parent the ID of the containing type's item; both nil means the first
+// child of the root.
+func (w *updateWriter) writeItem(left *ID, parent *ID, parentSub string, ref int, length int, content func(e *encoder) error) (ID, error) {
+	id := ID{Client: w.client, Clock: w.clock}
+	info := byte(ref)
+	if left != nil {
+		info |= 0x80
+	}
+	if parentSub != "" {
+		info |= 0x20
+	}
+	w.body.writeUint8(info)
+	if left != nil {
+		w.body.writeVarUint(left.Client)
+		w.body.writeVarUint(left.Clock)
+	} else {
+		if parent == nil {
+			w.body.writeVarUint(1)
+			w.body.writeVarString(DefaultRoot)
+		} else {
+			w.body.writeVarUint(0)
+			w.body.writeVarUint(parent.Client)
+			w.body.writeVarUint(parent.Clock)
+		}
+		if parentSub != "" {
+			w.body.writeVarString(parentSub)
+		}
+	}
+	if err := content(&w.body); err != nil {
+		return id, err
+	}
+	w.structs = append(w.structs, id)
+	w.clock += uint64(length)
+	return ID{Client: w.client, Clock: w.clock - 1}, nil
+}
+
+// writeChildren writes the content of a type. Consecutive text runs are
+// grouped into a single XmlText.
+func (w *updateWriter) writeChildren(parent *ID, nodes []Node) error {
+	var left *ID
+	for i := 0; i < len(nodes); {
+		if nodes[i].IsText() {
+			j := i
+			for j < len(nodes) && nodes[j].IsText() {
+				j++
+			}
+			last, err := w.writeXmlText(left, parent, nodes[i:j])
+			if err != nil {
+				return err
+			}
+			left, i = &last, j
+			continue
+		}
+		last, err := w.writeElement(left, parent, &nodes[i])
+		if err != nil {
+			return err
+		}
+		left = &last
+		i++
+	}
+	return nil
+}
+
+func (w *updateWriter) writeElement(left *ID, parent *ID, n *Node) (ID, error) {
+	id, err := w.writeItem(left, parent, "", refType, 1, func(e *encoder) error {
+		e.writeVarUint(TypeXmlElement)
+		e.writeVarString(n.Name)
+		return nil
+	})
+	if err != nil {
+		return id, err
+	}
+	keys := make([]string, 0, len(n.Attrs))
+	for key := range n.Attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := n.Attrs[key]
+		_, err := w.writeItem(nil, &id, key, refAny, 1, func(e *encoder) error {
+			e.writeVarUint(1)
+			return e.writeAny(value)
+		})
+		if err != nil {
+			return id, err
+		}
+	}
+	return id, w.writeChildren(&id, n.Children)
+}
+
+func (w *updateWriter) writeXmlText(left *ID, parent *ID, runs []Node) (ID, error) {
+	id, err := w.writeItem(left, parent, "", refType, 1, func(e *encoder) error {
+		e.writeVarUint(TypeXmlText)
+		return nil
+	})
+	if err != nil {
+		return id, err
+	}
+
+	var prev *ID
+	active := map[string]interface{}{}
+	format := func(key string, value interface{}) error {
+		last, err := w.writeItem(prev, &id, "", refFormat, 1, func(e *encoder) error {
+			e.writeVarString(key)
+			return e.writeJSON(value)
+		})
+		prev = &last
+		return err
+	}
+	for _, run := range runs {
+		if run.Text == "" {
+			continue
+		}
+		for _, key := range sortedKeys(active, run.Marks) {
+			value, ok := run.Marks[key]
+			if !ok {
+				value = nil
+			} else if current, on := active[key]; on && reflect.DeepEqual(current, value) {
+				continue
+			}
+			if err := format(key, value); err != nil {
+				return id, err
+			}
+			if value == nil {
+				delete(active, key)
+			} else {
+				active[key] = value
+			}
+		}
+		text := run.Text
+		last, err := w.writeItem(prev, &id, "", refString, len(encodeUTF16(text)), func(e *encoder) error {
+			e.writeVarString(text)
+			return nil
+		})
+		if err != nil {
+			return id, err
+		}
+		prev = &last
+	}
+	for _, key := range sortedKeys(active, nil) {
+		if err := format(key, nil); err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+// sortedKeys is the sorted union of the keys of a and b.
+func sortedKeys(a, b map[string]interface{}) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var keys []string
+	for _, m := range []map[string]interface{}{a, b} {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,64 @@
+package crdt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	plain := map[string]interface{}{}
+	nodes := []Node{
+		{Name: "heading", Attrs: map[string]interface{}{"level": int64(2)}, Children: []Node{
+			{Text: "Title", Marks: plain},
+		}},
+		{Name: "paragraph", Attrs: map[string]interface{}{}, Children: []Node{
+			{Text: "Some ", Marks: plain},
+			{Text: "bold", Marks: map[string]interface{}{"bold": true}},
+			{Text: " and ", Marks: plain},
+			{Text: "linked 😀", Marks: map[string]interface{}{
+				"bold": true,
+				"link": map[string]interface{}{"href": "https://example.com"},
+			}},
+			{Text: " text", Marks: plain},
+		}},
+		{Name: "blockquote", Attrs: map[string]interface{}{}, Children: []Node{
+			{Name: "paragraph", Attrs: map[string]interface{}{}, Children: []Node{
+				{Text: "Quoted", Marks: map[string]interface{}{"italic": true}},
+			}},
+		}},
+		{Name: "horizontalRule", Attrs: map[string]interface{}{}},
+	}
+
+	update, err := Encode(nodes)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	doc, err := Decode(update)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if names := doc.RootNames(); !reflect.DeepEqual(names, []string{DefaultRoot}) {
+		t.Errorf("RootNames() = %q, want %q", names, DefaultRoot)
+	}
+	if got := doc.Nodes(); !reflect.DeepEqual(got, nodes) {
+		t.Errorf("Nodes() = %#v\nwant %#v", got, nodes)
+	}
+	want := "Title\nSome bold and linked 😀 text\nQuoted"
+	if got := doc.PlainText(); got != want {
+		t.Errorf("PlainText() = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	update, err := Encode(nil)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	doc, err := Decode(update)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if nodes := doc.Nodes(); len(nodes) != 0 {
+		t.Errorf("Nodes() = %#v, want none", nodes)
+	}
+}
@@ -0,0 +1,128 @@
+package crdt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// encoder writes the lib0 binary encoding used by Yjs updates.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) writeUint8(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) writeVarUint(num uint64) {
+	for num >= 0x80 {
+		e.buf = append(e.buf, byte(num)|0x80)
+		num >>= 7
+	}
+	e.buf = append(e.buf, byte(num))
+}
+
+func (e *encoder) writeVarInt(num int64) {
+	var sign byte
+	if num < 0 {
+		sign = 0x40
+		num = -num
+	}
+	b := byte(num&0x3f) | sign
+	num >>= 6
+	for {
+		if num > 0 {
+			b |= 0x80
+		}
+		e.buf = append(e.buf, b)
+		if num == 0 {
+			return
+		}
+		b = byte(num & 0x7f)
+		num >>= 7
+	}
+}
+
+func (e *encoder) writeVarString(s string) {
+	e.writeVarUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeJSON(v interface{}) error {
+	if v == nil {
+		e.writeVarString("null")
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.writeVarString(string(b))
+	return nil
+}
+
+// writeAny encodes a value the way lib0's encoding.writeAny does, it is the
+// inverse of decoder.readAny.
+func (e *encoder) writeAny(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.writeUint8(126)
+	case bool:
+		if v {
+			e.writeUint8(120)
+		} else {
+			e.writeUint8(121)
+		}
+	case string:
+		e.writeUint8(119)
+		e.writeVarString(v)
+	case int:
+		return e.writeAny(int64(v))
+	case int64:
+		if v > math.MaxInt32 || v < math.MinInt32 {
+			e.writeUint8(122)
+			e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+		} else {
+			e.writeUint8(125)
+			e.writeVarInt(v)
+		}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return e.writeAny(int64(v))
+		}
+		e.writeUint8(123)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v))
+	case []byte:
+		e.writeUint8(116)
+		e.writeVarUint(uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	case []interface{}:
+		e.writeUint8(117)
+		e.writeVarUint(uint64(len(v)))
+		for _, item := range v {
+			if err := e.writeAny(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.writeUint8(118)
+		e.writeVarUint(uint64(len(keys)))
+		for _, key := range keys {
+			e.writeVarString(key)
+			if err := e.writeAny(v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("crdt: cannot encode %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package crdt
+
+import "reflect"
+
+// Node is a read-only view of the document tree. Elements have a Name,
+// attributes and children; text runs have Text and the formatting marks
+// active over it.
+type Node struct {
+	Name     string
+	Attrs    map[string]interface{}
+	Children []Node
+	Text     string
+	Marks    map[string]interface{}
+}
+
+// IsText reports whether the node is a text run.
+func (n *Node) IsText() bool {
+	return n.Name == ""
+}
+
+// Nodes returns the content of every root type in order. Y.XmlFragment roots
+// (ProseMirror and TipTap) yield elements; Y.Text roots yield text runs.
+func (doc *Doc) Nodes() []Node {
+	var nodes []Node
+	for _, name := range doc.rootOrder {
+		nodes = append(nodes, typeNodes(doc.roots[name], 0)...)
+	}
+	return nodes
+}
+
+// typeNodes converts t's content, leaving out types nested deeper than
+// maxTypeDepth.
+func typeNodes(t *Type, depth int) []Node {
+	if depth > maxTypeDepth {
+		return nil
+	}
+	var nodes []Node
+	marks := map[string]interface{}{}
+	for item := t.start; item != nil; item = item.right {
+		if item.deleted {
+			continue
+		}
+		switch item.content.ref {
+		case refFormat:
+			marks = copyMarks(marks)
+			if item.content.value == nil {
+				delete(marks, item.content.key)
+			} else {
+				marks[item.content.key] = item.content.value
+			}
+		case refString:
+			nodes = appendText(nodes, decodeUTF16(item.content.str), marks)
+		case refType:
+			child := item.content.typ
+			if child.Ref == TypeXmlElement {
+				nodes = append(nodes, Node{
+					Name:     child.NodeName,
+					Attrs:    child.attrs(),
+					Children: typeNodes(child, depth+1),
+				})
+			} else {
+				for _, n := range typeNodes(child, depth+1) {
+					if n.IsText() {
+						nodes = appendText(nodes, n.Text, n.Marks)
+					} else {
+						nodes = append(nodes, n)
+					}
+				}
+			}
+		}
+	}
+	return nodes
+}
+
+// appendText adds a text run, merging it into the previous one when the
+// marks are the same.
+func appendText(nodes []Node, text string, marks map[string]interface{}) []Node {
+	if last := len(nodes) - 1; last >= 0 && nodes[last].IsText() && reflect.DeepEqual(nodes[last].Marks, marks) {
+		nodes[last].Text += text
+		return nodes
+	}
+	return append(nodes, Node{Text: text, Marks: marks})
+}
+
+func copyMarks(marks map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(marks))
+	for k, v := range marks {
+		c[k] = v
+	}
+	return c
+}
+
+func (t *Type) attrs() map[string]interface{} {
+	attrs := make(map[string]interface{}, len(t.entries))
+	for key := range t.entries {
+		if v, ok := t.Attr(key); ok {
+			attrs[key] = v
+		}
+	}
+	return attrs
+}
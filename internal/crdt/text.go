@@ -0,0 +1,80 @@
+package crdt
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+var extraNewlines = regexp.MustCompile(`\n{3,}`)
+
+func encodeUTF16(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+func decodeUTF16(s []uint16) string {
+	return string(utf16.Decode(s))
+}
+
+// Children returns the live items of a sequence type in document order.
+func (t *Type) Children() []*Item {
+	var items []*Item
+	for item := t.start; item != nil; item = item.right {
+		if !item.deleted && item.content.countable() {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Attr returns the current value stored under key in a map-like type, such
+// as an XmlElement's attributes.
+func (t *Type) Attr(key string) (interface{}, bool) {
+	item, ok := t.entries[key]
+	if !ok || item.deleted {
+		return nil, false
+	}
+	switch item.content.ref {
+	case refAny, refJSON:
+		if len(item.content.values) > 0 {
+			return item.content.values[len(item.content.values)-1], true
+		}
+	case refType:
+		return item.content.typ, true
+	case refEmbed, refBinary:
+		return item.content.value, true
+	}
+	return nil, false
+}
+
+// PlainText flattens every root type into text, one block per line. It is
+// what the search index is built from.
+func (doc *Doc) PlainText() string {
+	var sb strings.Builder
+	for _, name := range doc.rootOrder {
+		writeText(&sb, doc.roots[name], 0)
+		sb.WriteByte('\n')
+	}
+	text := extraNewlines.ReplaceAllString(sb.String(), "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// writeText writes t's text, leaving out types nested deeper than
+// maxTypeDepth.
+func writeText(sb *strings.Builder, t *Type, depth int) {
+	if depth > maxTypeDepth {
+		return
+	}
+	for _, item := range t.Children() {
+		switch item.content.ref {
+		case refString:
+			sb.WriteString(decodeUTF16(item.content.str))
+		case refType:
+			child := item.content.typ
+			writeText(sb, child, depth+1)
+			if child.Ref == TypeXmlElement {
+				sb.WriteByte('\n')
+			}
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"livescribble/internal/utils"
-	"os"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -18,25 +19,56 @@ func NewDatabaseManager() *Manager {
 	return &Manager{}
 }
 
-func (dbm *Manager) Connect() error {
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		return fmt.Errorf("DATABASE_URL environment variable not set")
+// Connect opens the pool and migrates the schema. log receives GORM's
+// output, see logging.GormLogger.
+func (dbm *Manager) Connect(dsn string, log logger.Interface) error {
+	if err := dbm.Open(dsn, log); err != nil {
+		return err
+	}
+	if err := dbm.Migrate(); err != nil {
+		return fmt.Errorf("migrating schema: %w", err)
 	}
+	return nil
+}
+
+// Open opens the pool without touching the schema.
+func (dbm *Manager) Open(dsn string, log logger.Interface) error {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger: log,
 	})
 	if err != nil {
 		return err
 	}
+	dbm.DB = db
+	return nil
+}
 
-	err = db.AutoMigrate(utils.User{}, utils.Document{})
+// Migrate brings the schema up to date. Every step runs even when an
+// earlier one fails, the errors are joined.
+func (dbm *Manager) Migrate() error {
+	var errs []error
+	err := dbm.DB.AutoMigrate(utils.User{}, utils.Document{}, utils.APIKey{}, utils.RecoveryCode{}, utils.Folder{}, utils.CommentThread{}, utils.Comment{}, utils.Notification{}, utils.Webhook{}, utils.WebhookDelivery{}, utils.AuditEvent{})
 	if err != nil {
-		fmt.Printf("%s", err.Error())
+		errs = append(errs, err)
 	}
-	dbm.DB = db
-	return nil
+	if err := migrateSearch(dbm.DB); err != nil {
+		errs = append(errs, err)
+	}
+	if err := migrateAudit(dbm.DB); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks that Postgres answers on the pool.
+func (dbm *Manager) Ping(ctx context.Context) error {
+	db, err := dbm.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
 }
+
 func (dbm *Manager) Close() error {
 	db, err := dbm.DB.DB()
 	if err != nil {
@@ -44,3 +76,38 @@ func (dbm *Manager) Close() error {
 	}
 	return db.Close()
 }
+
+// migrateSearch adds the full-text search column, which AutoMigrate cannot
+// express. It is generated from the title and the snapshot text so it never
+// goes stale.
+func migrateSearch(db *gorm.DB) error {
+	err := db.Exec(`ALTER TABLE documents ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (
+			setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+			setweight(to_tsvector('english', coalesce(search_text, '')), 'B')
+		) STORED`).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_documents_search_vector ON documents USING GIN (search_vector)").Error
+}
+
+// migrateAudit makes audit_events append-only for the application: any
+// UPDATE or DELETE fails, only a superuser dropping the trigger can edit it.
+func migrateAudit(db *gorm.DB) error {
+	err := db.Exec(`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return err
+	}
+	err = db.Exec("DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events").Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`CREATE TRIGGER audit_events_append_only
+		BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`).Error
+}
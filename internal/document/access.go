@@ -0,0 +1,252 @@
+package document
+
+import (
+	"encoding/json"
+	"errors"
+	"livescribble/internal/utils"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RoleOwner     = "owner"
+	RoleEditor    = "editor"
+	RoleCommenter = "commenter" // may read and comment, but not edit
+	RoleViewer    = "viewer"
+
+	// maxFolderDepth bounds ancestor walks, so a corrupted parent chain
+	// cannot loop forever.
+	maxFolderDepth = 32
+)
+
+// ErrNoAccess is returned when the document exists but the user has no role on it.
+var ErrNoAccess = errors.New("no access to document")
+
+// ErrAlreadyOwner is returned by TransferOwner when nothing would change.
+var ErrAlreadyOwner = errors.New("user already owns the document")
+
+var roleRank = map[string]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+// AccessEntry is one element of Document.Access and Folder.Access.
+type AccessEntry struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// ParseAccess decodes an Access column. Older rows store a plain array of
+// user IDs, those users are treated as editors.
+func ParseAccess(raw string) []AccessEntry {
+	var entries []AccessEntry
+	if err := json.Unmarshal([]byte(raw), &entries); err == nil {
+		return entries
+	}
+	var userIDs []string
+	if err := json.Unmarshal([]byte(raw), &userIDs); err != nil {
+		return nil
+	}
+	for _, id := range userIDs {
+		entries = append(entries, AccessEntry{UserID: id, Role: RoleEditor})
+	}
+	return entries
+}
+
+// SetAccess returns raw with the user's role replaced, or removed when role
+// is empty.
+func SetAccess(raw string, userID string, role string) string {
+	entries := make([]AccessEntry, 0)
+	for _, entry := range ParseAccess(raw) {
+		if entry.UserID != userID {
+			entries = append(entries, entry)
+		}
+	}
+	if role != "" {
+		entries = append(entries, AccessEntry{UserID: userID, Role: role})
+	}
+	return string(mustJSON(entries))
+}
+
+// RemoveUserAccess takes the user off every document and folder shared with
+// them. Account deletion runs it inside its transaction.
+func RemoveUserAccess(tx *gorm.DB, userID string) error {
+	entry := string(mustJSON([]map[string]string{{"user_id": userID}}))
+	legacy := string(mustJSON([]string{userID}))
+
+	var documents []utils.Document
+	err := tx.Model(utils.Document{}).Select("id, access").Where("access @> ?::jsonb OR access @> ?::jsonb", entry, legacy).Find(&documents).Error
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		if err := tx.Model(&document).Update("access", SetAccess(document.Access, userID, "")).Error; err != nil {
+			return err
+		}
+	}
+	var folders []utils.Folder
+	if err := tx.Model(utils.Folder{}).Select("id, access").Where("access @> ?::jsonb", entry).Find(&folders).Error; err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if err := tx.Model(&folder).Update("access", SetAccess(folder.Access, userID, "")).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidShareRole reports whether role can be granted through sharing.
+func ValidShareRole(role string) bool {
+	return role != RoleOwner && roleRank[role] > 0
+}
+
+// RoleFor returns the user's role granted on the document itself, or "" if
+// they have none. Roles inherited from folders are resolved by Authorize.
+func RoleFor(document *utils.Document, userID string) string {
+	if document.UserID == userID {
+		return RoleOwner
+	}
+	return accessRole(document.Access, userID)
+}
+
+func accessRole(raw string, userID string) string {
+	for _, entry := range ParseAccess(raw) {
+		if entry.UserID == userID {
+			return entry.Role
+		}
+	}
+	return ""
+}
+
+// strongerRole returns whichever of the two roles grants more.
+func strongerRole(a, b string) string {
+	if roleRank[b] > roleRank[a] {
+		return b
+	}
+	return a
+}
+
+// CanEdit reports whether the role may change document content.
+func CanEdit(role string) bool {
+	return role == RoleOwner || role == RoleEditor
+}
+
+// CanComment reports whether the role may take part in comment threads.
+func CanComment(role string) bool {
+	return roleRank[role] >= roleRank[RoleCommenter]
+}
+
+// Authorize loads the document and the user's effective role on it. It
+// returns gorm.ErrRecordNotFound for unknown or trashed documents and
+// ErrNoAccess when the user has no role.
+func Authorize(db *gorm.DB, docId string, userID string) (*utils.Document, string, error) {
+	var document utils.Document
+	err := db.Model(utils.Document{}).Omit("content", "search_text").Where("id = ? AND trashed_at IS NULL", docId).First(&document).Error
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := EffectiveRole(db, &document, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if role == "" {
+		return nil, "", ErrNoAccess
+	}
+	return &document, role, nil
+}
+
+// TransferOwner hands the document to newOwnerID and returns the previous
+// owner. The document leaves the previous owner's folder, the new owner's
+// share is dropped and the previous owner keeps previousRole on it, or no
+// access when previousRole is empty.
+func TransferOwner(db *gorm.DB, docId string, newOwnerID string, previousRole string) (string, error) {
+	var previousOwner string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var document utils.Document
+		err := tx.Model(utils.Document{}).Select("id, user_id, access").Where("id = ?", docId).First(&document).Error
+		if err != nil {
+			return err
+		}
+		if document.UserID == newOwnerID {
+			return ErrAlreadyOwner
+		}
+		previousOwner = document.UserID
+		access := SetAccess(document.Access, newOwnerID, "")
+		if previousRole != "" {
+			access = SetAccess(access, previousOwner, previousRole)
+		}
+		return tx.Model(utils.Document{}).Where("id = ? AND user_id = ?", docId, previousOwner).Updates(map[string]interface{}{
+			"user_id":   newOwnerID,
+			"folder_id": nil,
+			"access":    access,
+		}).Error
+	})
+	return previousOwner, err
+}
+
+// EffectiveRole is the strongest of the user's role on the document and the
+// roles on every folder above it.
+func EffectiveRole(db *gorm.DB, document *utils.Document, userID string) (string, error) {
+	role := RoleFor(document, userID)
+	if role == RoleOwner || document.FolderID == nil {
+		return role, nil
+	}
+	inherited, err := folderRole(db, *document.FolderID, userID)
+	if err != nil {
+		return "", err
+	}
+	return strongerRole(role, inherited), nil
+}
+
+// folderRole is the user's role on a folder, inherited down from its
+// ancestors. Owning a folder makes you owner of everything in it.
+func folderRole(db *gorm.DB, folderID string, userID string) (string, error) {
+	role := ""
+	for depth := 0; folderID != "" && depth < maxFolderDepth; depth++ {
+		var folder utils.Folder
+		err := db.Model(utils.Folder{}).Where("id = ?", folderID).First(&folder).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				break
+			}
+			return "", err
+		}
+		if folder.UserID == userID {
+			return RoleOwner, nil
+		}
+		role = strongerRole(role, accessRole(folder.Access, userID))
+		folderID = ""
+		if folder.ParentID != nil {
+			folderID = *folder.ParentID
+		}
+	}
+	return role, nil
+}
+
+// sharedWith matches documents shared with the user directly, in either the
+// current or the legacy Access format, or through any folder above them.
+func sharedWith(db *gorm.DB, userID string) *gorm.DB {
+	entry := string(mustJSON([]map[string]string{{"user_id": userID}}))
+	legacy := string(mustJSON([]string{userID}))
+	return db.Where("access @> ?::jsonb OR access @> ?::jsonb", entry, legacy).
+		Or("folder_id IN (?)", sharedFolderIDs(db, userID))
+}
+
+// sharedFolderIDs selects folders shared with the user and all their
+// descendants.
+func sharedFolderIDs(db *gorm.DB, userID string) *gorm.DB {
+	entry := string(mustJSON([]map[string]string{{"user_id": userID}}))
+	return db.Raw(`WITH RECURSIVE shared_folders AS (
+			SELECT id FROM folders WHERE access @> ?::jsonb AND user_id <> ?
+			UNION
+			SELECT f.id FROM folders f JOIN shared_folders s ON f.parent_id = s.id
+		) SELECT id FROM shared_folders`, entry, userID)
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
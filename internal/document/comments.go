@@ -0,0 +1,407 @@
+package document
+
+import (
+	"encoding/json"
+	"errors"
+	"livescribble/internal/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxCommentLength = 10000
+
+// Comment events, sent to the room as the "type" of a FrameComment.
+const (
+	EventThreadCreated  = "thread_created"
+	EventThreadResolved = "thread_resolved"
+	EventThreadReopened = "thread_reopened"
+	EventThreadDeleted  = "thread_deleted"
+	EventCommentAdded   = "comment_added"
+	EventCommentEdited  = "comment_edited"
+	EventCommentDeleted = "comment_deleted"
+)
+
+// CommentEvent is the payload of a FrameComment.
+type CommentEvent struct {
+	Type      string               `json:"type"`
+	ThreadID  string               `json:"thread_id"`
+	Thread    *utils.CommentThread `json:"thread,omitempty"`
+	Comment   *utils.Comment       `json:"comment,omitempty"`
+	CommentID string               `json:"comment_id,omitempty"`
+}
+
+// CommentAnchor is the range a thread is attached to. Start and End are
+// Yjs relative positions as encoded by the client, so the anchor follows the
+// text through concurrent edits. Quote is the text selected at the time.
+type CommentAnchor struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Quote string `json:"quote,omitempty"`
+}
+
+// ListComments returns the document's threads with their comments, oldest
+// first. status=open or status=resolved narrows the list.
+func (h *Handler) ListComments(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	if _, _, err := Authorize(h.db, docId, currentUser); err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	query := h.db.Model(utils.CommentThread{}).Where("document_id = ?", docId)
+	switch ctx.DefaultQuery("status", "all") {
+	case "all":
+	case "open":
+		query = query.Where("resolved_at IS NULL")
+	case "resolved":
+		query = query.Where("resolved_at IS NOT NULL")
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "status must be open, resolved or all",
+		})
+		return
+	}
+
+	threads := make([]utils.CommentThread, 0)
+	err := query.Preload("Comments", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created, id")
+	}).Order("created, id").Find(&threads).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list comments", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving comments",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"threads": threads,
+	})
+}
+
+// CreateThread starts a thread on a range of the document. anchor is a
+// CommentAnchor in JSON.
+func (h *Handler) CreateThread(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	document, ok := h.authorizeComment(ctx, docId, currentUser)
+	if !ok {
+		return
+	}
+	var anchor CommentAnchor
+	if err := json.Unmarshal([]byte(ctx.PostForm("anchor")), &anchor); err != nil || anchor.Start == "" || anchor.End == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid comment anchor",
+		})
+		return
+	}
+	body, ok := commentBody(ctx)
+	if !ok {
+		return
+	}
+
+	thread := utils.CommentThread{
+		DocumentID: docId,
+		UserID:     currentUser,
+		Anchor:     string(mustJSON(anchor)),
+	}
+	comment := utils.Comment{
+		UserID: currentUser,
+		Body:   body,
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if thread.ID, err = utils.RandomString(10); err != nil {
+			return err
+		}
+		if err := tx.Create(&thread).Error; err != nil {
+			return err
+		}
+		if comment.ID, err = utils.RandomString(10); err != nil {
+			return err
+		}
+		comment.ThreadID = thread.ID
+		return tx.Create(&comment).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create comment thread", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating comment",
+		})
+		return
+	}
+
+	thread.Comments = []utils.Comment{comment}
+	h.rooms.PublishComment(docId, CommentEvent{Type: EventThreadCreated, ThreadID: thread.ID, Thread: &thread})
+	h.notifyMentions(document, thread.ID, currentUser, body)
+	h.hooks.Emit(HookCommented, document, currentUser, gin.H{
+		"thread_id":  thread.ID,
+		"comment_id": comment.ID,
+	})
+	ctx.JSON(http.StatusCreated, gin.H{
+		"thread": thread,
+	})
+}
+
+// ReplyToThread adds a comment to a thread.
+func (h *Handler) ReplyToThread(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	document, ok := h.authorizeComment(ctx, docId, currentUser)
+	if !ok {
+		return
+	}
+	thread, ok := h.loadThread(ctx, docId)
+	if !ok {
+		return
+	}
+	body, ok := commentBody(ctx)
+	if !ok {
+		return
+	}
+
+	comment := utils.Comment{
+		ThreadID: thread.ID,
+		UserID:   currentUser,
+		Body:     body,
+	}
+	var err error
+	if comment.ID, err = utils.RandomString(10); err == nil {
+		err = h.db.Create(&comment).Error
+	}
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create comment", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating comment",
+		})
+		return
+	}
+
+	h.rooms.PublishComment(docId, CommentEvent{Type: EventCommentAdded, ThreadID: thread.ID, Comment: &comment})
+	h.notifyMentions(document, thread.ID, currentUser, body)
+	h.hooks.Emit(HookCommented, document, currentUser, gin.H{
+		"thread_id":  thread.ID,
+		"comment_id": comment.ID,
+	})
+	ctx.JSON(http.StatusCreated, gin.H{
+		"comment": comment,
+	})
+}
+
+// ResolveThread marks a thread as resolved.
+func (h *Handler) ResolveThread(ctx *gin.Context) {
+	h.setResolved(ctx, true)
+}
+
+// ReopenThread clears a thread's resolved state.
+func (h *Handler) ReopenThread(ctx *gin.Context) {
+	h.setResolved(ctx, false)
+}
+
+func (h *Handler) setResolved(ctx *gin.Context, resolved bool) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	if _, ok := h.authorizeComment(ctx, docId, currentUser); !ok {
+		return
+	}
+	thread, ok := h.loadThread(ctx, docId)
+	if !ok {
+		return
+	}
+	event := EventThreadReopened
+	thread.ResolvedAt, thread.ResolvedBy = nil, nil
+	if resolved {
+		now := time.Now()
+		event = EventThreadResolved
+		thread.ResolvedAt, thread.ResolvedBy = &now, &currentUser
+	}
+	if err := h.db.Model(thread).Select("resolved_at", "resolved_by").Updates(thread).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to update comment thread", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error updating comment thread",
+		})
+		return
+	}
+
+	h.rooms.PublishComment(docId, CommentEvent{Type: event, ThreadID: thread.ID, Thread: thread})
+	ctx.JSON(http.StatusOK, gin.H{
+		"thread": thread,
+	})
+}
+
+// EditComment replaces the body of one of the caller's comments.
+func (h *Handler) EditComment(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	if _, ok := h.authorizeComment(ctx, docId, currentUser); !ok {
+		return
+	}
+	comment, ok := h.loadComment(ctx, docId)
+	if !ok {
+		return
+	}
+	if comment.UserID != currentUser {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "only the author can edit a comment",
+		})
+		return
+	}
+	body, ok := commentBody(ctx)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	comment.Body, comment.EditedAt = body, &now
+	if err := h.db.Model(comment).Select("body", "edited_at").Updates(comment).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to edit comment", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error updating comment",
+		})
+		return
+	}
+
+	h.rooms.PublishComment(docId, CommentEvent{Type: EventCommentEdited, ThreadID: comment.ThreadID, Comment: comment})
+	ctx.JSON(http.StatusOK, gin.H{
+		"comment": comment,
+	})
+}
+
+// DeleteComment removes a comment. Authors can delete their own comments and
+// the document owner can delete any. A thread goes away with its last
+// comment.
+func (h *Handler) DeleteComment(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	_, role, err := Authorize(h.db, docId, currentUser)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	comment, ok := h.loadComment(ctx, docId)
+	if !ok {
+		return
+	}
+	if comment.UserID != currentUser && role != RoleOwner {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "only the author or the document owner can delete a comment",
+		})
+		return
+	}
+
+	var threadDeleted bool
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(comment).Error; err != nil {
+			return err
+		}
+		var remaining int64
+		if err := tx.Model(utils.Comment{}).Where("thread_id = ?", comment.ThreadID).Count(&remaining).Error; err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return nil
+		}
+		threadDeleted = true
+		return tx.Where("id = ?", comment.ThreadID).Delete(&utils.CommentThread{}).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to delete comment", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error deleting comment",
+		})
+		return
+	}
+
+	if threadDeleted {
+		h.rooms.PublishComment(docId, CommentEvent{Type: EventThreadDeleted, ThreadID: comment.ThreadID})
+	} else {
+		h.rooms.PublishComment(docId, CommentEvent{Type: EventCommentDeleted, ThreadID: comment.ThreadID, CommentID: comment.ID})
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "comment deleted",
+	})
+}
+
+// authorizeComment checks the caller may comment on the document and writes
+// the error response when not.
+func (h *Handler) authorizeComment(ctx *gin.Context, docId string, userID string) (*utils.Document, bool) {
+	document, role, err := Authorize(h.db, docId, userID)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return nil, false
+	}
+	if !CanComment(role) {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "you cannot comment on this document",
+		})
+		return nil, false
+	}
+	return document, true
+}
+
+func (h *Handler) loadThread(ctx *gin.Context, docId string) (*utils.CommentThread, bool) {
+	var thread utils.CommentThread
+	err := h.db.Model(utils.CommentThread{}).
+		Where("id = ? AND document_id = ?", ctx.Param("thread_id"), docId).
+		First(&thread).Error
+	if err != nil {
+		respondCommentError(ctx, err, "comment thread not found")
+		return nil, false
+	}
+	return &thread, true
+}
+
+func (h *Handler) loadComment(ctx *gin.Context, docId string) (*utils.Comment, bool) {
+	var comment utils.Comment
+	err := h.db.Model(utils.Comment{}).
+		Joins("JOIN comment_threads ON comment_threads.id = comments.thread_id").
+		Where("comments.id = ? AND comments.thread_id = ? AND comment_threads.document_id = ?",
+			ctx.Param("comment_id"), ctx.Param("thread_id"), docId).
+		First(&comment).Error
+	if err != nil {
+		respondCommentError(ctx, err, "comment not found")
+		return nil, false
+	}
+	return &comment, true
+}
+
+func respondCommentError(ctx *gin.Context, err error, notFound string) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": notFound,
+		})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{
+		"message": "error retrieving comments",
+	})
+}
+
+func commentBody(ctx *gin.Context) (string, bool) {
+	body := strings.TrimSpace(ctx.PostForm("body"))
+	if body == "" || len(body) > maxCommentLength {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "comment must be between 1 and 10000 characters",
+		})
+		return "", false
+	}
+	return body, true
+}
+
+// deleteThreads removes every comment thread on the selected documents.
+func deleteThreads(tx *gorm.DB, documentIDs interface{}) error {
+	threads := tx.Model(utils.CommentThread{}).Select("id").Where("document_id IN (?)", documentIDs)
+	if err := tx.Where("thread_id IN (?)", threads).Delete(&utils.Comment{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("document_id IN (?)", documentIDs).Delete(&utils.CommentThread{}).Error
+}
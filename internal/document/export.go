@@ -0,0 +1,108 @@
+package document
+
+import (
+	"fmt"
+	"livescribble/internal/audit"
+	"livescribble/internal/crdt"
+	"livescribble/internal/markup"
+	"livescribble/internal/utils"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"md":   {"text/markdown; charset=utf-8", "md"},
+	"html": {"text/html; charset=utf-8", "html"},
+	"txt":  {"text/plain; charset=utf-8", "txt"},
+}
+
+var unsafeFilename = regexp.MustCompile(`[^\w\- ]+`)
+
+// ExportDocument renders the latest snapshot of a document the caller can
+// open as Markdown, HTML or plain text (format=md|html|txt, default md).
+func (h *Handler) ExportDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+	format := ctx.DefaultQuery("format", "md")
+
+	exportFormat, ok := exportFormats[format]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "format must be md, html or txt",
+		})
+		return
+	}
+	document, _, err := Authorize(h.db, docId, currentUser)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	err = h.db.Model(utils.Document{}).Where("id = ?", docId).Pluck("content", &document.Content).Error
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+
+	body, err := Render(document, format)
+	if err != nil {
+		h.logger.WarnContext(ctx.Request.Context(), "Failed to decode snapshot for export", "docId", docId, "error", err)
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{
+			"message": "document content could not be read",
+		})
+		return
+	}
+
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentExport, DocumentID: document.ID, Data: gin.H{"format": format}})
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, ExportFilename(document), exportFormat.extension))
+	ctx.Data(http.StatusOK, exportFormat.contentType, []byte(body))
+}
+
+// Render converts the document's stored snapshot to format: md, html or
+// txt. It fails on an unknown format or a snapshot that does not decode.
+func Render(document *utils.Document, format string) (string, error) {
+	if _, ok := exportFormats[format]; !ok {
+		return "", fmt.Errorf("unknown format %q, use md, html or txt", format)
+	}
+	var doc *crdt.Doc
+	if document.Content != "" {
+		var err error
+		if doc, err = crdt.DecodeSnapshot(document.Content); err != nil {
+			return "", err
+		}
+	}
+
+	switch format {
+	case "md":
+		if doc == nil {
+			return "", nil
+		}
+		return markup.Markdown(doc.Nodes()), nil
+	case "html":
+		var nodes []crdt.Node
+		if doc != nil {
+			nodes = doc.Nodes()
+		}
+		return markup.HTML(document.Title, nodes), nil
+	default:
+		if doc == nil {
+			return "", nil
+		}
+		return doc.PlainText() + "\n", nil
+	}
+}
+
+// ExportFilename is the document's title made safe for a file name, or its
+// ID when nothing is left, without an extension.
+func ExportFilename(document *utils.Document) string {
+	name := strings.TrimSpace(unsafeFilename.ReplaceAllString(document.Title, ""))
+	if name == "" {
+		return document.ID
+	}
+	return name
+}
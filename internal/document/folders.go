@@ -0,0 +1,441 @@
+package document
+
+import (
+	"encoding/json"
+	"errors"
+	"livescribble/internal/audit"
+	"livescribble/internal/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type ShareRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"` // editor, commenter or viewer, empty revokes
+}
+
+func (h *Handler) CreateFolder(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	name := strings.TrimSpace(ctx.PostForm("name"))
+	if name == "" || len(name) > 200 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid folder name",
+		})
+		return
+	}
+
+	folder := utils.Folder{
+		UserID: currentUser,
+		Name:   name,
+		Access: "[]",
+	}
+	if parentID := ctx.PostForm("parent_id"); parentID != "" {
+		if !h.ownsFolder(ctx, parentID, currentUser) {
+			return
+		}
+		folder.ParentID = &parentID
+	}
+
+	folderID, err := utils.RandomString(10)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating folder",
+		})
+		return
+	}
+	folder.ID = folderID
+	if err := h.db.Create(&folder).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create folder", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating folder",
+		})
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{
+		"folder": folder,
+	})
+}
+
+// ListFolders returns the caller's top level folders and the folders others
+// have shared with them.
+func (h *Handler) ListFolders(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var owned []utils.Folder
+	err := h.db.Model(utils.Folder{}).Where("user_id = ? AND parent_id IS NULL", currentUser).Order("name").Find(&owned).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list folders", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving folders",
+		})
+		return
+	}
+	var shared []utils.Folder
+	entry := string(mustJSON([]map[string]string{{"user_id": currentUser}}))
+	err = h.db.Model(utils.Folder{}).Where("access @> ?::jsonb AND user_id <> ?", entry, currentUser).Order("name").Find(&shared).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list shared folders", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving folders",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"folders": owned,
+		"shared":  shared,
+	})
+}
+
+// GetFolder lists a folder's subfolders and documents. Anyone with a role on
+// the folder, directly or from a parent, sees everything inside it.
+func (h *Handler) GetFolder(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	folderID := ctx.Param("folder_id")
+
+	folder, role, ok := h.authorizeFolder(ctx, folderID, currentUser)
+	if !ok {
+		return
+	}
+
+	var subfolders []utils.Folder
+	if err := h.db.Model(utils.Folder{}).Where("parent_id = ?", folderID).Order("name").Find(&subfolders).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list subfolders", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving folder",
+		})
+		return
+	}
+	var documents []utils.Document
+	err := h.db.Model(utils.Document{}).Select(summaryColumns).Where("folder_id = ? AND trashed_at IS NULL", folderID).Order("title").Find(&documents).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list folder documents", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving folder",
+		})
+		return
+	}
+	summaries, err := h.summarize(documents, currentUser)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to resolve document roles", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving folder",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"folder":    folder,
+		"role":      role,
+		"folders":   subfolders,
+		"documents": summaries,
+	})
+}
+
+// UpdateFolder renames a folder and/or moves it under another folder the
+// caller owns. An empty parent_id moves it to the top level.
+func (h *Handler) UpdateFolder(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	folderID := ctx.Param("folder_id")
+	if !h.ownsFolder(ctx, folderID, currentUser) {
+		return
+	}
+
+	updates := map[string]interface{}{"updated": time.Now()}
+	if name, ok := ctx.GetPostForm("name"); ok {
+		name = strings.TrimSpace(name)
+		if name == "" || len(name) > 200 {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid folder name",
+			})
+			return
+		}
+		updates["name"] = name
+	}
+	if parentID, ok := ctx.GetPostForm("parent_id"); ok {
+		if parentID == "" {
+			updates["parent_id"] = nil
+		} else {
+			if !h.ownsFolder(ctx, parentID, currentUser) {
+				return
+			}
+			inside, err := h.isWithin(parentID, folderID)
+			if err != nil {
+				h.logger.ErrorContext(ctx.Request.Context(), "Failed to check folder ancestry", "error", err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{
+					"message": "error updating folder",
+				})
+				return
+			}
+			if inside {
+				ctx.JSON(http.StatusBadRequest, gin.H{
+					"message": "cannot move a folder into itself",
+				})
+				return
+			}
+			updates["parent_id"] = parentID
+		}
+	}
+
+	if err := h.db.Model(utils.Folder{}).Where("id = ?", folderID).Updates(updates).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to update folder", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error updating folder",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "folder updated",
+	})
+}
+
+// DeleteFolder removes a folder. Its documents and subfolders move up to the
+// folder's parent rather than being deleted.
+func (h *Handler) DeleteFolder(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	folderID := ctx.Param("folder_id")
+	if !h.ownsFolder(ctx, folderID, currentUser) {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var folder utils.Folder
+		if err := tx.Model(utils.Folder{}).Where("id = ?", folderID).First(&folder).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(utils.Document{}).Where("folder_id = ?", folderID).Update("folder_id", folder.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(utils.Folder{}).Where("parent_id = ?", folderID).Update("parent_id", folder.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&folder).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to delete folder", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error deleting folder",
+		})
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionFolderDelete, TargetID: folderID})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "folder deleted",
+	})
+}
+
+// ShareFolder grants, changes or revokes a user's role on a folder. The role
+// applies to every document and folder inside it.
+func (h *Handler) ShareFolder(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	folderID := ctx.Param("folder_id")
+	if !h.ownsFolder(ctx, folderID, currentUser) {
+		return
+	}
+	target, role, ok := h.shareTarget(ctx, currentUser)
+	if !ok {
+		return
+	}
+
+	var folder utils.Folder
+	var previous string
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(utils.Folder{}).Where("id = ?", folderID).First(&folder).Error; err != nil {
+			return err
+		}
+		previous = accessRole(folder.Access, target.ID)
+		return tx.Model(&folder).Update("access", SetAccess(folder.Access, target.ID, role)).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to share folder", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error sharing folder",
+		})
+		return
+	}
+	if role != previous {
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionFolderShare, TargetID: target.ID, Data: gin.H{
+			"folder_id": folder.ID,
+			"role":      role,
+			"previous":  previous,
+		}})
+	}
+	if role != "" && role != previous {
+		h.notifyShare(target.ID, currentUser, role, nil, &folder.ID, folder.Name)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "folder sharing updated",
+	})
+}
+
+// ShareDocument grants, changes or revokes a user's role on one document.
+func (h *Handler) ShareDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	document, role, err := Authorize(h.db, docId, currentUser)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	if role != RoleOwner {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "only the owner can share this document",
+		})
+		return
+	}
+	target, newRole, ok := h.shareTarget(ctx, currentUser)
+	if !ok {
+		return
+	}
+
+	previous := accessRole(document.Access, target.ID)
+	err = h.db.Model(document).Update("access", SetAccess(document.Access, target.ID, newRole)).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to share document", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error sharing document",
+		})
+		return
+	}
+	if newRole != previous {
+		h.hooks.Emit(HookShared, document, currentUser, gin.H{
+			"user_id": target.ID,
+			"role":    newRole,
+		})
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentShare, DocumentID: document.ID, TargetID: target.ID, Data: gin.H{
+			"role":     newRole,
+			"previous": previous,
+		}})
+	}
+	if newRole != "" && newRole != previous {
+		h.notifyShare(target.ID, currentUser, newRole, &document.ID, nil, document.Title)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "document sharing updated",
+	})
+}
+
+// MoveDocument files a document the caller owns into one of their folders,
+// or back to the top level when folder_id is empty.
+func (h *Handler) MoveDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	document, role, err := Authorize(h.db, docId, currentUser)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	if document.UserID != currentUser || role != RoleOwner {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "only the owner can move this document",
+		})
+		return
+	}
+
+	var folderID *string
+	if id := ctx.PostForm("folder_id"); id != "" {
+		if !h.ownsFolder(ctx, id, currentUser) {
+			return
+		}
+		folderID = &id
+	}
+	if err := h.db.Model(document).Update("folder_id", folderID).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to move document", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error moving document",
+		})
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentMove, DocumentID: document.ID, Data: gin.H{"folder_id": folderID}})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "document moved",
+	})
+}
+
+// shareTarget parses a ShareRequest and resolves the user it names.
+func (h *Handler) shareTarget(ctx *gin.Context, currentUser string) (*utils.User, string, bool) {
+	var req ShareRequest
+	if err := json.Unmarshal([]byte(ctx.PostForm("request")), &req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "Missing Request",
+		})
+		return nil, "", false
+	}
+	if req.Role != "" && !ValidShareRole(req.Role) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid role",
+		})
+		return nil, "", false
+	}
+	var target utils.User
+	err := h.db.Model(utils.User{}).Where("email = ?", req.Email).First(&target).Error
+	if err != nil || target.ID == currentUser {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "user not found",
+		})
+		return nil, "", false
+	}
+	return &target, req.Role, true
+}
+
+// authorizeFolder loads a folder and the caller's role on it, answering 404
+// when they have none.
+func (h *Handler) authorizeFolder(ctx *gin.Context, folderID string, userID string) (*utils.Folder, string, bool) {
+	var folder utils.Folder
+	err := h.db.Model(utils.Folder{}).Where("id = ?", folderID).First(&folder).Error
+	if err != nil {
+		respondFolderError(ctx, err)
+		return nil, "", false
+	}
+	role, err := folderRole(h.db, folderID, userID)
+	if err != nil || role == "" {
+		respondFolderError(ctx, err)
+		return nil, "", false
+	}
+	return &folder, role, true
+}
+
+func (h *Handler) ownsFolder(ctx *gin.Context, folderID string, userID string) bool {
+	var count int64
+	err := h.db.Model(utils.Folder{}).Where("id = ? AND user_id = ?", folderID, userID).Count(&count).Error
+	if err != nil || count == 0 {
+		respondFolderError(ctx, err)
+		return false
+	}
+	return true
+}
+
+// isWithin reports whether folderID is ancestorID or one of its descendants.
+func (h *Handler) isWithin(folderID string, ancestorID string) (bool, error) {
+	for depth := 0; folderID != "" && depth < maxFolderDepth; depth++ {
+		if folderID == ancestorID {
+			return true, nil
+		}
+		var folder utils.Folder
+		if err := h.db.Model(utils.Folder{}).Where("id = ?", folderID).First(&folder).Error; err != nil {
+			return false, err
+		}
+		folderID = ""
+		if folder.ParentID != nil {
+			folderID = *folder.ParentID
+		}
+	}
+	return false, nil
+}
+
+func respondFolderError(ctx *gin.Context, err error) {
+	if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "folder not found",
+		})
+	} else {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving folder",
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package document
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"livescribble/internal/audit"
+	"livescribble/internal/utils"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type Handler struct {
+	db             *gorm.DB
+	logger         *slog.Logger
+	rooms          Rooms
+	notifier       Notifier
+	hooks          Webhooks
+	audit          Auditor
+	trashRetention time.Duration
+}
+
+func NewHandler(db *gorm.DB, logger *slog.Logger, rooms Rooms, notifier Notifier, hooks Webhooks, auditor Auditor, trashRetention time.Duration) *Handler {
+	return &Handler{
+		db:             db,
+		logger:         logger,
+		rooms:          rooms,
+		notifier:       notifier,
+		hooks:          hooks,
+		audit:          auditor,
+		trashRetention: trashRetention,
+	}
+}
+
+// Summary is a document without its content, as returned by listings.
+type Summary struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	UserID   string    `json:"user_id"`
+	FolderID *string   `json:"folder_id"`
+	Updated  time.Time `json:"updated"`
+	Created  time.Time `json:"created"`
+	Role     string    `json:"role"`
+}
+
+// summaryColumns is everything a Summary needs, leaving out the content blobs.
+const summaryColumns = "id, user_id, folder_id, title, updated, created, access"
+
+type listCursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+var sortColumns = map[string]string{
+	"updated": "updated",
+	"created": "created",
+	"title":   "title",
+}
+
+func (h *Handler) GetDocument(ctx *gin.Context) {
+	requestedDocId := ctx.Param("doc_id")
+	currentUser := ctx.GetString("current_user")
+
+	_, role, err := Authorize(h.db, requestedDocId, currentUser)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	var document utils.Document
+	err = h.db.Model(utils.Document{}).Omit("search_text").Where("id = ?", requestedDocId).First(&document).Error
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"document": document,
+		"role":     role,
+	})
+}
+
+// CreateDocument makes a new document owned by the caller. It starts empty,
+// or from the latest snapshot of template_id when given.
+func (h *Handler) CreateDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	document := utils.Document{
+		UserID: currentUser,
+		Title:  strings.TrimSpace(ctx.PostForm("title")),
+		Access: "[]",
+	}
+	if folderID := ctx.PostForm("folder_id"); folderID != "" {
+		if !h.ownsFolder(ctx, folderID, currentUser) {
+			return
+		}
+		document.FolderID = &folderID
+	}
+	if templateID := ctx.PostForm("template_id"); templateID != "" {
+		template, err := h.loadTemplate(templateID, currentUser)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				ctx.JSON(http.StatusNotFound, gin.H{
+					"message": "template not found",
+				})
+			} else {
+				ctx.JSON(http.StatusInternalServerError, gin.H{
+					"message": "error creating document",
+				})
+			}
+			return
+		}
+		document.Content = template.Content
+		document.SearchText = template.SearchText
+		if document.Title == "" {
+			document.Title = template.Title
+		}
+	}
+
+	if err := createDocument(h.db, &document); err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create document", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating document",
+		})
+		return
+	}
+	h.hooks.Emit(HookCreated, &document, currentUser, nil)
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentCreate, DocumentID: document.ID})
+	ctx.JSON(http.StatusCreated, gin.H{
+		"document": document,
+	})
+}
+
+// createDocument assigns a fresh ID and inserts the document.
+func createDocument(db *gorm.DB, document *utils.Document) error {
+	documentId, err := generateDocumentId()
+	if err != nil {
+		return err
+	}
+	document.ID = documentId
+	return db.Create(document).Error
+}
+
+// ListDocuments returns the documents the caller owns or has been shared,
+// newest first by default. Query parameters:
+//
+//	filter  all (default), owned or shared
+//	owner   only documents owned by this user ID
+//	sort    updated (default), created or title
+//	order   asc or desc
+//	limit   page size, up to 100
+//	cursor  the next_cursor of the previous page
+func (h *Handler) ListDocuments(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	sortColumn, ok := sortColumns[ctx.DefaultQuery("sort", "updated")]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid sort",
+		})
+		return
+	}
+	descending := sortColumn != "title"
+	switch ctx.Query("order") {
+	case "asc":
+		descending = false
+	case "desc":
+		descending = true
+	case "":
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid order",
+		})
+		return
+	}
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	query := h.db.Model(utils.Document{}).Where("trashed_at IS NULL")
+	switch ctx.DefaultQuery("filter", "all") {
+	case "owned":
+		query = query.Where("user_id = ?", currentUser)
+	case "shared":
+		query = query.Where(sharedWith(h.db, currentUser))
+	case "all":
+		query = query.Where(h.db.Where("user_id = ?", currentUser).Or(sharedWith(h.db, currentUser)))
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid filter",
+		})
+		return
+	}
+	if owner := ctx.Query("owner"); owner != "" {
+		query = query.Where("user_id = ?", owner)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to count documents", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving document",
+		})
+		return
+	}
+
+	if raw := ctx.Query("cursor"); raw != "" {
+		cursor, value, err := decodeCursor(raw, sortColumn)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid cursor",
+			})
+			return
+		}
+		op := ">"
+		if descending {
+			op = "<"
+		}
+		query = query.Where(
+			h.db.Where(sortColumn+" "+op+" ?", value).Or(h.db.Where(sortColumn+" = ? AND id "+op+" ?", value, cursor.ID)),
+		)
+	}
+	direction := " ASC"
+	if descending {
+		direction = " DESC"
+	}
+
+	var documents []utils.Document
+	err = query.Select(summaryColumns).
+		Order(sortColumn + direction).Order("id" + direction).Limit(limit + 1).Find(&documents).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list documents", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving document",
+		})
+		return
+	}
+
+	nextCursor := ""
+	if len(documents) > limit {
+		documents = documents[:limit]
+		nextCursor = encodeCursor(&documents[limit-1], sortColumn)
+	}
+	summaries, err := h.summarize(documents, currentUser)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to resolve document roles", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving document",
+		})
+		return
+	}
+
+	var owned, shared int64
+	if err := h.db.Model(utils.Document{}).Where("user_id = ? AND trashed_at IS NULL", currentUser).Count(&owned).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to count documents", "error", err)
+	}
+	if err := h.db.Model(utils.Document{}).Where("trashed_at IS NULL").Where(sharedWith(h.db, currentUser)).Count(&shared).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to count documents", "error", err)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"documents":   summaries,
+		"next_cursor": nextCursor,
+		"counts": gin.H{
+			"total":  total,
+			"owned":  owned,
+			"shared": shared,
+		},
+	})
+}
+
+func (h *Handler) summarize(documents []utils.Document, userID string) ([]Summary, error) {
+	summaries := make([]Summary, 0, len(documents))
+	for i := range documents {
+		role, err := EffectiveRole(h.db, &documents[i], userID)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, Summary{
+			ID:       documents[i].ID,
+			Title:    documents[i].Title,
+			UserID:   documents[i].UserID,
+			FolderID: documents[i].FolderID,
+			Updated:  documents[i].Updated,
+			Created:  documents[i].Created,
+			Role:     role,
+		})
+	}
+	return summaries, nil
+}
+
+func generateDocumentId() (string, error) {
+	return utils.RandomString(10)
+}
+
+func encodeCursor(document *utils.Document, sortColumn string) string {
+	cursor := listCursor{ID: document.ID}
+	switch sortColumn {
+	case "updated":
+		cursor.Value = document.Updated.Format(time.RFC3339Nano)
+	case "created":
+		cursor.Value = document.Created.Format(time.RFC3339Nano)
+	default:
+		cursor.Value = document.Title
+	}
+	return base64.RawURLEncoding.EncodeToString(mustJSON(cursor))
+}
+
+func decodeCursor(raw string, sortColumn string) (*listCursor, interface{}, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil {
+		return nil, nil, err
+	}
+	if sortColumn == "title" {
+		return &cursor, cursor.Value, nil
+	}
+	value, err := time.Parse(time.RFC3339Nano, cursor.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cursor, value, nil
+}
+
+// respondAccessError maps Authorize errors onto responses. Documents the
+// caller cannot see are reported as missing so IDs cannot be probed.
+func respondAccessError(ctx *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, ErrNoAccess) {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "document not found",
+		})
+	} else {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving document",
+		})
+	}
+}
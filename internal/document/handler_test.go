@@ -0,0 +1,63 @@
+package document
+
+import (
+	"encoding/base64"
+	"livescribble/internal/utils"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	created := time.Date(2023, 12, 31, 23, 59, 59, 0, time.FixedZone("CET", 3600))
+	doc := &utils.Document{ID: "doc1", Title: "Notes, draft \"2\"", Updated: updated, Created: created}
+
+	tests := []struct {
+		sortColumn string
+		want       interface{}
+	}{
+		{"updated", updated},
+		{"created", created},
+		{"title", doc.Title},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sortColumn, func(t *testing.T) {
+			cursor, value, err := decodeCursor(encodeCursor(doc, tt.sortColumn), tt.sortColumn)
+			if err != nil {
+				t.Fatalf("decodeCursor: %v", err)
+			}
+			if cursor.ID != doc.ID {
+				t.Errorf("cursor.ID = %q, want %q", cursor.ID, doc.ID)
+			}
+			if want, ok := tt.want.(time.Time); ok {
+				// the same instant, time.Parse may pick another location
+				if got, ok := value.(time.Time); !ok || !got.Equal(want) {
+					t.Errorf("value = %v, want %v", value, want)
+				}
+			} else if value != tt.want {
+				t.Errorf("value = %v, want %v", value, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	titleCursor := encodeCursor(&utils.Document{ID: "doc1", Title: "Notes"}, "title")
+	tests := []struct {
+		name       string
+		raw        string
+		sortColumn string
+	}{
+		{"not base64", "not a cursor!", "updated"},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("doc1")), "title"},
+		{"title cursor on a time sort", titleCursor, "updated"},
+		{"bad time", base64.RawURLEncoding.EncodeToString([]byte(`{"v":"yesterday","id":"doc1"}`)), "created"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeCursor(tt.raw, tt.sortColumn); err == nil {
+				t.Error("decodeCursor succeeded")
+			}
+		})
+	}
+}
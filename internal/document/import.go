@@ -0,0 +1,224 @@
+package document
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"livescribble/internal/audit"
+	"livescribble/internal/crdt"
+	"livescribble/internal/markup"
+	"livescribble/internal/utils"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxImportUpload = 20 << 20 // the whole request
+	maxImportFile   = 5 << 20  // one file, or one zip entry uncompressed
+	maxImportFiles  = 200      // entries in a zip
+)
+
+var importParsers = map[string]func(string) ([]crdt.Node, error){
+	".md":       parseMarkdown,
+	".markdown": parseMarkdown,
+	".html":     markup.ParseHTML,
+	".htm":      markup.ParseHTML,
+	".txt":      parseText,
+}
+
+func parseMarkdown(src string) ([]crdt.Node, error) {
+	return markup.ParseMarkdown(src), nil
+}
+
+func parseText(src string) ([]crdt.Node, error) {
+	return markup.ParseText(src), nil
+}
+
+// ImportDocuments creates documents from an uploaded Markdown, HTML or text
+// file, or from every such file in a zip. The optional folder_id must be a
+// folder the caller owns; title renames a single imported file.
+func (h *Handler) ImportDocuments(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxImportUpload)
+	header, err := ctx.FormFile("file")
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("missing file or upload larger than %d MB", maxImportUpload>>20),
+		})
+		return
+	}
+	var folderID *string
+	if id := ctx.PostForm("folder_id"); id != "" {
+		if !h.ownsFolder(ctx, id, currentUser) {
+			return
+		}
+		folderID = &id
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to open upload", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error importing documents",
+		})
+		return
+	}
+	defer file.Close()
+
+	var documents []utils.Document
+	var skipped []string
+	if strings.EqualFold(path.Ext(header.Filename), ".zip") {
+		archive, err := zip.NewReader(file, header.Size)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid zip file",
+			})
+			return
+		}
+		if len(archive.File) > maxImportFiles {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("zip holds more than %d files", maxImportFiles),
+			})
+			return
+		}
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(path.Base(entry.Name), ".") {
+				continue
+			}
+			document, err := importZipEntry(entry)
+			if err != nil {
+				skipped = append(skipped, entry.Name)
+				continue
+			}
+			documents = append(documents, *document)
+		}
+	} else {
+		data, err := io.ReadAll(io.LimitReader(file, maxImportFile+1))
+		if err != nil {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to read upload", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error importing documents",
+			})
+			return
+		}
+		document, err := importFile(header.Filename, data)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": err.Error(),
+			})
+			return
+		}
+		if title := strings.TrimSpace(ctx.PostForm("title")); title != "" {
+			document.Title = title
+		}
+		documents = append(documents, *document)
+	}
+	if len(documents) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "no markdown, html or text files to import",
+			"skipped": skipped,
+		})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		for i := range documents {
+			documents[i].UserID = currentUser
+			documents[i].FolderID = folderID
+			if err := createDocument(tx, &documents[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to import documents", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error importing documents",
+		})
+		return
+	}
+	for i := range documents {
+		h.hooks.Emit(HookCreated, &documents[i], currentUser, nil)
+		h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentCreate, DocumentID: documents[i].ID, Data: gin.H{"imported": true}})
+	}
+	summaries, err := h.summarize(documents, currentUser)
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to resolve document roles", "error", err)
+	}
+	ctx.JSON(http.StatusCreated, gin.H{
+		"documents": summaries,
+		"skipped":   skipped,
+	})
+}
+
+// ImportFile creates a document owned by userID from one Markdown, HTML or
+// text file. It is titled after the file name unless title is set.
+func ImportFile(db *gorm.DB, userID string, name string, data []byte, title string) (*utils.Document, error) {
+	document, err := importFile(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if title != "" {
+		document.Title = title
+	}
+	document.UserID = userID
+	if err := createDocument(db, document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func importZipEntry(entry *zip.File) (*utils.Document, error) {
+	if entry.UncompressedSize64 > maxImportFile {
+		return nil, fmt.Errorf("%s is larger than %d MB", entry.Name, maxImportFile>>20)
+	}
+	r, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxImportFile+1))
+	if err != nil {
+		return nil, err
+	}
+	return importFile(entry.Name, data)
+}
+
+// importFile converts one file into an unsaved document titled after the
+// file name.
+func importFile(name string, data []byte) (*utils.Document, error) {
+	if len(data) > maxImportFile {
+		return nil, fmt.Errorf("%s is larger than %d MB", path.Base(name), maxImportFile>>20)
+	}
+	ext := strings.ToLower(path.Ext(name))
+	parse, ok := importParsers[ext]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a markdown, html or text file", path.Base(name))
+	}
+	nodes, err := parse(strings.ToValidUTF8(string(data), "�"))
+	if err != nil {
+		return nil, fmt.Errorf("%s could not be parsed", path.Base(name))
+	}
+	update, err := crdt.Encode(nodes)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := crdt.Decode(update)
+	if err != nil {
+		return nil, err
+	}
+	return &utils.Document{
+		Title: strings.TrimSuffix(path.Base(name), path.Ext(name)),
+		// base64, like the snapshots clients save, so it survives the text column
+		Content:    base64.StdEncoding.EncodeToString(update),
+		SearchText: doc.PlainText(),
+		Access:     "[]",
+	}, nil
+}
@@ -0,0 +1,87 @@
+package document
+
+import (
+	"fmt"
+	"livescribble/internal/notification"
+	"livescribble/internal/utils"
+	"regexp"
+)
+
+// mentionPattern matches @ followed by an email address, e.g.
+// "@alice@example.com".
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w.@])@([\w.%+\-]+@[\w\-]+(?:\.[\w\-]+)+)`)
+
+const maxMentions = 20
+
+// notifyMentions notifies everyone @mentioned in a comment who can open the
+// document. Mentions of people without access are ignored rather than
+// leaking the document to them.
+func (h *Handler) notifyMentions(document *utils.Document, threadID string, actorID string, body string) {
+	emails := mentionedEmails(body)
+	if len(emails) == 0 {
+		return
+	}
+
+	var users []utils.User
+	if err := h.db.Model(utils.User{}).Where("email IN ?", emails).Find(&users).Error; err != nil {
+		h.logger.Error("Failed to resolve mentions", "error", err)
+		return
+	}
+	actor := h.actorName(actorID)
+	for _, user := range users {
+		if user.ID == actorID {
+			continue
+		}
+		role, err := EffectiveRole(h.db, document, user.ID)
+		if err != nil || role == "" {
+			continue
+		}
+		h.notifier.Notify(&utils.Notification{
+			UserID:     user.ID,
+			Type:       notification.TypeMention,
+			ActorID:    actorID,
+			DocumentID: &document.ID,
+			ThreadID:   &threadID,
+			Message:    fmt.Sprintf("%s mentioned you in a comment on %q", actor, document.Title),
+		})
+	}
+}
+
+// mentionedEmails is every address @mentioned in body, once each and at
+// most maxMentions of them.
+func mentionedEmails(body string) []string {
+	var emails []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		if !seen[m[1]] && len(emails) < maxMentions {
+			seen[m[1]] = true
+			emails = append(emails, m[1])
+		}
+	}
+	return emails
+}
+
+// notifyShare tells a user they were given a role on a document or folder.
+func (h *Handler) notifyShare(userID string, actorID string, role string, documentID *string, folderID *string, name string) {
+	kind := "document"
+	if folderID != nil {
+		kind = "folder"
+	}
+	h.notifier.Notify(&utils.Notification{
+		UserID:     userID,
+		Type:       notification.TypeShare,
+		ActorID:    actorID,
+		DocumentID: documentID,
+		FolderID:   folderID,
+		Message:    fmt.Sprintf("%s shared the %s %q with you as %s", h.actorName(actorID), kind, name, role),
+	})
+}
+
+// actorName is how a notification refers to the user who caused it.
+func (h *Handler) actorName(userID string) string {
+	var user utils.User
+	if err := h.db.Model(utils.User{}).Select("email").Where("id = ?", userID).First(&user).Error; err != nil {
+		return "Someone"
+	}
+	return user.Email
+}
@@ -0,0 +1,45 @@
+package document
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMentionedEmails(t *testing.T) {
+	var many []string
+	for i := 0; i < maxMentions+5; i++ {
+		many = append(many, fmt.Sprintf("@user%d@example.com", i))
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"start of body", "@alice@example.com have a look", []string{"alice@example.com"}},
+		{"inside a sentence", "thanks @bob.smith+docs@mail.example.co.uk!", []string{"bob.smith+docs@mail.example.co.uk"}},
+		{"after punctuation", "(@alice@example.com)", []string{"alice@example.com"}},
+		{"several", "@alice@example.com and @bob@example.org", []string{"alice@example.com", "bob@example.org"}},
+		{"repeated", "@alice@example.com @alice@example.com", []string{"alice@example.com"}},
+		{"plain address", "mail alice@example.com", nil},
+		{"@ inside a word", "foo@alice@example.com", nil},
+		{"no domain dot", "@alice@localhost", nil},
+		{"handle only", "@alice", nil},
+		{"capped", strings.Join(many, " "), func() []string {
+			var want []string
+			for i := 0; i < maxMentions; i++ {
+				want = append(want, fmt.Sprintf("user%d@example.com", i))
+			}
+			return want
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mentionedEmails(tt.body); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mentionedEmails(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
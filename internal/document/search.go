@@ -0,0 +1,75 @@
+package document
+
+import (
+	"livescribble/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const headlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxWords=35, MinWords=10, MaxFragments=2"
+
+type SearchResult struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	UserID  string    `json:"user_id"`
+	Updated time.Time `json:"updated"`
+	Rank    float64   `json:"rank"`
+	Snippet string    `json:"snippet"`
+	Role    string    `json:"role"`
+}
+
+// Search runs a full-text query (websearch syntax) over the titles and
+// snapshot text of documents the caller can open, best matches first.
+func (h *Handler) Search(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	q := strings.TrimSpace(ctx.Query("q"))
+	if q == "" || len(q) > 256 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid search query",
+		})
+		return
+	}
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	var rows []struct {
+		SearchResult
+		FolderID *string
+		Access   string
+	}
+	err = h.db.Table("documents").
+		Select(`id, title, user_id, folder_id, updated, access,
+			ts_rank(search_vector, websearch_to_tsquery('english', ?)) AS rank,
+			ts_headline('english', search_text, websearch_to_tsquery('english', ?), ?) AS snippet`, q, q, headlineOptions).
+		Where("search_vector @@ websearch_to_tsquery('english', ?) AND trashed_at IS NULL", q).
+		Where(h.db.Where("user_id = ?", currentUser).Or(sharedWith(h.db, currentUser))).
+		Order("rank DESC").
+		Limit(limit).
+		Scan(&rows).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to search documents", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error searching documents",
+		})
+		return
+	}
+
+	results := make([]SearchResult, 0, len(rows))
+	for _, row := range rows {
+		document := utils.Document{UserID: row.UserID, FolderID: row.FolderID, Access: row.Access}
+		if row.SearchResult.Role, err = EffectiveRole(h.db, &document, currentUser); err != nil {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to resolve document role", "error", err)
+		}
+		results = append(results, row.SearchResult)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"results": results,
+	})
+}
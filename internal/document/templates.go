@@ -0,0 +1,155 @@
+package document
+
+import (
+	"fmt"
+	"livescribble/internal/audit"
+	"livescribble/internal/utils"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TemplatePersonal = "personal" // offered only to the template's owner
+	TemplateGlobal   = "global"   // offered to everyone, set by admins
+)
+
+// DuplicateDocument copies the latest snapshot of a document the caller can
+// open into a new document they own.
+func (h *Handler) DuplicateDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	if _, _, err := Authorize(h.db, docId, currentUser); err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	var source utils.Document
+	err := h.db.Model(utils.Document{}).Where("id = ?", docId).First(&source).Error
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+
+	title := strings.TrimSpace(ctx.PostForm("title"))
+	if title == "" {
+		title = fmt.Sprintf("Copy of %s", source.Title)
+	}
+	duplicate := utils.Document{
+		UserID:     currentUser,
+		Title:      title,
+		Content:    source.Content,
+		SearchText: source.SearchText,
+		Access:     "[]",
+	}
+	if err := createDocument(h.db, &duplicate); err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to duplicate document", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error duplicating document",
+		})
+		return
+	}
+	h.hooks.Emit(HookCreated, &duplicate, currentUser, gin.H{
+		"source_id": source.ID,
+	})
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentCreate, DocumentID: duplicate.ID, Data: gin.H{"source_id": source.ID}})
+	ctx.JSON(http.StatusCreated, gin.H{
+		"document": duplicate,
+	})
+}
+
+// SetTemplate flags a document the caller owns as a personal or global
+// template, or clears the flag when scope is empty. Only admins publish
+// global templates.
+func (h *Handler) SetTemplate(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+	scope := ctx.PostForm("scope")
+
+	document, role, err := Authorize(h.db, docId, currentUser)
+	if err != nil {
+		respondAccessError(ctx, err)
+		return
+	}
+	if role != RoleOwner || document.UserID != currentUser {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"message": "only the owner can make this document a template",
+		})
+		return
+	}
+	switch scope {
+	case "", TemplatePersonal:
+	case TemplateGlobal:
+		var user utils.User
+		if err := h.db.Model(utils.User{}).Where("id = ?", currentUser).First(&user).Error; err != nil || !user.Admin {
+			ctx.JSON(http.StatusForbidden, gin.H{
+				"message": "only admins can publish global templates",
+			})
+			return
+		}
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid template scope",
+		})
+		return
+	}
+
+	if err := h.db.Model(document).Update("template", scope).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to update template flag", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error updating document",
+		})
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentTemplate, DocumentID: document.ID, Data: gin.H{"scope": scope}})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "template updated",
+	})
+}
+
+// ListTemplates is the template gallery: the caller's personal templates and
+// every global one.
+func (h *Handler) ListTemplates(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var documents []utils.Document
+	err := h.db.Model(utils.Document{}).Select(summaryColumns + ", template").
+		Where("trashed_at IS NULL").
+		Where(h.db.Where("template = ?", TemplateGlobal).Or("template = ? AND user_id = ?", TemplatePersonal, currentUser)).
+		Order("title").Find(&documents).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list templates", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving templates",
+		})
+		return
+	}
+
+	templates := make([]gin.H, 0, len(documents))
+	for _, document := range documents {
+		templates = append(templates, gin.H{
+			"id":      document.ID,
+			"title":   document.Title,
+			"user_id": document.UserID,
+			"scope":   document.Template,
+			"updated": document.Updated,
+		})
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"templates": templates,
+	})
+}
+
+// loadTemplate returns a template the user may start a document from.
+func (h *Handler) loadTemplate(templateID string, userID string) (*utils.Document, error) {
+	var template utils.Document
+	err := h.db.Model(utils.Document{}).
+		Where("id = ? AND trashed_at IS NULL", templateID).
+		Where(h.db.Where("template = ?", TemplateGlobal).Or("template = ? AND user_id = ?", TemplatePersonal, userID)).
+		First(&template).Error
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
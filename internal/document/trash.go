@@ -0,0 +1,236 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"livescribble/internal/audit"
+	"livescribble/internal/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Rooms is what the handlers need from the live editing rooms. It is
+// satisfied by room.RoomManager.
+type Rooms interface {
+	// CloseRoom disconnects everyone editing a document.
+	CloseRoom(docId string, reason string)
+	// PublishComment pushes a comment change to everyone in a document.
+	PublishComment(docId string, event interface{})
+}
+
+// Notifier delivers in-app notifications. It is satisfied by
+// notification.Handler.
+type Notifier interface {
+	Notify(n *utils.Notification)
+}
+
+// Webhook events. HookUpdated is raised by the rooms when a changed
+// snapshot is saved, the rest by the handlers.
+const (
+	HookCreated   = "document.created"
+	HookUpdated   = "document.updated"
+	HookShared    = "document.shared"
+	HookDeleted   = "document.deleted"
+	HookCommented = "document.commented"
+)
+
+// HookEvents lists every webhook event.
+var HookEvents = []string{HookCreated, HookUpdated, HookShared, HookDeleted, HookCommented}
+
+// Webhooks sends document events to subscribed URLs. It is satisfied by
+// webhook.Handler.
+type Webhooks interface {
+	Emit(event string, document *utils.Document, actorID string, data interface{})
+}
+
+// Auditor appends to the audit log. It is satisfied by audit.Log.
+type Auditor interface {
+	Record(ctx *gin.Context, event audit.Event)
+	RecordSystem(ctx context.Context, event audit.Event)
+}
+
+// TrashDocument moves a document the caller owns into their trash and closes
+// any live editing session on it.
+func (h *Handler) TrashDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.PostForm("document_id")
+
+	var document utils.Document
+	err := h.db.Model(utils.Document{}).Select(summaryColumns).
+		Where("id = ? AND user_id = ? AND trashed_at IS NULL", docId, currentUser).
+		First(&document).Error
+	if err == nil {
+		err = h.db.Model(&document).Update("trashed_at", time.Now()).Error
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"message": "document not found",
+			})
+		} else {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to trash document", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error deleting document",
+			})
+		}
+		return
+	}
+
+	h.rooms.CloseRoom(docId, "document deleted")
+	h.hooks.Emit(HookDeleted, &document, currentUser, nil)
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentTrash, DocumentID: document.ID})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "document moved to trash",
+	})
+}
+
+func (h *Handler) ListTrash(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var documents []utils.Document
+	err := h.db.Model(utils.Document{}).Select(summaryColumns+", trashed_at").
+		Where("user_id = ? AND trashed_at IS NOT NULL", currentUser).
+		Order("trashed_at DESC").Find(&documents).Error
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list trash", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving trash",
+		})
+		return
+	}
+
+	trashed := make([]gin.H, 0, len(documents))
+	for _, document := range documents {
+		trashed = append(trashed, gin.H{
+			"id":         document.ID,
+			"title":      document.Title,
+			"folder_id":  document.FolderID,
+			"updated":    document.Updated,
+			"trashed_at": document.TrashedAt,
+			"purge_at":   document.TrashedAt.Add(h.trashRetention),
+		})
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"documents": trashed,
+	})
+}
+
+// RestoreDocument takes a document back out of the trash. If its folder was
+// deleted meanwhile it is restored to the top level.
+func (h *Handler) RestoreDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var document utils.Document
+		err := tx.Model(utils.Document{}).Select(summaryColumns).
+			Where("id = ? AND user_id = ? AND trashed_at IS NOT NULL", docId, currentUser).
+			First(&document).Error
+		if err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"trashed_at": nil}
+		if document.FolderID != nil {
+			var count int64
+			if err := tx.Model(utils.Folder{}).Where("id = ?", *document.FolderID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				updates["folder_id"] = nil
+			}
+		}
+		return tx.Model(&document).Updates(updates).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"message": "document not found in trash",
+			})
+		} else {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to restore document", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error restoring document",
+			})
+		}
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentRestore, DocumentID: docId})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "document restored",
+	})
+}
+
+// PurgeDocument permanently deletes a trashed document.
+func (h *Handler) PurgeDocument(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	docId := ctx.Param("doc_id")
+
+	var deleted int64
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ? AND trashed_at IS NOT NULL", docId, currentUser).Delete(&utils.Document{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return deleteThreads(tx, []string{docId})
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to purge document", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error deleting document",
+		})
+		return
+	}
+	if deleted == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "document not found in trash",
+		})
+		return
+	}
+	h.audit.Record(ctx, audit.Event{Action: audit.ActionDocumentPurge, DocumentID: docId})
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "document deleted permanently",
+	})
+}
+
+// StartTrashPurge deletes documents that have been in the trash longer than
+// the retention period, checking once an hour. It blocks, run it in a goroutine.
+func (h *Handler) StartTrashPurge() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		var expired []utils.Document
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(utils.Document{}).Select("id, user_id").
+				Where("trashed_at < ?", time.Now().Add(-h.trashRetention)).Find(&expired).Error
+			if err != nil || len(expired) == 0 {
+				return err
+			}
+			ids := make([]string, 0, len(expired))
+			for _, document := range expired {
+				ids = append(ids, document.ID)
+			}
+			if err := deleteThreads(tx, ids); err != nil {
+				return err
+			}
+			return tx.Where("id IN ?", ids).Delete(&utils.Document{}).Error
+		})
+		if err != nil {
+			h.logger.Error("Failed to purge trash", "error", err)
+		} else if len(expired) > 0 {
+			for _, document := range expired {
+				h.audit.RecordSystem(context.Background(), audit.Event{
+					Action:     audit.ActionTrashAutoPurge,
+					DocumentID: document.ID,
+					Data:       gin.H{"owner_id": document.UserID},
+				})
+			}
+			h.logger.Info("Purged trashed documents", "count", len(expired))
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,108 @@
+// Package health serves the liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Check pings one dependency and returns nil when it is usable.
+type Check func(ctx context.Context) error
+
+type Checker struct {
+	timeout      time.Duration
+	logger       *slog.Logger
+	names        []string
+	checks       map[string]Check
+	shuttingDown atomic.Bool
+}
+
+// NewChecker creates a checker that gives each dependency timeout to answer.
+// Failures are logged, the probe itself only reports status and latency.
+func NewChecker(timeout time.Duration, logger *slog.Logger) *Checker {
+	return &Checker{
+		timeout: timeout,
+		logger:  logger,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add registers a dependency that must be up for the node to be ready.
+func (c *Checker) Add(name string, check Check) {
+	c.names = append(c.names, name)
+	c.checks[name] = check
+}
+
+// StartShutdown makes readiness fail from now on, so load balancers stop
+// sending new traffic while the node drains.
+func (c *Checker) StartShutdown() {
+	c.shuttingDown.Store(true)
+}
+
+type status struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// Live reports that the process is up and serving HTTP. It checks no
+// dependencies, an outage there should not get the node restarted.
+func (c *Checker) Live(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// Ready pings every dependency concurrently and answers 503 when one of
+// them fails or the node is shutting down.
+func (c *Checker) Ready(ctx *gin.Context) {
+	results := make(map[string]status, len(c.names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range c.names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx.Request.Context(), c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			result := status{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				// the probe is public, driver errors can name hosts and users
+				result.Status = "error"
+				c.logger.WarnContext(ctx.Request.Context(), "Readiness check failed", "dependency", name, "error", err.Error())
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, c.checks[name])
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	overall := "ok"
+	for _, result := range results {
+		if result.Status != "ok" {
+			code = http.StatusServiceUnavailable
+			overall = "error"
+		}
+	}
+	if c.shuttingDown.Load() {
+		code = http.StatusServiceUnavailable
+		overall = "shutting_down"
+	}
+	ctx.JSON(code, gin.H{
+		"status": overall,
+		"checks": results,
+	})
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"livescribble/internal/utils"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// a request ID from the client is kept only if it is short and harmless
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware gives every request an ID, taken from X-Request-ID when
+// a proxy set one. It is echoed in the response header, stored as
+// "request_id" on the Gin context and on the request context for
+// WithRequestID-aware loggers.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			id, err = utils.RandomString(16)
+			if err != nil {
+				id = "unknown"
+			}
+		}
+		ctx.Set("request_id", id)
+		ctx.Header(RequestIDHeader, id)
+		ctx.Request = ctx.Request.WithContext(WithRequestID(ctx.Request.Context(), id))
+		ctx.Next()
+	}
+}
+
+// AccessLog replaces Gin's logger with one record per request. Server errors
+// are logged at Error, client errors at Warn and the rest at Info.
+func AccessLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		path := ctx.Request.URL.Path
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", ctx.Request.Method),
+			slog.String("path", path),
+			slog.String("route", ctx.FullPath()),
+			slog.Int("status", status),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+			slog.String("clientIp", ctx.ClientIP()),
+			slog.Int("size", ctx.Writer.Size()),
+		}
+		if user := ctx.GetString("current_user"); user != "" {
+			attrs = append(attrs, slog.String("userId", user))
+		}
+		if errs := ctx.Errors.String(); errs != "" {
+			attrs = append(attrs, slog.String("error", errs))
+		}
+		logger.LogAttrs(ctx.Request.Context(), level, "HTTP request", attrs...)
+	}
+}
+
+// Recovery answers 500 to a panicking handler and logs the panic with its
+// request ID instead of Gin printing it to stderr.
+func Recovery(logger *slog.Logger) gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(ctx *gin.Context, err any) {
+		logger.ErrorContext(ctx.Request.Context(), "Recovered from panic", "error", err, "path", ctx.Request.URL.Path, "stack", string(debug.Stack()))
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
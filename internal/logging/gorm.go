@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// GormLogger sends GORM's output to logger. Failed queries are logged at
+// Error, queries slower than slowThreshold at Warn and, only when the slog
+// level allows Debug, every statement at Debug. A missing record is not an
+// error here, callers handle gorm.ErrRecordNotFound themselves.
+func GormLogger(logger *slog.Logger, slowThreshold time.Duration) gormlogger.Interface {
+	return &gormLogger{logger: logger, slowThreshold: slowThreshold, level: gormlogger.Info}
+}
+
+type gormLogger struct {
+	logger        *slog.Logger
+	slowThreshold time.Duration
+	level         gormlogger.LogLevel
+}
+
+func (l *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	copied := *l
+	copied.level = level
+	return &copied
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		l.logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		l.logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		l.logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		sql, rows := fc()
+		l.logger.ErrorContext(ctx, "SQL query failed", "error", err, "sql", sql, "rows", rows, "elapsed", elapsed)
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		l.logger.WarnContext(ctx, "Slow SQL query", "sql", sql, "rows", rows, "elapsed", elapsed, "threshold", l.slowThreshold)
+	case l.level >= gormlogger.Info && l.logger.Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		l.logger.DebugContext(ctx, "SQL query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	}
+}
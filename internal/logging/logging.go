@@ -0,0 +1,115 @@
+// Package logging builds the process-wide slog logger and routes Gin and
+// GORM output through it, so every line shares one format and destination.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a logger writing level and above in format ("json" or "text")
+// to stdout, file (appended to) or both. The closer releases the file.
+func New(level string, format string, file string, stdout bool) (*slog.Logger, io.Closer, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, fmt.Errorf("log level %q: %w", level, err)
+	}
+
+	var writers []io.Writer
+	var closer io.Closer = nopCloser{}
+	if stdout {
+		writers = append(writers, os.Stdout)
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening log file: %w", err)
+		}
+		writers = append(writers, f)
+		closer = f
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+	out := io.MultiWriter(writers...)
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	default:
+		closer.Close()
+		return nil, nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+type requestIDKey struct{}
+
+// WithRequestID stores the request ID for loggers called with ctx.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID is the ID stored by WithRequestID, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request and trace IDs of the context to records
+// logged with the *Context methods, e.g. logger.ErrorContext(ctx, ...).
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("requestId", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("traceId", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Writer turns each line written to it into a record at level, for libraries
+// that only log to an io.Writer. prefix is trimmed from every line.
+func Writer(logger *slog.Logger, level slog.Level, prefix string) io.Writer {
+	return &lineWriter{logger: logger, level: level, prefix: prefix}
+}
+
+type lineWriter struct {
+	logger *slog.Logger
+	level  slog.Level
+	prefix string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		msg := strings.TrimSpace(strings.TrimPrefix(string(line), w.prefix))
+		if msg != "" {
+			w.logger.Log(context.Background(), w.level, msg)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,117 @@
+package markup
+
+import (
+	"html"
+	"strings"
+
+	"livescribble/internal/crdt"
+)
+
+var blockTags = map[string]string{
+	kindParagraph:  "p",
+	kindBlockquote: "blockquote",
+	kindBulletList: "ul",
+	kindOrderList:  "ol",
+	kindTaskList:   "ul",
+	kindListItem:   "li",
+	kindTaskItem:   "li",
+	kindTable:      "table",
+	kindTableRow:   "tr",
+	kindTableCell:  "td",
+	kindTableHead:  "th",
+}
+
+var markTags = map[string]string{
+	"bold":      "strong",
+	"italic":    "em",
+	"strike":    "s",
+	"underline": "u",
+	"code":      "code",
+}
+
+// HTML renders the document as a standalone HTML page.
+func HTML(title string, nodes []crdt.Node) string {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	sb.WriteString("<title>" + html.EscapeString(title) + "</title>\n</head>\n<body>\n")
+	for _, n := range topLevel(nodes) {
+		writeHTML(&sb, &n)
+		sb.WriteByte('\n')
+	}
+	sb.WriteString("</body>\n</html>\n")
+	return sb.String()
+}
+
+func writeHTML(sb *strings.Builder, n *crdt.Node) {
+	switch k := kind(n); {
+	case n.IsText():
+		writeHTMLText(sb, n)
+	case k == kindHeading:
+		tag := string(rune('0' + headingLevel(n)))
+		sb.WriteString("<h" + tag + ">")
+		writeHTMLChildren(sb, n)
+		sb.WriteString("</h" + tag + ">")
+	case k == kindCodeBlock:
+		sb.WriteString("<pre><code")
+		if language := attr(n, "language"); language != "" {
+			sb.WriteString(` class="language-` + html.EscapeString(language) + `"`)
+		}
+		sb.WriteString(">" + html.EscapeString(textContent(n.Children)) + "</code></pre>")
+	case k == kindRule:
+		sb.WriteString("<hr>")
+	case k == kindHardBreak:
+		sb.WriteString("<br>")
+	case k == kindImage:
+		sb.WriteString(`<img src="` + html.EscapeString(safeURL(attr(n, "src"))) + `" alt="` + html.EscapeString(attr(n, "alt")) + `"`)
+		if title := attr(n, "title"); title != "" {
+			sb.WriteString(` title="` + html.EscapeString(title) + `"`)
+		}
+		sb.WriteString(">")
+	case k == kindOrderList && attr(n, "start") != "" && attr(n, "start") != "1":
+		sb.WriteString(`<ol start="` + html.EscapeString(attr(n, "start")) + `">`)
+		writeHTMLChildren(sb, n)
+		sb.WriteString("</ol>")
+	case k == kindTaskItem:
+		sb.WriteString(`<li><input type="checkbox" disabled`)
+		if checked(n) {
+			sb.WriteString(" checked")
+		}
+		sb.WriteString("> ")
+		writeHTMLChildren(sb, n)
+		sb.WriteString("</li>")
+	case blockTags[k] != "":
+		sb.WriteString("<" + blockTags[k] + ">")
+		writeHTMLChildren(sb, n)
+		sb.WriteString("</" + blockTags[k] + ">")
+	default:
+		writeHTMLChildren(sb, n)
+	}
+}
+
+func writeHTMLChildren(sb *strings.Builder, n *crdt.Node) {
+	for i := range n.Children {
+		writeHTML(sb, &n.Children[i])
+	}
+}
+
+func writeHTMLText(sb *strings.Builder, n *crdt.Node) {
+	m := marks(n)
+	var closing []string
+	for _, mark := range markOrder {
+		v, ok := m[mark]
+		if !ok {
+			continue
+		}
+		if mark == "link" {
+			sb.WriteString(`<a href="` + html.EscapeString(safeURL(markAttr(v, "href"))) + `">`)
+			closing = append(closing, "</a>")
+		} else {
+			sb.WriteString("<" + markTags[mark] + ">")
+			closing = append(closing, "</"+markTags[mark]+">")
+		}
+	}
+	sb.WriteString(strings.ReplaceAll(html.EscapeString(n.Text), "\n", "<br>"))
+	for i := len(closing) - 1; i >= 0; i-- {
+		sb.WriteString(closing[i])
+	}
+}
@@ -0,0 +1,187 @@
+package markup
+
+import (
+	"fmt"
+	"strings"
+
+	"livescribble/internal/crdt"
+)
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`,
+)
+
+// Markdown renders the document as CommonMark, with GFM tables, task lists
+// and strikethrough.
+func Markdown(nodes []crdt.Node) string {
+	var sb strings.Builder
+	writeMarkdownBlocks(&sb, topLevel(nodes), "")
+	return strings.TrimSpace(sb.String()) + "\n"
+}
+
+// writeMarkdownBlocks writes blocks separated by blank lines. prefix is
+// written before every line, it carries blockquote and list indentation.
+func writeMarkdownBlocks(sb *strings.Builder, blocks []crdt.Node, prefix string) {
+	for i := range blocks {
+		if i > 0 {
+			sb.WriteString(strings.TrimRight(prefix, " ") + "\n")
+		}
+		writeMarkdownBlock(sb, &blocks[i], prefix)
+	}
+}
+
+func writeMarkdownBlock(sb *strings.Builder, n *crdt.Node, prefix string) {
+	switch kind(n) {
+	case kindParagraph:
+		writeMarkdownLines(sb, prefix, markdownInline(n.Children))
+	case kindHeading:
+		writeMarkdownLines(sb, prefix, strings.Repeat("#", headingLevel(n))+" "+markdownInline(n.Children))
+	case kindBlockquote:
+		writeMarkdownBlocks(sb, n.Children, prefix+"> ")
+	case kindBulletList, kindOrderList, kindTaskList:
+		writeMarkdownList(sb, n, prefix)
+	case kindCodeBlock:
+		fence := "```"
+		code := textContent(n.Children)
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		writeMarkdownLines(sb, prefix, fence+attr(n, "language")+"\n"+code+"\n"+fence)
+	case kindRule:
+		writeMarkdownLines(sb, prefix, "---")
+	case kindImage:
+		writeMarkdownLines(sb, prefix, markdownImage(n))
+	case kindTable:
+		writeMarkdownTable(sb, n, prefix)
+	default:
+		if n.IsText() {
+			writeMarkdownLines(sb, prefix, markdownInline([]crdt.Node{*n}))
+		} else {
+			writeMarkdownBlocks(sb, n.Children, prefix)
+		}
+	}
+}
+
+func writeMarkdownLines(sb *strings.Builder, prefix string, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		sb.WriteString(prefix + line + "\n")
+	}
+}
+
+func writeMarkdownList(sb *strings.Builder, list *crdt.Node, prefix string) {
+	number := 1
+	if start := attr(list, "start"); start != "" {
+		fmt.Sscanf(start, "%d", &number)
+	}
+	for i := range list.Children {
+		item := &list.Children[i]
+		var marker string
+		switch {
+		case kind(list) == kindOrderList:
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		case kind(item) == kindTaskItem && checked(item):
+			marker = "- [x] "
+		case kind(item) == kindTaskItem:
+			marker = "- [ ] "
+		default:
+			marker = "- "
+		}
+		var body strings.Builder
+		writeMarkdownBlocks(&body, item.Children, "")
+		indent := strings.Repeat(" ", len(marker))
+		for j, line := range strings.Split(strings.TrimRight(body.String(), "\n"), "\n") {
+			switch {
+			case j == 0:
+				sb.WriteString(prefix + marker + line + "\n")
+			case line == "":
+				sb.WriteString(strings.TrimRight(prefix, " ") + "\n")
+			default:
+				sb.WriteString(prefix + indent + line + "\n")
+			}
+		}
+	}
+}
+
+func writeMarkdownTable(sb *strings.Builder, table *crdt.Node, prefix string) {
+	for i, row := range table.Children {
+		cells := make([]string, 0, len(row.Children))
+		for _, cell := range row.Children {
+			text := strings.TrimSpace(Markdown(cell.Children))
+			text = strings.ReplaceAll(text, "\n\n", "<br>")
+			text = strings.ReplaceAll(text, "\n", " ")
+			cells = append(cells, strings.ReplaceAll(text, "|", `\|`))
+		}
+		sb.WriteString(prefix + "| " + strings.Join(cells, " | ") + " |\n")
+		if i == 0 {
+			sb.WriteString(prefix + strings.Repeat("| --- ", len(cells)) + "|\n")
+		}
+	}
+}
+
+func markdownImage(n *crdt.Node) string {
+	image := "![" + markdownEscaper.Replace(attr(n, "alt")) + "](" + safeURL(attr(n, "src"))
+	if title := attr(n, "title"); title != "" {
+		image += fmt.Sprintf(" %q", title)
+	}
+	return image + ")"
+}
+
+func markdownInline(nodes []crdt.Node) string {
+	var sb strings.Builder
+	for i := range nodes {
+		n := &nodes[i]
+		switch {
+		case kind(n) == kindHardBreak:
+			sb.WriteString("\\\n")
+		case kind(n) == kindImage:
+			sb.WriteString(markdownImage(n))
+		case n.IsText():
+			sb.WriteString(markdownText(n))
+		default:
+			sb.WriteString(markdownInline(n.Children))
+		}
+	}
+	return sb.String()
+}
+
+func markdownText(n *crdt.Node) string {
+	m := marks(n)
+	if _, ok := m["code"]; ok {
+		fence := "`"
+		for strings.Contains(n.Text, fence) {
+			fence += "`"
+		}
+		text := fence + n.Text + fence
+		if href, ok := m["link"]; ok {
+			text = "[" + text + "](" + safeURL(markAttr(href, "href")) + ")"
+		}
+		return text
+	}
+
+	// emphasis cannot start or end with whitespace, keep it outside
+	text := markdownEscaper.Replace(n.Text)
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	for i := len(markOrder) - 1; i >= 0; i-- {
+		v, ok := m[markOrder[i]]
+		if !ok {
+			continue
+		}
+		switch markOrder[i] {
+		case "bold":
+			trimmed = "**" + trimmed + "**"
+		case "italic":
+			trimmed = "*" + trimmed + "*"
+		case "strike":
+			trimmed = "~~" + trimmed + "~~"
+		case "link":
+			trimmed = "[" + trimmed + "](" + safeURL(markAttr(v, "href")) + ")"
+		}
+	}
+	return lead + trimmed + trail
+}
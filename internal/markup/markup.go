@@ -0,0 +1,229 @@
+// Package markup converts between the document tree of a snapshot and the
+// formats users export to and import from: Markdown, HTML and plain text.
+//
+// Node names follow the ProseMirror schemas our clients use. TipTap names
+// nodes in camelCase (bulletList) and prosemirror-schema-basic in snake_case
+// (bullet_list), both are accepted.
+package markup
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"livescribble/internal/crdt"
+)
+
+// Block and inline node kinds, after normalizing the node name.
+const (
+	kindParagraph  = "paragraph"
+	kindHeading    = "heading"
+	kindBlockquote = "blockquote"
+	kindBulletList = "bulletlist"
+	kindOrderList  = "orderedlist"
+	kindTaskList   = "tasklist"
+	kindListItem   = "listitem"
+	kindTaskItem   = "taskitem"
+	kindCodeBlock  = "codeblock"
+	kindRule       = "horizontalrule"
+	kindHardBreak  = "hardbreak"
+	kindImage      = "image"
+	kindTable      = "table"
+	kindTableRow   = "tablerow"
+	kindTableCell  = "tablecell"
+	kindTableHead  = "tableheader"
+)
+
+var blankLine = regexp.MustCompile(`\n[ \t]*\n`)
+
+// nodeNames maps a kind to the node name imports produce. We write TipTap's
+// schema, which is what the web client edits.
+var nodeNames = map[string]string{
+	kindParagraph:  "paragraph",
+	kindHeading:    "heading",
+	kindBlockquote: "blockquote",
+	kindBulletList: "bulletList",
+	kindOrderList:  "orderedList",
+	kindTaskList:   "taskList",
+	kindListItem:   "listItem",
+	kindTaskItem:   "taskItem",
+	kindCodeBlock:  "codeBlock",
+	kindRule:       "horizontalRule",
+	kindHardBreak:  "hardBreak",
+	kindImage:      "image",
+	kindTable:      "table",
+	kindTableRow:   "tableRow",
+	kindTableCell:  "tableCell",
+	kindTableHead:  "tableHeader",
+}
+
+// Marks in the order they are opened, outermost first.
+var markOrder = []string{"link", "bold", "italic", "strike", "underline", "code"}
+
+var markAliases = map[string]string{
+	"strong":        "bold",
+	"em":            "italic",
+	"strikethrough": "strike",
+}
+
+func kind(n *crdt.Node) string {
+	return strings.ToLower(strings.ReplaceAll(n.Name, "_", ""))
+}
+
+// marks returns the node's marks under their canonical names.
+func marks(n *crdt.Node) map[string]interface{} {
+	m := make(map[string]interface{}, len(n.Marks))
+	for name, v := range n.Marks {
+		if alias, ok := markAliases[name]; ok {
+			name = alias
+		}
+		m[name] = v
+	}
+	return m
+}
+
+// attr returns an attribute as a string, "" when it is missing.
+func attr(n *crdt.Node, key string) string {
+	v, ok := n.Attrs[key]
+	if !ok || v == nil {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%g", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// markAttr reads an attribute of a mark value, such as a link's href.
+func markAttr(v interface{}, key string) string {
+	if obj, ok := v.(map[string]interface{}); ok {
+		if s, ok := obj[key].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// safeURL drops links with schemes that could run script when the export is
+// opened in a browser.
+func safeURL(raw string) string {
+	scheme, _, found := strings.Cut(strings.ToLower(strings.TrimSpace(raw)), ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return raw
+	}
+	switch scheme {
+	case "http", "https", "mailto":
+		return raw
+	}
+	return ""
+}
+
+func headingLevel(n *crdt.Node) int {
+	level := 1
+	fmt.Sscanf(attr(n, "level"), "%d", &level)
+	return min(max(level, 1), 6)
+}
+
+func checked(n *crdt.Node) bool {
+	return attr(n, "checked") == "true"
+}
+
+// textContent concatenates every text run below the node.
+func textContent(nodes []crdt.Node) string {
+	var sb strings.Builder
+	for i := range nodes {
+		if nodes[i].IsText() {
+			sb.WriteString(nodes[i].Text)
+		} else {
+			sb.WriteString(textContent(nodes[i].Children))
+		}
+	}
+	return sb.String()
+}
+
+// element builds an element node of the given kind.
+func element(k string, attrs map[string]interface{}, children ...crdt.Node) crdt.Node {
+	return crdt.Node{Name: nodeNames[k], Attrs: attrs, Children: children}
+}
+
+// addText appends a text run, merging it into the previous run when both
+// carry the same marks.
+func addText(nodes []crdt.Node, text string, m map[string]interface{}) []crdt.Node {
+	if text == "" {
+		return nodes
+	}
+	if last := len(nodes) - 1; last >= 0 && nodes[last].IsText() && reflect.DeepEqual(nodes[last].Marks, m) {
+		nodes[last].Text += text
+		return nodes
+	}
+	return append(nodes, crdt.Node{Text: text, Marks: m})
+}
+
+// withMark returns a copy of m with one more mark set.
+func withMark(m map[string]interface{}, name string, value interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	c[name] = value
+	return c
+}
+
+// topLevel wraps text runs that sit directly in a root, as in Y.Text
+// documents, into one paragraph per line.
+func topLevel(nodes []crdt.Node) []crdt.Node {
+	var blocks []crdt.Node
+	var para *crdt.Node
+	for _, n := range nodes {
+		if !n.IsText() {
+			blocks = append(blocks, n)
+			para = nil
+			continue
+		}
+		lines := strings.Split(n.Text, "\n")
+		for i, line := range lines {
+			if i > 0 {
+				para = nil
+			}
+			if para == nil {
+				blocks = append(blocks, crdt.Node{Name: kindParagraph})
+				para = &blocks[len(blocks)-1]
+			}
+			if line != "" {
+				para.Children = append(para.Children, crdt.Node{Text: line, Marks: n.Marks})
+			}
+		}
+	}
+	// drop the empty paragraph left by a trailing newline
+	if last := len(blocks) - 1; last >= 0 && blocks[last].Name == kindParagraph && len(blocks[last].Children) == 0 {
+		blocks = blocks[:last]
+	}
+	return blocks
+}
+
+// ParseText reads plain text: blank lines separate paragraphs, single line
+// breaks are kept as hard breaks.
+func ParseText(src string) []crdt.Node {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	var blocks []crdt.Node
+	for _, para := range blankLine.Split(src, -1) {
+		para = strings.Trim(para, "\n")
+		if strings.TrimSpace(para) == "" {
+			continue
+		}
+		p := element(kindParagraph, nil)
+		for i, line := range strings.Split(para, "\n") {
+			if i > 0 {
+				p.Children = append(p.Children, element(kindHardBreak, nil))
+			}
+			p.Children = addText(p.Children, line, nil)
+		}
+		blocks = append(blocks, p)
+	}
+	return blocks
+}
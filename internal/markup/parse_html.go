@@ -0,0 +1,341 @@
+package markup
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"livescribble/internal/crdt"
+)
+
+var inlineMarks = map[atom.Atom]string{
+	atom.B:      "bold",
+	atom.Strong: "bold",
+	atom.I:      "italic",
+	atom.Em:     "italic",
+	atom.S:      "strike",
+	atom.Strike: "strike",
+	atom.Del:    "strike",
+	atom.U:      "underline",
+	atom.Code:   "code",
+}
+
+// blockAtoms start a new block; anything else is read as inline content.
+var blockAtoms = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Blockquote: true, atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Pre: true, atom.Hr: true,
+	atom.Table: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+	atom.Header: true, atom.Footer: true, atom.Nav: true, atom.Aside: true, atom.Figure: true,
+	atom.Body: true, atom.Html: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+}
+
+// ParseHTML reads an HTML page or fragment into a document tree. Elements it
+// does not know contribute their content.
+func ParseHTML(src string) ([]crdt.Node, error) {
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return htmlBlocks(root), nil
+}
+
+// htmlBlocks reads the children of n as blocks, wrapping stray inline
+// content into paragraphs.
+func htmlBlocks(n *html.Node) []crdt.Node {
+	var blocks, inline []crdt.Node
+	flush := func() {
+		if inline = trimInline(inline); len(inline) > 0 {
+			blocks = append(blocks, element(kindParagraph, nil, inline...))
+		}
+		inline = nil
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (blockAtoms[c.DataAtom] || c.DataAtom == atom.Head) {
+			flush()
+			blocks = append(blocks, htmlBlock(c)...)
+			continue
+		}
+		inline = appendInline(inline, htmlInline(c, nil))
+	}
+	flush()
+	return blocks
+}
+
+func htmlBlock(n *html.Node) []crdt.Node {
+	switch n.DataAtom {
+	case atom.Head:
+		return nil
+	case atom.P, atom.Dt:
+		return []crdt.Node{element(kindParagraph, nil, trimInline(htmlInlineChildren(n, nil))...)}
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		return []crdt.Node{element(kindHeading, map[string]interface{}{"level": level}, trimInline(htmlInlineChildren(n, nil))...)}
+	case atom.Blockquote:
+		return []crdt.Node{element(kindBlockquote, nil, nonEmpty(htmlBlocks(n))...)}
+	case atom.Ul, atom.Ol:
+		return []crdt.Node{htmlList(n)}
+	case atom.Li:
+		return []crdt.Node{element(kindBulletList, nil, htmlListItem(n, false))}
+	case atom.Pre:
+		attrs := map[string]interface{}(nil)
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom == atom.Code {
+				if language := codeLanguage(c); language != "" {
+					attrs = map[string]interface{}{"language": language}
+				}
+			}
+		}
+		block := element(kindCodeBlock, attrs)
+		if code := strings.TrimSuffix(htmlText(n), "\n"); code != "" {
+			block.Children = []crdt.Node{{Text: code}}
+		}
+		return []crdt.Node{block}
+	case atom.Hr:
+		return []crdt.Node{element(kindRule, nil)}
+	case atom.Table:
+		return []crdt.Node{htmlTable(n)}
+	default:
+		return htmlBlocks(n)
+	}
+}
+
+func htmlList(n *html.Node) crdt.Node {
+	task := htmlAttr(n, "data-type") == "taskList"
+	var items []crdt.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Li {
+			items = append(items, htmlListItem(c, task))
+		}
+	}
+	// lists are task lists when every item leads with a checkbox
+	if !task && len(items) > 0 {
+		task = true
+		for _, item := range items {
+			task = task && item.Name == nodeNames[kindTaskItem]
+		}
+	}
+	for j := range items {
+		if !task && items[j].Name == nodeNames[kindTaskItem] {
+			items[j] = element(kindListItem, nil, items[j].Children...)
+		}
+	}
+	switch {
+	case task && n.DataAtom == atom.Ul:
+		return element(kindTaskList, nil, items...)
+	case n.DataAtom == atom.Ol:
+		var attrs map[string]interface{}
+		if start, err := strconv.Atoi(htmlAttr(n, "start")); err == nil && start != 1 {
+			attrs = map[string]interface{}{"start": start}
+		}
+		return element(kindOrderList, attrs, items...)
+	default:
+		return element(kindBulletList, nil, items...)
+	}
+}
+
+func htmlListItem(n *html.Node, task bool) crdt.Node {
+	checkbox := findCheckbox(n)
+	children := nonEmpty(htmlBlocks(n))
+	if checkbox == nil && !task {
+		return element(kindListItem, nil, children...)
+	}
+	checked := checkbox != nil && hasAttr(checkbox, "checked") || htmlAttr(n, "data-checked") == "true"
+	return element(kindTaskItem, map[string]interface{}{"checked": checked}, children...)
+}
+
+// findCheckbox returns the checkbox leading a task list item.
+func findCheckbox(n *html.Node) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.DataAtom == atom.Input && htmlAttr(c, "type") == "checkbox":
+			return c
+		case c.DataAtom == atom.Label:
+			if box := findCheckbox(c); box != nil {
+				return box
+			}
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) == "":
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func htmlTable(n *html.Node) crdt.Node {
+	table := element(kindTable, nil)
+	var rows func(n *html.Node)
+	rows = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				rows(c)
+			case atom.Tr:
+				row := element(kindTableRow, nil)
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					cellKind := kindTableCell
+					if cell.DataAtom == atom.Th {
+						cellKind = kindTableHead
+					} else if cell.DataAtom != atom.Td {
+						continue
+					}
+					row.Children = append(row.Children, element(cellKind, nil, nonEmpty(htmlBlocks(cell))...))
+				}
+				table.Children = append(table.Children, row)
+			}
+		}
+	}
+	rows(n)
+	return table
+}
+
+func htmlInlineChildren(n *html.Node, m map[string]interface{}) []crdt.Node {
+	var nodes []crdt.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		nodes = appendInline(nodes, htmlInline(c, m))
+	}
+	return nodes
+}
+
+// appendInline appends inline nodes, merging text runs with equal marks.
+func appendInline(nodes []crdt.Node, more []crdt.Node) []crdt.Node {
+	for _, node := range more {
+		if node.IsText() {
+			nodes = addText(nodes, node.Text, node.Marks)
+		} else {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func htmlInline(n *html.Node, m map[string]interface{}) []crdt.Node {
+	switch n.Type {
+	case html.TextNode:
+		return addText(nil, collapseSpace(n.Data), m)
+	case html.ElementNode:
+	default:
+		return nil
+	}
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Template, atom.Input:
+		return nil
+	case atom.Br:
+		return []crdt.Node{element(kindHardBreak, nil)}
+	case atom.Img:
+		attrs := map[string]interface{}{"src": htmlAttr(n, "src"), "alt": htmlAttr(n, "alt")}
+		if title := htmlAttr(n, "title"); title != "" {
+			attrs["title"] = title
+		}
+		return []crdt.Node{element(kindImage, attrs)}
+	case atom.A:
+		if href := htmlAttr(n, "href"); href != "" {
+			m = withMark(m, "link", map[string]interface{}{"href": href})
+		}
+	default:
+		if mark, ok := inlineMarks[n.DataAtom]; ok {
+			m = withMark(m, mark, map[string]interface{}{})
+		}
+	}
+	return htmlInlineChildren(n, m)
+}
+
+// trimInline drops the whitespace HTML source formatting leaves at the edges
+// of a block and around line breaks.
+func trimInline(nodes []crdt.Node) []crdt.Node {
+	var out []crdt.Node
+	for i, node := range nodes {
+		if node.IsText() {
+			node.Text = collapseSpace(node.Text)
+			if i == 0 || !nodes[i-1].IsText() {
+				node.Text = strings.TrimLeft(node.Text, " ")
+			}
+			if i == len(nodes)-1 || !nodes[i+1].IsText() {
+				node.Text = strings.TrimRight(node.Text, " ")
+			}
+			if node.Text == "" {
+				continue
+			}
+		}
+		out = append(out, node)
+	}
+	return out
+}
+
+// nonEmpty gives list items and cells the paragraph the schema requires.
+func nonEmpty(blocks []crdt.Node) []crdt.Node {
+	if len(blocks) == 0 {
+		return []crdt.Node{element(kindParagraph, nil)}
+	}
+	return blocks
+}
+
+// collapseSpace turns every run of whitespace into one space, as browsers
+// render it.
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range s {
+		if isHTMLSpace(r) {
+			if !space {
+				sb.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func isHTMLSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+}
+
+// htmlText is the raw text below n, used for preformatted content.
+func htmlText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		if n.DataAtom == atom.Br {
+			sb.WriteByte('\n')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+func codeLanguage(n *html.Node) string {
+	for _, class := range strings.Fields(htmlAttr(n, "class")) {
+		if language, ok := strings.CutPrefix(class, "language-"); ok {
+			return language
+		}
+	}
+	return ""
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,478 @@
+package markup
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"livescribble/internal/crdt"
+)
+
+var (
+	atxHeading     = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextHeading  = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	thematicBreak  = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	codeFence      = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	blockquoteLine = regexp.MustCompile(`^ {0,3}> ?`)
+	listMarker     = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	taskMarker     = regexp.MustCompile(`^\[([ xX])\][ \t]+`)
+	tableDelimiter = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	autolink       = regexp.MustCompile(`^<((?:https?|mailto):[^<>\s]+)>`)
+	linkTarget     = regexp.MustCompile(`^\(\s*(<[^>]*>|[^\s()]*(?:\([^\s()]*\)[^\s()]*)*)(?:\s+"([^"]*)")?\s*\)`)
+)
+
+// ParseMarkdown parses CommonMark, with GFM tables, task lists and
+// strikethrough, into a document tree. Constructs it does not know, such as
+// raw HTML or reference links, are kept as text.
+func ParseMarkdown(src string) []crdt.Node {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\t", "    ")
+	return parseMarkdownBlocks(strings.Split(src, "\n"))
+}
+
+func parseMarkdownBlocks(lines []string) []crdt.Node {
+	var blocks []crdt.Node
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case codeFence.MatchString(line):
+			var block crdt.Node
+			block, i = parseCodeFence(lines, i)
+			blocks = append(blocks, block)
+		case atxHeading.MatchString(line):
+			m := atxHeading.FindStringSubmatch(line)
+			blocks = append(blocks, element(kindHeading, map[string]interface{}{"level": len(m[1])}, parseInline(m[2])...))
+			i++
+		case thematicBreak.MatchString(line):
+			blocks = append(blocks, element(kindRule, nil))
+			i++
+		case blockquoteLine.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && blockquoteLine.MatchString(lines[i]); i++ {
+				quoted = append(quoted, blockquoteLine.ReplaceAllString(lines[i], ""))
+			}
+			blocks = append(blocks, element(kindBlockquote, nil, parseMarkdownBlocks(quoted)...))
+		case listMarker.MatchString(line):
+			var block crdt.Node
+			block, i = parseList(lines, i)
+			blocks = append(blocks, block)
+		case i+1 < len(lines) && strings.Contains(line, "|") && tableDelimiter.MatchString(lines[i+1]):
+			var block crdt.Node
+			block, i = parseTable(lines, i)
+			blocks = append(blocks, block)
+		default:
+			var block crdt.Node
+			block, i = parseParagraph(lines, i)
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+func parseCodeFence(lines []string, i int) (crdt.Node, int) {
+	m := codeFence.FindStringSubmatch(lines[i])
+	indent, fence := len(m[1]), m[2]
+	var attrs map[string]interface{}
+	if m[3] != "" {
+		attrs = map[string]interface{}{"language": m[3]}
+	}
+	var code []string
+	for i++; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			i++
+			break
+		}
+		code = append(code, trimLeadingSpaces(lines[i], indent))
+	}
+	block := element(kindCodeBlock, attrs)
+	if text := strings.Join(code, "\n"); text != "" {
+		block.Children = []crdt.Node{{Text: text}}
+	}
+	return block, i
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	return atxHeading.MatchString(line) || thematicBreak.MatchString(line) || codeFence.MatchString(line) ||
+		blockquoteLine.MatchString(line) || listMarker.MatchString(line)
+}
+
+func parseParagraph(lines []string, i int) (crdt.Node, int) {
+	text := []string{strings.TrimLeft(lines[i], " ")}
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		if m := setextHeading.FindStringSubmatch(line); m != nil {
+			level := 1
+			if m[1][0] == '-' {
+				level = 2
+			}
+			return element(kindHeading, map[string]interface{}{"level": level}, parseInline(joinParagraph(text))...), i + 1
+		}
+		if startsBlock(line) {
+			break
+		}
+		// keep trailing spaces, two of them make a hard break
+		text = append(text, strings.TrimLeft(line, " "))
+	}
+	return element(kindParagraph, nil, parseInline(joinParagraph(text))...), i
+}
+
+func joinParagraph(lines []string) string {
+	return strings.TrimRight(strings.Join(lines, "\n"), " ")
+}
+
+func parseList(lines []string, i int) (crdt.Node, int) {
+	first := listMarker.FindStringSubmatch(lines[i])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	delimiter := first[2][len(first[2])-1:]
+
+	var items []crdt.Node
+	allTasks := true
+	for i < len(lines) {
+		m := listMarker.FindStringSubmatch(lines[i])
+		if m == nil || (m[2][0] >= '0' && m[2][0] <= '9') != ordered || !strings.HasSuffix(m[2], delimiter) {
+			break
+		}
+		contentIndent := len(m[0])
+		if m[3] == "" || len(m[3]) > 4 {
+			contentIndent = len(m[1]) + len(m[2]) + 1
+		}
+		body := []string{lines[i][min(contentIndent, len(lines[i])):]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// a blank line continues the item only if indented content follows
+				next := i + 1
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next < len(lines) && leadingSpaces(lines[next]) >= contentIndent {
+					body = append(body, "")
+					continue
+				}
+				break
+			}
+			if leadingSpaces(line) >= contentIndent {
+				body = append(body, line[contentIndent:])
+				continue
+			}
+			if startsBlock(line) {
+				break
+			}
+			// lazy continuation of the item's paragraph
+			body = append(body, strings.TrimLeft(line, " "))
+		}
+
+		itemKind, attrs := kindListItem, map[string]interface{}(nil)
+		if task := taskMarker.FindStringSubmatch(body[0]); task != nil {
+			itemKind = kindTaskItem
+			attrs = map[string]interface{}{"checked": task[1] != " "}
+			body[0] = body[0][len(task[0]):]
+		} else {
+			allTasks = false
+		}
+		children := parseMarkdownBlocks(body)
+		if len(children) == 0 {
+			children = []crdt.Node{element(kindParagraph, nil)}
+		}
+		items = append(items, element(itemKind, attrs, children...))
+
+		// skip the blank lines between items
+		next := i
+		for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+			next++
+		}
+		if next >= len(lines) || !listMarker.MatchString(lines[next]) {
+			break
+		}
+		i = next
+	}
+
+	if allTasks && !ordered {
+		return element(kindTaskList, nil, items...), i
+	}
+	// other lists keep a task's checkbox as text
+	for j := range items {
+		if items[j].Name == nodeNames[kindTaskItem] {
+			mark := "[ ] "
+			if items[j].Attrs["checked"] == true {
+				mark = "[x] "
+			}
+			items[j] = element(kindListItem, nil, items[j].Children...)
+			if p := &items[j].Children[0]; p.Name == nodeNames[kindParagraph] {
+				p.Children = append([]crdt.Node{{Text: mark}}, p.Children...)
+			}
+		}
+	}
+	if ordered {
+		start, _ := strconv.Atoi(strings.TrimRight(first[2], ".)"))
+		var attrs map[string]interface{}
+		if start != 1 {
+			attrs = map[string]interface{}{"start": start}
+		}
+		return element(kindOrderList, attrs, items...), i
+	}
+	return element(kindBulletList, nil, items...), i
+}
+
+func parseTable(lines []string, i int) (crdt.Node, int) {
+	header := splitTableRow(lines[i])
+	rows := []crdt.Node{tableRow(header, kindTableHead, len(header))}
+	for i += 2; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" || !strings.Contains(lines[i], "|") {
+			break
+		}
+		rows = append(rows, tableRow(splitTableRow(lines[i]), kindTableCell, len(header)))
+	}
+	return element(kindTable, nil, rows...), i
+}
+
+func tableRow(cells []string, cellKind string, width int) crdt.Node {
+	row := element(kindTableRow, nil)
+	for c := 0; c < width; c++ {
+		text := ""
+		if c < len(cells) {
+			text = cells[c]
+		}
+		row.Children = append(row.Children, element(cellKind, nil, element(kindParagraph, nil, parseInline(text)...)))
+	}
+	return row
+}
+
+// splitTableRow splits a table row on unescaped pipes.
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cell strings.Builder
+	for j := 0; j < len(line); j++ {
+		switch {
+		case line[j] == '\\' && j+1 < len(line) && line[j+1] == '|':
+			cell.WriteByte('|')
+			j++
+		case line[j] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[j])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func trimLeadingSpaces(line string, n int) string {
+	return line[min(n, leadingSpaces(line)):]
+}
+
+// parseInline parses inline Markdown into text runs, hard breaks and images.
+func parseInline(src string) []crdt.Node {
+	return parseInlineMarks(src, nil)
+}
+
+func parseInlineMarks(src string, m map[string]interface{}) []crdt.Node {
+	var nodes []crdt.Node
+	var text strings.Builder
+	flush := func() {
+		nodes = addText(nodes, text.String(), m)
+		text.Reset()
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			flush()
+			nodes = append(nodes, element(kindHardBreak, nil))
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(src) && unicode.IsPunct(rune(src[i+1])) || c == '\\' && i+1 < len(src) && unicode.IsSymbol(rune(src[i+1])):
+			text.WriteByte(src[i+1])
+			i += 2
+			continue
+		case c == '\n':
+			flush()
+			if strings.HasSuffix(nodesText(nodes), "  ") {
+				trimTrailingSpaces(nodes)
+				nodes = append(nodes, element(kindHardBreak, nil))
+			} else {
+				trimTrailingSpaces(nodes)
+				nodes = addText(nodes, " ", m)
+			}
+			i++
+			continue
+		case c == '`':
+			if code, end, ok := codeSpan(src, i); ok {
+				flush()
+				nodes = addText(nodes, code, withMark(m, "code", map[string]interface{}{}))
+				i = end
+				continue
+			}
+		case c == '!' && strings.HasPrefix(src[i+1:], "["):
+			if alt, href, title, end, ok := linkAt(src, i+1); ok {
+				flush()
+				attrs := map[string]interface{}{"src": href, "alt": alt}
+				if title != "" {
+					attrs["title"] = title
+				}
+				nodes = append(nodes, element(kindImage, attrs))
+				i = end
+				continue
+			}
+		case c == '[':
+			if label, href, _, end, ok := linkAt(src, i); ok {
+				flush()
+				nodes = append(nodes, parseInlineMarks(label, withMark(m, "link", map[string]interface{}{"href": href}))...)
+				i = end
+				continue
+			}
+		case c == '<':
+			if link := autolink.FindStringSubmatch(src[i:]); link != nil {
+				flush()
+				nodes = addText(nodes, link[1], withMark(m, "link", map[string]interface{}{"href": link[1]}))
+				i += len(link[0])
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if inner, mark, end, ok := emphasis(src, i); ok {
+				flush()
+				nodes = append(nodes, parseInlineMarks(inner, withMark(m, mark, map[string]interface{}{}))...)
+				i = end
+				continue
+			}
+		}
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return nodes
+}
+
+// codeSpan matches a backtick code span starting at i.
+func codeSpan(src string, i int) (string, int, bool) {
+	n := 0
+	for i+n < len(src) && src[i+n] == '`' {
+		n++
+	}
+	fence := src[i : i+n]
+	for j := i + n; j < len(src); {
+		k := strings.Index(src[j:], fence)
+		if k < 0 {
+			return "", 0, false
+		}
+		k += j
+		end := k + n
+		if end < len(src) && src[end] == '`' {
+			// a longer backtick run does not close the span
+			for end < len(src) && src[end] == '`' {
+				end++
+			}
+			j = end
+			continue
+		}
+		code := strings.ReplaceAll(src[i+n:k], "\n", " ")
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+			code = code[1 : len(code)-1]
+		}
+		return code, end, true
+	}
+	return "", 0, false
+}
+
+// linkAt matches [label](href "title") with the bracket at i.
+func linkAt(src string, i int) (label, href, title string, end int, ok bool) {
+	depth := 0
+	for j := i; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				target := linkTarget.FindStringSubmatch(src[j+1:])
+				if target == nil {
+					return "", "", "", 0, false
+				}
+				href = strings.TrimSuffix(strings.TrimPrefix(target[1], "<"), ">")
+				return src[i+1 : j], href, target[2], j + 1 + len(target[0]), true
+			}
+		}
+	}
+	return "", "", "", 0, false
+}
+
+// emphasis matches **strong**, __strong__, *em*, _em_ or ~~strike~~ at i.
+func emphasis(src string, i int) (inner string, mark string, end int, ok bool) {
+	c := src[i]
+	delim := string(c)
+	if i+1 < len(src) && src[i+1] == c {
+		delim += string(c)
+	}
+	switch {
+	case c == '~' && len(delim) == 1:
+		return "", "", 0, false
+	case c == '~':
+		mark = "strike"
+	case len(delim) == 2:
+		mark = "bold"
+	default:
+		mark = "italic"
+	}
+	start := i + len(delim)
+	if start >= len(src) || unicode.IsSpace(rune(src[start])) {
+		return "", "", 0, false
+	}
+	// underscores inside words are literal
+	if c == '_' && i > 0 && isWordByte(src[i-1]) {
+		return "", "", 0, false
+	}
+	for j := start + 1; j+len(delim) <= len(src); j++ {
+		if src[j-1] == '\\' || !strings.HasPrefix(src[j:], delim) || unicode.IsSpace(rune(src[j-1])) {
+			continue
+		}
+		after := j + len(delim)
+		if len(delim) == 1 && after < len(src) && src[after] == c {
+			// part of a longer run, e.g. the end of **bold** inside *em*
+			j++
+			continue
+		}
+		if c == '_' && after < len(src) && isWordByte(src[after]) {
+			continue
+		}
+		return src[start:j], mark, after, true
+	}
+	return "", "", 0, false
+}
+
+func isWordByte(b byte) bool {
+	return b >= 0x80 || unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b))
+}
+
+// nodesText is the text of the last run, if the last node is one.
+func nodesText(nodes []crdt.Node) string {
+	if last := len(nodes) - 1; last >= 0 && nodes[last].IsText() {
+		return nodes[last].Text
+	}
+	return ""
+}
+
+func trimTrailingSpaces(nodes []crdt.Node) {
+	if last := len(nodes) - 1; last >= 0 && nodes[last].IsText() {
+		nodes[last].Text = strings.TrimRight(nodes[last].Text, " ")
+	}
+}
@@ -0,0 +1,93 @@
+// Package metrics holds the Prometheus collectors of this node and the
+// handlers that expose them. Everything is registered with the default
+// registry, so Go runtime and process metrics come along for free.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "livescribble"
+
+var (
+	Rooms = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rooms",
+		Help:      "Rooms open on this node.",
+	})
+	Connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections",
+		Help:      "WebSocket connections open on this node.",
+	})
+	Frames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "frames_total",
+		Help:      "WebSocket frames by frame type and direction (in from clients, out to clients).",
+	}, []string{"type", "direction"})
+	Bytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "frame_bytes_total",
+		Help:      "WebSocket payload bytes by direction.",
+	}, []string{"direction"})
+	BroadcastDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broadcast_duration_seconds",
+		Help:      "Time to fan a frame out to the local clients of a room.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	})
+	SnapshotSaveDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_save_duration_seconds",
+		Help:      "Time to store a snapshot, including text extraction.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	SnapshotSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_size_bytes",
+		Help:      "Size of saved snapshots.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8), // 1 KiB to 16 MiB
+	})
+	RedisPublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_publish_errors_total",
+		Help:      "Failed Redis publishes of room messages.",
+	})
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format. It is not
+// authenticated, so it gets a listener of its own rather than a public route.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the latency of every request under its route template,
+// e.g. /protected/document/:doc_id, so IDs do not blow up the label set.
+// Requests that match no route are recorded as "unmatched".
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequestDuration.
+			WithLabelValues(route, ctx.Request.Method, strconv.Itoa(ctx.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
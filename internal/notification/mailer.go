@@ -0,0 +1,56 @@
+package notification
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer delivers email. Digests go through it, so deployments can plug in
+// their own provider.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailer returns an SMTPMailer when addr is set and a LogMailer
+// otherwise. username and password are only needed by servers that want
+// PLAIN auth.
+func NewMailer(addr string, from string, username string, password string, logger *slog.Logger) Mailer {
+	if addr == "" {
+		return &LogMailer{logger: logger}
+	}
+	mailer := &SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+// LogMailer only logs what it would send. It is the default when no mail
+// server is configured.
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	m.logger.Info("Email not sent, no mailer configured", "to", to, "subject", subject)
+	return nil
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.from, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
@@ -0,0 +1,287 @@
+// Package notification stores in-app notifications, pushes them to the
+// recipient's open streams through Redis and mails unread ones as digests.
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"livescribble/internal/utils"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	TypeMention = "mention"
+	TypeShare   = "share"
+
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	keepAliveInterval = 25 * time.Second
+)
+
+type Handler struct {
+	db          *gorm.DB
+	redisClient *redis.Client
+	logger      *slog.Logger
+	mailer      Mailer
+
+	closing   chan struct{} // closed by Shutdown, ends every stream
+	closeOnce sync.Once
+}
+
+func NewHandler(db *gorm.DB, redisClient *redis.Client, logger *slog.Logger, mailer Mailer) *Handler {
+	return &Handler{
+		db:          db,
+		redisClient: redisClient,
+		logger:      logger,
+		mailer:      mailer,
+		closing:     make(chan struct{}),
+	}
+}
+
+// Shutdown ends every open stream so the HTTP server can stop. Register it
+// with http.Server.RegisterOnShutdown.
+func (h *Handler) Shutdown() {
+	h.closeOnce.Do(func() {
+		close(h.closing)
+	})
+}
+
+func userChannel(userID string) string {
+	return "user:" + userID
+}
+
+// Notify saves the notification and pushes it to every stream the recipient
+// has open, on any node. Failures are logged, they never fail the action
+// that caused the notification.
+func (h *Handler) Notify(n *utils.Notification) {
+	id, err := utils.RandomString(10)
+	if err != nil {
+		h.logger.Error("Failed to generate notification id", "error", err)
+		return
+	}
+	n.ID = id
+	n.Created = time.Now()
+	if err := h.db.Create(n).Error; err != nil {
+		h.logger.Error("Failed to save notification", "error", err, "userId", n.UserID)
+		return
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		h.logger.Error("Failed to marshal notification", "error", err)
+		return
+	}
+	if err := h.redisClient.Publish(context.Background(), userChannel(n.UserID), payload).Err(); err != nil {
+		h.logger.Error("Failed to publish notification", "error", err, "userId", n.UserID)
+	}
+}
+
+// ListNotifications is the inbox, newest first. unread=true hides read
+// notifications; before (RFC 3339) pages back from an earlier response.
+func (h *Handler) ListNotifications(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	query := h.db.Model(utils.Notification{}).Where("user_id = ?", currentUser)
+	if ctx.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+	if before := ctx.Query("before"); before != "" {
+		t, err := time.Parse(time.RFC3339Nano, before)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid before timestamp",
+			})
+			return
+		}
+		query = query.Where("created < ?", t)
+	}
+
+	notifications := make([]utils.Notification, 0)
+	if err := query.Order("created DESC").Limit(limit).Find(&notifications).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list notifications", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving notifications",
+		})
+		return
+	}
+	var unread int64
+	if err := h.db.Model(utils.Notification{}).Where("user_id = ? AND read_at IS NULL", currentUser).Count(&unread).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to count unread notifications", "error", err)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"notifications": notifications,
+		"unread_count":  unread,
+	})
+}
+
+// MarkRead marks one notification as read.
+func (h *Handler) MarkRead(ctx *gin.Context) {
+	h.setRead(ctx, h.db.Where("id = ?", ctx.Param("notification_id")), time.Now())
+}
+
+// MarkUnread puts one notification back in the unread list.
+func (h *Handler) MarkUnread(ctx *gin.Context) {
+	h.setRead(ctx, h.db.Where("id = ?", ctx.Param("notification_id")), nil)
+}
+
+// MarkAllRead marks the whole inbox as read.
+func (h *Handler) MarkAllRead(ctx *gin.Context) {
+	h.setRead(ctx, h.db.Where("read_at IS NULL"), time.Now())
+}
+
+func (h *Handler) setRead(ctx *gin.Context, scope *gorm.DB, readAt interface{}) {
+	currentUser := ctx.GetString("current_user")
+
+	result := h.db.Model(utils.Notification{}).Where("user_id = ?", currentUser).Where(scope).Update("read_at", readAt)
+	if result.Error != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to update notifications", "error", result.Error)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error updating notifications",
+		})
+		return
+	}
+	if result.RowsAffected == 0 && ctx.Param("notification_id") != "" {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "notification not found",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "notifications updated",
+	})
+}
+
+// Stream sends the caller's new notifications as server-sent events until
+// the client disconnects or the server shuts down.
+func (h *Handler) Stream(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+	reqCtx := ctx.Request.Context()
+
+	pubsub := h.redisClient.Subscribe(reqCtx, userChannel(currentUser))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(reqCtx); err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to subscribe to notifications", "error", err, "userId", currentUser)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error opening notification stream",
+		})
+		return
+	}
+	messages := pubsub.Channel()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent("notification", msg.Payload)
+			return true
+		case <-keepAlive.C:
+			// a comment line keeps proxies from closing an idle stream
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-reqCtx.Done():
+			return false
+		case <-h.closing:
+			return false
+		}
+	})
+}
+
+// StartDigests mails every user their unread notifications that have not
+// been mailed yet, once per interval. It blocks, run it in a goroutine.
+func (h *Handler) StartDigests(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.sendDigests(); err != nil {
+			h.logger.Error("Failed to send notification digests", "error", err)
+		}
+	}
+}
+
+func (h *Handler) sendDigests() error {
+	var recipients []struct {
+		UserID string
+		Email  string
+	}
+	err := h.db.Model(utils.Notification{}).
+		Select("DISTINCT notifications.user_id, users.email").
+		Joins("LEFT JOIN users ON users.id = notifications.user_id").
+		Where("notifications.read_at IS NULL AND notifications.emailed_at IS NULL").
+		Scan(&recipients).Error
+	if err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if !mailable(r.UserID, r.Email) {
+			// nothing will ever reach them, stop looking at these rows
+			err := h.db.Model(utils.Notification{}).
+				Where("user_id = ? AND read_at IS NULL AND emailed_at IS NULL", r.UserID).
+				Update("emailed_at", time.Now()).Error
+			if err != nil {
+				h.logger.Error("Failed to skip notification digest", "error", err, "userId", r.UserID)
+			}
+			continue
+		}
+		if err := h.sendDigest(r.UserID, r.Email); err != nil {
+			h.logger.Error("Failed to send notification digest", "error", err, "userId", r.UserID)
+		}
+	}
+	return nil
+}
+
+// mailable reports whether a user can be sent a digest. Temporary accounts
+// and deleted users have no address.
+func mailable(userID string, email string) bool {
+	if email == "" || strings.HasPrefix(userID, utils.TempUserPrefix) {
+		return false
+	}
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+func (h *Handler) sendDigest(userID string, email string) error {
+	var notifications []utils.Notification
+	err := h.db.Model(utils.Notification{}).
+		Where("user_id = ? AND read_at IS NULL AND emailed_at IS NULL", userID).
+		Order("created").Find(&notifications).Error
+	if err != nil || len(notifications) == 0 {
+		return err
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "You have %d unread notification(s) on LiveScribble:\n\n", len(notifications))
+	ids := make([]string, 0, len(notifications))
+	for _, n := range notifications {
+		fmt.Fprintf(&body, "- %s (%s)\n", n.Message, n.Created.Format("Jan 2 15:04"))
+		ids = append(ids, n.ID)
+	}
+	if err := h.mailer.Send(email, "Your LiveScribble notifications", body.String()); err != nil {
+		return err
+	}
+	return h.db.Model(utils.Notification{}).Where("id IN ?", ids).Update("emailed_at", time.Now()).Error
+}
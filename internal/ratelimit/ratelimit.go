@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// slidingWindow keeps one sorted-set member per hit, scored by its timestamp
+// in milliseconds. It trims everything older than the window, admits the hit
+// if there is room and otherwise reports how long until the oldest hit expires.
+var slidingWindow = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+if count < limit then
+	redis.call('ZADD', key, now, ARGV[4])
+	redis.call('PEXPIRE', key, window)
+	return {1, limit - count - 1, 0}
+end
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if #oldest == 0 then
+	-- a limit of 0 admits nothing, not even a first hit
+	return {0, 0, window}
+end
+return {0, 0, tonumber(oldest[2]) + window - now}
+`)
+
+type Limiter struct {
+	redisClient *redis.Client
+	logger      *slog.Logger
+}
+
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+func NewLimiter(redisClient *redis.Client, logger *slog.Logger) *Limiter {
+	return &Limiter{
+		redisClient: redisClient,
+		logger:      logger,
+	}
+}
+
+// Allow records a hit against key and reports whether it fits in limit hits
+// per window.
+func (l *Limiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (Result, error) {
+	now := time.Now().UnixMilli()
+	member := strconv.FormatInt(time.Now().UnixNano(), 10)
+	res, err := slidingWindow.Run(ctx, l.redisClient, []string{"ratelimit:" + key}, now, window.Milliseconds(), limit, member).Int64Slice()
+	if err != nil {
+		return Result{Allowed: true}, err
+	}
+	return Result{
+		Allowed:    res[0] == 1,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+	}, nil
+}
+
+// Middleware throttles a route to limit requests per window for each client
+// IP. name keeps the counters of different routes apart.
+func (l *Limiter) Middleware(name string, limit int, window time.Duration) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := fmt.Sprintf("%s:%s", name, ctx.ClientIP())
+		res, err := l.Allow(ctx.Request.Context(), key, limit, window)
+		if err != nil {
+			// fail open, an unavailable Redis should not take auth down with it
+			l.logger.ErrorContext(ctx.Request.Context(), "Rate limiter unavailable", "route", name, "error", err)
+			ctx.Next()
+			return
+		}
+
+		ctx.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+		ctx.Header("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		if !res.Allowed {
+			SetRetryAfter(ctx, res.RetryAfter)
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"message": "Too many requests, try again later",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// SetRetryAfter writes the Retry-After header in whole seconds, rounding up.
+func SetRetryAfter(ctx *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+}
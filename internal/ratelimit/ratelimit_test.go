@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// testLimiter connects to the Redis at REDIS_ADDR, the counters live in
+// scripts so they cannot be checked without one. Keys are prefixed with the
+// test name and removed afterwards.
+func testLimiter(t *testing.T) (*Limiter, string) {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis at %s: %v", addr, err)
+	}
+	prefix := "test:" + t.Name() + ":" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	t.Cleanup(func() {
+		for _, pattern := range []string{"ratelimit:*" + prefix + "*", "lockout:" + prefix + "*"} {
+			keys, _ := client.Keys(ctx, pattern).Result()
+			if len(keys) > 0 {
+				client.Del(ctx, keys...)
+			}
+		}
+	})
+	return NewLimiter(client, slog.New(slog.NewTextHandler(io.Discard, nil))), prefix
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name        string
+		limit       int
+		hits        int
+		wantAllowed bool
+		wantLeft    int
+	}{
+		{"first hit", 3, 1, true, 2},
+		{"last allowed hit", 3, 3, true, 0},
+		{"one over the limit", 3, 4, false, 0},
+		{"limit of one", 1, 2, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, key := testLimiter(t)
+			ctx := context.Background()
+			var res Result
+			var err error
+			for i := 0; i < tt.hits; i++ {
+				if res, err = limiter.Allow(ctx, key, tt.limit, time.Minute); err != nil {
+					t.Fatalf("Allow: %v", err)
+				}
+			}
+			if res.Allowed != tt.wantAllowed || res.Remaining != tt.wantLeft {
+				t.Errorf("after %d hits Allow() = %+v, want allowed %t with %d left", tt.hits, res, tt.wantAllowed, tt.wantLeft)
+			}
+			if !res.Allowed && (res.RetryAfter <= 0 || res.RetryAfter > time.Minute) {
+				t.Errorf("RetryAfter = %v, want within the window", res.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures int
+		failures    int
+		wantLocked  bool
+	}{
+		{"below the threshold", 5, 4, false},
+		{"at the threshold", 5, 5, true},
+		{"single failure allowed", 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, account := testLimiter(t)
+			lockout := NewAccountLockout(limiter, tt.maxFailures, time.Minute, 15*time.Minute)
+			ctx := context.Background()
+			for i := 1; i <= tt.failures; i++ {
+				locked, err := lockout.RecordFailure(ctx, account)
+				if err != nil {
+					t.Fatalf("RecordFailure: %v", err)
+				}
+				if causedLock := i == tt.maxFailures; (locked > 0) != causedLock {
+					t.Errorf("failure %d locked for %v", i, locked)
+				}
+			}
+			wait, err := lockout.Locked(ctx, account)
+			if err != nil {
+				t.Fatalf("Locked: %v", err)
+			}
+			if (wait > 0) != tt.wantLocked || wait > 15*time.Minute {
+				t.Errorf("Locked() = %v after %d failures, want locked %t", wait, tt.failures, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestAccountLockoutReset(t *testing.T) {
+	limiter, account := testLimiter(t)
+	lockout := NewAccountLockout(limiter, 3, time.Minute, 15*time.Minute)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := lockout.RecordFailure(ctx, account); err != nil {
+			t.Fatalf("RecordFailure: %v", err)
+		}
+	}
+	lockout.Reset(ctx, account)
+	for i := 0; i < 2; i++ {
+		if locked, err := lockout.RecordFailure(ctx, account); err != nil || locked > 0 {
+			t.Fatalf("RecordFailure after Reset = %v, %v, want no lock", locked, err)
+		}
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "1"},
+		{300 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wait.String(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			SetRetryAfter(ctx, tt.wait)
+			if got := w.Header().Get("Retry-After"); got != tt.want {
+				t.Errorf("Retry-After = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
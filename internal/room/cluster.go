@@ -0,0 +1,279 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"livescribble/internal/metrics"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Every node announces itself in the nodesKey sorted set, scored by its last
+// heartbeat, and listens on adminChannel. Admin commands are published there
+// and each node answers on the command's reply channel, so the caller knows
+// how many answers to wait for.
+const (
+	adminChannel  = "admin:rooms"
+	nodesKey      = "cluster:nodes"
+	nodeHeartbeat = 10 * time.Second
+	nodeExpiry    = 3 * nodeHeartbeat
+
+	commandList     = "list"
+	commandKick     = "kick"
+	commandSnapshot = "snapshot"
+)
+
+var ErrNoNodes = errors.New("no live nodes")
+
+// ClientInfo describes one connection in a room.
+type ClientInfo struct {
+	ConnId     string    `json:"conn_id"`
+	UserId     string    `json:"user_id"`
+	ReadOnly   bool      `json:"read_only"`
+	RemoteAddr string    `json:"remote_addr"`
+	Joined     time.Time `json:"joined"`
+}
+
+// RoomInfo is the state of a room on one node. The counters start when the
+// room was opened on that node.
+type RoomInfo struct {
+	DocId     string       `json:"doc_id"`
+	Node      string       `json:"node"`
+	Clients   []ClientInfo `json:"clients"`
+	Created   time.Time    `json:"created"`
+	SavedAt   *time.Time   `json:"saved_at"` // last snapshot saved from this node
+	FramesIn  uint64       `json:"frames_in"`
+	FramesOut uint64       `json:"frames_out"`
+	BytesIn   uint64       `json:"bytes_in"`
+	BytesOut  uint64       `json:"bytes_out"`
+}
+
+// NodeReply is one node's answer to an admin command.
+type NodeReply struct {
+	Node     string     `json:"node"`
+	Rooms    []RoomInfo `json:"rooms,omitempty"`
+	Affected int        `json:"affected"` // connections kicked or rooms asked for a snapshot
+}
+
+// ClusterResult collects the replies to a command. Partial is set when some
+// live nodes did not answer in time.
+type ClusterResult struct {
+	Replies []NodeReply `json:"replies"`
+	Nodes   int         `json:"nodes"`
+	Partial bool        `json:"partial"`
+}
+
+type adminCommand struct {
+	Type    string `json:"type"`
+	DocId   string `json:"docId,omitempty"`
+	ConnId  string `json:"connId,omitempty"`
+	UserId  string `json:"userId,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	ReplyTo string `json:"replyTo"`
+}
+
+// Cluster sends admin commands to every node and collects their answers.
+// RoomManager embeds one; on its own it reaches the nodes without joining
+// them, as the operator CLI does.
+type Cluster struct {
+	redisClient *redis.Client
+	logger      *slog.Logger
+}
+
+func NewCluster(redisClient *redis.Client, logger *slog.Logger) *Cluster {
+	return &Cluster{redisClient: redisClient, logger: logger}
+}
+
+// NodeID names this process in admin replies.
+func (rm *RoomManager) NodeID() string {
+	return rm.nodeID
+}
+
+func newNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "node"
+	}
+	return host + "-" + generateConnectionId()[:6]
+}
+
+// ListRooms reports the rooms of every node, or only docId's when it is set.
+func (c *Cluster) ListRooms(ctx context.Context, docId string) (*ClusterResult, error) {
+	return c.command(ctx, adminCommand{Type: commandList, DocId: docId})
+}
+
+// Kick disconnects connId, or every connection of userId, from docId's room
+// on whichever node holds it, or from every room when docId is empty. The
+// client gets a FrameControl with reason and the close code CloseKicked.
+func (c *Cluster) Kick(ctx context.Context, docId string, connId string, userId string, reason string) (*ClusterResult, error) {
+	return c.command(ctx, adminCommand{Type: commandKick, DocId: docId, ConnId: connId, UserId: userId, Reason: reason})
+}
+
+// RequestSnapshot sends FrameRequestSnap to everyone in docId's room.
+func (c *Cluster) RequestSnapshot(ctx context.Context, docId string) (*ClusterResult, error) {
+	return c.command(ctx, adminCommand{Type: commandSnapshot, DocId: docId})
+}
+
+// CloseRoom disconnects everyone editing docId on every node, sending reason
+// in a FrameControl first. The close goes through Redis so nodes without a
+// local room simply ignore it.
+func (c *Cluster) CloseRoom(docId string, reason string) {
+	msg, err := json.Marshal(RedisMessage{
+		Type:  "close",
+		DocId: docId,
+		Data:  []byte(reason),
+	})
+	if err != nil {
+		c.logger.Error("Failed to marshal Redis message", "error", err)
+		return
+	}
+	if err := c.redisClient.Publish(context.Background(), "room:"+docId, msg).Err(); err != nil {
+		metrics.RedisPublishErrors.Inc()
+		c.logger.Error("Failed to publish room close", "docId", docId, "error", err)
+	}
+}
+
+// command publishes cmd to every node and waits for their replies until all
+// live nodes answered or ctx ends.
+func (c *Cluster) command(ctx context.Context, cmd adminCommand) (*ClusterResult, error) {
+	cutoff := strconv.FormatInt(time.Now().Add(-nodeExpiry).UnixMilli(), 10)
+	nodes, err := c.redisClient.ZCount(ctx, nodesKey, cutoff, "+inf").Result()
+	if err != nil {
+		return nil, err
+	}
+	if nodes == 0 {
+		return nil, ErrNoNodes
+	}
+
+	cmd.ReplyTo = "admin:reply:" + generateConnectionId()
+	pubsub := c.redisClient.Subscribe(ctx, cmd.ReplyTo)
+	defer pubsub.Close()
+	// the subscription must be live before anyone can answer
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return nil, err
+	}
+	msg, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.redisClient.Publish(ctx, adminChannel, msg).Err(); err != nil {
+		return nil, err
+	}
+
+	result := &ClusterResult{Replies: make([]NodeReply, 0, nodes), Nodes: int(nodes)}
+	ch := pubsub.Channel()
+	for len(result.Replies) < int(nodes) {
+		select {
+		case <-ctx.Done():
+			result.Partial = true
+			return result, nil
+		case msg := <-ch:
+			var reply NodeReply
+			if err := json.Unmarshal([]byte(msg.Payload), &reply); err != nil {
+				c.logger.Error("Failed to unmarshal admin reply", "error", err)
+				continue
+			}
+			result.Replies = append(result.Replies, reply)
+		}
+	}
+	return result, nil
+}
+
+// heartbeat keeps this node in nodesKey until it drains and prunes nodes
+// that stopped beating. It blocks, run it in a goroutine.
+func (rm *RoomManager) heartbeat() {
+	ticker := time.NewTicker(nodeHeartbeat)
+	defer ticker.Stop()
+
+	for ; !rm.draining.Load(); <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), nodeHeartbeat)
+		now := time.Now()
+		err := rm.redisClient.ZAdd(ctx, nodesKey, redis.Z{Score: float64(now.UnixMilli()), Member: rm.nodeID}).Err()
+		if err == nil {
+			err = rm.redisClient.ZRemRangeByScore(ctx, nodesKey, "-inf", fmt.Sprintf("(%d", now.Add(-nodeExpiry).UnixMilli())).Err()
+		}
+		cancel()
+		if err != nil {
+			rm.logger.Error("Failed to send node heartbeat", "error", err)
+		}
+	}
+}
+
+// leaveCluster stops other nodes from waiting for this one.
+func (rm *RoomManager) leaveCluster() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rm.redisClient.ZRem(ctx, nodesKey, rm.nodeID).Err(); err != nil {
+		rm.logger.Error("Failed to leave cluster", "error", err)
+	}
+}
+
+// listenForCommands answers admin commands for this node's rooms. It
+// blocks, run it in a goroutine.
+func (rm *RoomManager) listenForCommands() {
+	pubsub := rm.redisClient.Subscribe(context.Background(), adminChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var cmd adminCommand
+		if err := json.Unmarshal([]byte(msg.Payload), &cmd); err != nil {
+			rm.logger.Error("Failed to unmarshal admin command", "error", err)
+			continue
+		}
+		reply := rm.handleCommand(&cmd)
+		out, err := json.Marshal(reply)
+		if err != nil {
+			rm.logger.Error("Failed to marshal admin reply", "error", err)
+			continue
+		}
+		if err := rm.redisClient.Publish(context.Background(), cmd.ReplyTo, out).Err(); err != nil {
+			rm.logger.Error("Failed to publish admin reply", "error", err)
+		}
+	}
+}
+
+func (rm *RoomManager) handleCommand(cmd *adminCommand) *NodeReply {
+	reply := &NodeReply{Node: rm.nodeID}
+
+	rm.roomMu.RLock()
+	var rooms []*Room
+	if cmd.DocId != "" {
+		if room, ok := rm.rooms[cmd.DocId]; ok {
+			rooms = append(rooms, room)
+		}
+	} else {
+		for _, room := range rm.rooms {
+			rooms = append(rooms, room)
+		}
+	}
+	rm.roomMu.RUnlock()
+
+	switch cmd.Type {
+	case commandList:
+		reply.Rooms = make([]RoomInfo, 0, len(rooms))
+		for _, room := range rooms {
+			info := room.info()
+			info.Node = rm.nodeID
+			reply.Rooms = append(reply.Rooms, info)
+		}
+	case commandKick:
+		for _, room := range rooms {
+			reply.Affected += room.kick(cmd.ConnId, cmd.UserId, cmd.Reason)
+		}
+		if reply.Affected > 0 {
+			rm.logger.Info("Kicked clients", "docId", cmd.DocId, "connId", cmd.ConnId, "userId", cmd.UserId, "count", reply.Affected)
+		}
+	case commandSnapshot:
+		for _, room := range rooms {
+			room.requestSnapshotFromClients()
+			reply.Affected++
+		}
+	}
+	return reply
+}
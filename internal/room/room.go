@@ -3,15 +3,26 @@ package room
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"livescribble/internal/crdt"
+	"livescribble/internal/metrics"
+	"livescribble/internal/tracing"
 	"livescribble/internal/utils"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
@@ -20,21 +31,66 @@ const (
 	FrameSnapshot    = 0x02 // full snapshot (binary)
 	FrameAwareness   = 0x10 // text JSON presence
 	FrameControl     = 0x11 // join/leave etc. (JSON)
+	FrameComment     = 0x12 // comment thread changes (JSON), sent by the server only
 	FrameRequestSnap = 0x20 // server → client asks for snapshot
 
 	FrameSnapshotUpdateFailed  = 0x21 //Snapshot update failed
 	FrameSnapshotUpdateSuccess = 0x22 //Snapshot update success
 )
 
+// frameTypes names frame types for metrics.
+var frameTypes = map[byte]string{
+	FrameUpdate:                "update",
+	FrameSnapshot:              "snapshot",
+	FrameAwareness:             "awareness",
+	FrameControl:               "control",
+	FrameComment:               "comment",
+	FrameRequestSnap:           "request_snapshot",
+	FrameSnapshotUpdateFailed:  "snapshot_failed",
+	FrameSnapshotUpdateSuccess: "snapshot_saved",
+}
+
+func frameType(data []byte) string {
+	if len(data) == 0 {
+		return "empty"
+	}
+	if name, ok := frameTypes[data[0]]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// WebSocket close codes sent by the server.
+const (
+	CloseRoomClosed       = 4001 // the room was shut down, e.g. because its document was deleted
+	CloseServerRestarting = 4002 // the node is shutting down, reconnect to another one
+	CloseKicked           = 4003 // an admin removed the connection
+)
+
 type RedisMessage struct {
-	Type     string `json:"type"`
-	DocId    string `json:"docId"`
-	Data     []byte `json:"data"`
-	SenderId string `json:"senderId"` // connection ID to avoid echo
+	Type     string            `json:"type"`
+	DocId    string            `json:"docId"`
+	Data     []byte            `json:"data"`
+	SenderId string            `json:"senderId"`        // connection ID to avoid echo
+	Trace    map[string]string `json:"trace,omitempty"` // W3C trace context of the publishing span
+}
+
+type client struct {
+	id         string // connection ID
+	userId     string
+	readOnly   bool         // viewers and commenters may not change the document
+	logger     *slog.Logger // the room's logger with connId and userId
+	remoteAddr string
+	joined     time.Time
+
+	// gorilla/websocket allows one writer per connection at a time, the
+	// read loop, broadcasts and admin commands all write
+	writeMu sync.Mutex
 }
 
 type Room struct {
-	logger *slog.Logger
+	logger       *slog.Logger
+	writeTimeout time.Duration
 
 	docId string
 
@@ -43,10 +99,22 @@ type Room struct {
 	ctx         context.Context
 	cancelRedis context.CancelFunc
 
-	clients  map[*websocket.Conn]string // map connection to connection ID
+	clients  map[*websocket.Conn]*client
 	clientMu sync.RWMutex
 
 	onEmpty func(string)
+
+	onSaved   func(string)
+	saveMu    sync.Mutex
+	lastSaved [sha256.Size]byte // hash of the last snapshot saved from this node
+	savedAt   time.Time
+
+	// for the admin API, metrics has the node-wide totals
+	created   time.Time
+	framesIn  atomic.Uint64
+	framesOut atomic.Uint64
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
 }
 
 func NewRoom(docId string, db *gorm.DB, redisClient *redis.Client) *Room {
@@ -58,7 +126,8 @@ func NewRoom(docId string, db *gorm.DB, redisClient *redis.Client) *Room {
 		redisClient: redisClient,
 		ctx:         ctx,
 		cancelRedis: cancel,
-		clients:     make(map[*websocket.Conn]string),
+		clients:     make(map[*websocket.Conn]*client),
+		created:     time.Now(),
 	}
 
 	go r.subscribeToRedis()
@@ -70,60 +139,119 @@ func (r *Room) SetOnEmptyCallback(callback func(string)) {
 	r.onEmpty = callback
 }
 
-func (r *Room) AddClient(c *websocket.Conn) {
+// SetOnSavedCallback is called after a snapshot that differs from the last
+// one saved by this room has been stored.
+func (r *Room) SetOnSavedCallback(callback func(string)) {
+	r.onSaved = callback
+}
+
+func (r *Room) AddClient(c *websocket.Conn, userId string, readOnly bool) {
+	cl := &client{
+		id:         generateConnectionId(),
+		userId:     userId,
+		readOnly:   readOnly,
+		remoteAddr: c.RemoteAddr().String(),
+		joined:     time.Now(),
+	}
+	cl.logger = r.logger.With("connId", cl.id, "userId", userId)
 	r.clientMu.Lock()
-	connId := generateConnectionId()
-	r.clients[c] = connId
+	r.clients[c] = cl
 	r.clientMu.Unlock()
+	metrics.Connections.Inc()
+	cl.logger.Info("Client joined room", "readOnly", readOnly)
 
-	r.listenToClient(c)
+	r.listenToClient(c, cl)
 }
 
-func (r *Room) listenToClient(c *websocket.Conn) {
+func (r *Room) listenToClient(c *websocket.Conn, cl *client) {
 	defer func() {
 		r.removeClient(c)
 	}()
 
-	connId := r.clients[c]
+	connId := cl.id
 
 	for {
 		msgType, data, err := c.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				r.logger.Error("WebSocket error", "docId", r.docId, "error", err)
+				cl.logger.Error("WebSocket error", "error", err)
 			}
 			return
 		}
 		if msgType == websocket.BinaryMessage || msgType == websocket.TextMessage {
+			metrics.Frames.WithLabelValues(frameType(data), "in").Inc()
+			metrics.Bytes.WithLabelValues("in").Add(float64(len(data)))
+			r.framesIn.Add(1)
+			r.bytesIn.Add(uint64(len(data)))
+			if len(data) > 0 && !cl.maySend(data[0]) {
+				cl.logger.Debug("Dropped frame from client", "frame", data[0])
+				continue
+			}
+			ctx, span := r.startFrameSpan(data)
 			r.broadcastLocal(data, c)
 
-			r.broadcastToRedis(data, connId)
+			r.broadcastToRedis(ctx, data, connId)
 
 			if len(data) > 0 && data[0] == FrameSnapshot {
 				payload := data[1:]
-				if err := r.saveSnapshot(payload); err != nil {
-        			r.logger.Error("Failed to save snapshot", "docId", r.docId, "error", err, "payloadSize", len(payload))
+				if err := r.saveSnapshot(ctx, payload); err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "saving snapshot failed")
+					cl.logger.Error("Failed to save snapshot", "error", err, "payloadSize", len(payload))
 					errorMsg := []byte{FrameSnapshotUpdateFailed}
 					r.broadcastToSingle(errorMsg, c)
 					//in the frontend, ensure you await this message upon saving, to ensure that it has saved or not, also account for user spammign the save
 				} else {
 					r.broadcastToSingle([]byte{FrameSnapshotUpdateSuccess}, c)
+					r.snapshotSaved(payload)
 				}
 			}
+			span.End()
 		}
 	}
 }
+
+// startFrameSpan traces document updates and snapshots from a client. Other
+// frames, mostly awareness, are too chatty to trace and get no span.
+func (r *Room) startFrameSpan(data []byte) (context.Context, trace.Span) {
+	if len(data) == 0 || (data[0] != FrameUpdate && data[0] != FrameSnapshot) {
+		return r.ctx, trace.SpanFromContext(r.ctx)
+	}
+	return tracing.Tracer().Start(r.ctx, "room.frame "+frameType(data),
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("document.id", r.docId),
+			attribute.String("frame.type", frameType(data)),
+			attribute.Int("frame.size", len(data)),
+		))
+}
+
+// maySend reports whether the client is allowed to send a frame of this type.
+func (cl *client) maySend(frame byte) bool {
+	switch frame {
+	case FrameUpdate, FrameSnapshot:
+		return !cl.readOnly
+	case FrameComment, FrameSnapshotUpdateFailed, FrameSnapshotUpdateSuccess:
+		return false
+	}
+	return true
+}
+
 func (r *Room) broadcastLocal(data []byte, sender *websocket.Conn) {
+	start := time.Now()
 	r.clientMu.RLock()
 	defer r.clientMu.RUnlock()
+	defer func() {
+		metrics.BroadcastDuration.Observe(time.Since(start).Seconds())
+	}()
 
-	for c := range r.clients {
+	for c, cl := range r.clients {
 		if c == sender {
 			continue
 		}
-		_ = c.SetWriteDeadline(time.Now().Add(time.Second * 5))
-		if err := c.WriteMessage(websocket.BinaryMessage, data); err != nil {
-			r.removeClient(c)
+		if err := r.write(c, cl, data); err != nil {
+			go r.removeClient(c)
 		}
 	}
 }
@@ -131,29 +259,105 @@ func (r *Room) broadcastToSingle(data []byte, recipient *websocket.Conn) {
 	r.clientMu.RLock()
 	defer r.clientMu.RUnlock()
 
-	_ = recipient.SetWriteDeadline(time.Now().Add(time.Second * 5))
-	if err := recipient.WriteMessage(websocket.BinaryMessage, data); err != nil {
-		r.removeClient(recipient)
+	cl, ok := r.clients[recipient]
+	if !ok {
+		return
+	}
+	if err := r.write(recipient, cl, data); err != nil {
+		go r.removeClient(recipient)
 	}
 }
 func (r *Room) requestSnapshotFromClients() {
 	r.clientMu.RLock()
 	defer r.clientMu.RUnlock()
 
-	for c := range r.clients {
-		_ = c.SetWriteDeadline(time.Now().Add(time.Second * 5))
-		if err := c.WriteMessage(websocket.BinaryMessage, []byte{FrameRequestSnap}); err != nil {
-			r.removeClient(c)
+	for c, cl := range r.clients {
+		if err := r.write(c, cl, []byte{FrameRequestSnap}); err != nil {
+			go r.removeClient(c)
 		}
 	}
 }
-func (r *Room) saveSnapshot(payload []byte) error {
-	return r.db.Model(&utils.Document{}).Where("id = ?", r.docId).Update("content", payload).Error
+
+// write sends one binary frame to a client and counts it.
+func (r *Room) write(c *websocket.Conn, cl *client, data []byte) error {
+	cl.writeMu.Lock()
+	_ = c.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+	err := c.WriteMessage(websocket.BinaryMessage, data)
+	cl.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	metrics.Frames.WithLabelValues(frameType(data), "out").Inc()
+	metrics.Bytes.WithLabelValues("out").Add(float64(len(data)))
+	r.framesOut.Add(1)
+	r.bytesOut.Add(uint64(len(data)))
+	return nil
+}
+
+func (r *Room) saveSnapshot(ctx context.Context, payload []byte) error {
+	ctx, span := tracing.Tracer().Start(ctx, "room.saveSnapshot", trace.WithAttributes(
+		attribute.String("document.id", r.docId),
+		attribute.Int("snapshot.size", len(payload)),
+	))
+	defer span.End()
+	start := time.Now()
+	defer func() {
+		metrics.SnapshotSaveDuration.Observe(time.Since(start).Seconds())
+	}()
+	metrics.SnapshotSize.Observe(float64(len(payload)))
+
+	updates := map[string]interface{}{
+		"content": payload,
+		"updated": time.Now(),
+	}
+	// keep the search index in step with the snapshot, an undecodable
+	// snapshot still saves but leaves the previous text in place
+	if text, err := snapshotText(payload); err == nil {
+		updates["search_text"] = text
+	} else {
+		r.logger.Warn("Failed to extract snapshot text", "error", err)
+	}
+	return r.db.WithContext(ctx).Model(&utils.Document{}).Where("id = ?", r.docId).Updates(updates).Error
+}
+
+// snapshotText extracts the plain text of a snapshot. The snapshot comes
+// straight from a client, so a decoder bug it trips is turned into an error
+// instead of taking the node down.
+func snapshotText(payload []byte) (text string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("crdt: decoder panic: %v", p)
+		}
+	}()
+	doc, err := crdt.DecodeSnapshot(string(payload))
+	if err != nil {
+		return "", err
+	}
+	return doc.PlainText(), nil
+}
+
+// snapshotSaved runs the saved callback unless the snapshot is the same as
+// the previous one, which is what the periodic snapshot requests mostly get.
+func (r *Room) snapshotSaved(payload []byte) {
+	sum := sha256.Sum256(payload)
+	r.saveMu.Lock()
+	changed := sum != r.lastSaved
+	r.lastSaved = sum
+	r.savedAt = time.Now()
+	r.saveMu.Unlock()
+
+	if changed && r.onSaved != nil {
+		go r.onSaved(r.docId)
+	}
 }
 
 func (r *Room) removeClient(c *websocket.Conn) {
 	r.clientMu.Lock()
 	defer r.clientMu.Unlock()
+	if cl, ok := r.clients[c]; ok {
+		metrics.Connections.Dec()
+		cl.logger.Info("Client left room")
+	}
 	delete(r.clients, c)
 	_ = c.Close()
 
@@ -167,19 +371,128 @@ func (r *Room) removeClient(c *websocket.Conn) {
 	}
 }
 
+// savedSince reports whether the room has stored a snapshot after t, or has
+// no client that could send one.
+func (r *Room) savedSince(t time.Time) bool {
+	r.saveMu.Lock()
+	saved := r.savedAt.After(t)
+	r.saveMu.Unlock()
+	if saved {
+		return true
+	}
+	r.clientMu.RLock()
+	defer r.clientMu.RUnlock()
+	for _, cl := range r.clients {
+		if !cl.readOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// closeAll tells every local client why the room is going away, then closes
+// their sockets with code. Their read loops remove them and tear the room
+// down.
+func (r *Room) closeAll(code int, reason string) {
+	frame := controlFrame("room_closed", reason)
+
+	r.clientMu.RLock()
+	defer r.clientMu.RUnlock()
+	for c, cl := range r.clients {
+		r.closeClient(c, cl, frame, code, reason)
+	}
+}
+
+// kick closes the connection connId, or every connection of userId, with
+// CloseKicked and returns how many were closed.
+func (r *Room) kick(connId string, userId string, reason string) int {
+	if connId == "" && userId == "" {
+		return 0
+	}
+	frame := controlFrame("kicked", reason)
+
+	r.clientMu.RLock()
+	defer r.clientMu.RUnlock()
+	kicked := 0
+	for c, cl := range r.clients {
+		if (connId != "" && cl.id != connId) || (userId != "" && cl.userId != userId) {
+			continue
+		}
+		cl.logger.Info("Kicking client", "reason", reason)
+		r.closeClient(c, cl, frame, CloseKicked, reason)
+		kicked++
+	}
+	return kicked
+}
+
+// closeClient sends frame, then closes the socket with code. The client's
+// read loop removes it from the room.
+func (r *Room) closeClient(c *websocket.Conn, cl *client, frame []byte, code int, reason string) {
+	_ = r.write(c, cl, frame)
+	// WriteControl may run alongside a write, the lock only keeps the
+	// close after the frame
+	cl.writeMu.Lock()
+	_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	cl.writeMu.Unlock()
+	_ = c.Close()
+}
+
+// controlFrame is a FrameControl telling clients why they are disconnected.
+func controlFrame(kind string, reason string) []byte {
+	frame, _ := json.Marshal(map[string]string{
+		"type":   kind,
+		"reason": reason,
+	})
+	return append([]byte{FrameControl}, frame...)
+}
+
+// info is the room's state for the admin API.
+func (r *Room) info() RoomInfo {
+	info := RoomInfo{
+		DocId:     r.docId,
+		Created:   r.created,
+		FramesIn:  r.framesIn.Load(),
+		FramesOut: r.framesOut.Load(),
+		BytesIn:   r.bytesIn.Load(),
+		BytesOut:  r.bytesOut.Load(),
+	}
+	r.saveMu.Lock()
+	if !r.savedAt.IsZero() {
+		savedAt := r.savedAt
+		info.SavedAt = &savedAt
+	}
+	r.saveMu.Unlock()
+
+	r.clientMu.RLock()
+	defer r.clientMu.RUnlock()
+	info.Clients = make([]ClientInfo, 0, len(r.clients))
+	for _, cl := range r.clients {
+		info.Clients = append(info.Clients, ClientInfo{
+			ConnId:     cl.id,
+			UserId:     cl.userId,
+			ReadOnly:   cl.readOnly,
+			RemoteAddr: cl.remoteAddr,
+			Joined:     cl.joined,
+		})
+	}
+	return info
+}
+
 func generateConnectionId() string {
 	bytes := make([]byte, 8)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
 
-func (r *Room) broadcastToRedis(data []byte, senderConnId string) {
+func (r *Room) broadcastToRedis(ctx context.Context, data []byte, senderConnId string) {
 	msg := RedisMessage{
 		Type:     "broadcast",
 		DocId:    r.docId,
 		Data:     data,
 		SenderId: senderConnId,
+		Trace:    propagation.MapCarrier{},
 	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Trace))
 
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
@@ -188,8 +501,9 @@ func (r *Room) broadcastToRedis(data []byte, senderConnId string) {
 	}
 
 	channel := "room:" + r.docId
-	if err := r.redisClient.Publish(r.ctx, channel, msgBytes).Err(); err != nil {
-		r.logger.Error("Failed to publish to Redis", "error", err)
+	if err := r.redisClient.Publish(ctx, channel, msgBytes).Err(); err != nil {
+		metrics.RedisPublishErrors.Inc()
+		r.logger.ErrorContext(ctx, "Failed to publish to Redis", "error", err)
 	}
 }
 
@@ -210,8 +524,11 @@ func (r *Room) subscribeToRedis() {
 			}
 
 			// Don't broadcast back to local clients if this server sent it
-			if redisMsg.Type == "broadcast" && !r.isLocalSender(redisMsg.SenderId){
-				r.broadcastFromRedis(redisMsg.Data)
+			if redisMsg.Type == "broadcast" && !r.isLocalSender(redisMsg.SenderId) {
+				r.broadcastFromRedis(&redisMsg)
+			}
+			if redisMsg.Type == "close" {
+				r.closeAll(CloseRoomClosed, string(redisMsg.Data))
 			}
 
 		case <-r.ctx.Done():
@@ -221,23 +538,42 @@ func (r *Room) subscribeToRedis() {
 }
 
 func (r *Room) isLocalSender(senderId string) bool {
-    r.clientMu.RLock()
-    defer r.clientMu.RUnlock()
-    
-    for _, connId := range r.clients {
-        if connId == senderId {
-            return true
-        }
-    }
-    return false
-}
-func (r *Room) broadcastFromRedis(data []byte) {
 	r.clientMu.RLock()
 	defer r.clientMu.RUnlock()
 
-	for c := range r.clients {
-		_ = c.SetWriteDeadline(time.Now().Add(time.Second * 5))
-		if err := c.WriteMessage(websocket.BinaryMessage, data); err != nil {
+	for _, cl := range r.clients {
+		if cl.id == senderId {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastFromRedis fans a message from another node out to the local
+// clients. Its span links to the publishing node's span, if any.
+func (r *Room) broadcastFromRedis(msg *RedisMessage) {
+	data := msg.Data
+	remote := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(r.ctx, propagation.MapCarrier(msg.Trace)))
+	if remote.IsValid() {
+		_, span := tracing.Tracer().Start(r.ctx, "room.fanout "+frameType(data),
+			trace.WithNewRoot(),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithLinks(trace.Link{SpanContext: remote}),
+			trace.WithAttributes(
+				attribute.String("document.id", r.docId),
+				attribute.String("frame.type", frameType(data)),
+			))
+		defer span.End()
+	}
+	start := time.Now()
+	r.clientMu.RLock()
+	defer r.clientMu.RUnlock()
+	defer func() {
+		metrics.BroadcastDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	for c, cl := range r.clients {
+		if err := r.write(c, cl, data); err != nil {
 			go r.removeClient(c)
 		}
 	}
@@ -1,8 +1,12 @@
 package room
 
 import (
+	"context"
+	"encoding/json"
+	"livescribble/internal/metrics"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,41 +15,73 @@ import (
 )
 
 type RoomManager struct {
+	*Cluster
+
 	logger      *slog.Logger
 	db          *gorm.DB
 	redisClient *redis.Client
 	rooms       map[string]*Room
 	roomMu      sync.RWMutex
+
+	writeTimeout     time.Duration // for every frame written to a client
+	snapshotInterval time.Duration // how often rooms are asked for a snapshot
+
+	onSnapshotSaved func(string)
+	draining        atomic.Bool
+
+	nodeID string // this process in admin replies and the cluster:nodes set
 }
 
-func NewRoomManager(db *gorm.DB, logger *slog.Logger, redisClient *redis.Client) *RoomManager {
+func NewRoomManager(db *gorm.DB, logger *slog.Logger, redisClient *redis.Client, writeTimeout time.Duration, snapshotInterval time.Duration) *RoomManager {
 	rm := &RoomManager{
-		logger:      logger,
-		db:          db,
-		redisClient: redisClient,
-		rooms:       make(map[string]*Room),
+		Cluster:          NewCluster(redisClient, logger),
+		logger:           logger,
+		db:               db,
+		redisClient:      redisClient,
+		rooms:            make(map[string]*Room),
+		writeTimeout:     writeTimeout,
+		snapshotInterval: snapshotInterval,
+		nodeID:           newNodeID(),
 	}
 
 	go rm.startPeriodicSnapshotRequests()
+	go rm.heartbeat()
+	go rm.listenForCommands()
 
 	return rm
 }
 
-func (rm *RoomManager) JoinRoom(docId string, conn *websocket.Conn) {
+// JoinRoom adds userId's connection to the document's room. Read-only
+// clients receive everything but their updates and snapshots are dropped.
+func (rm *RoomManager) JoinRoom(docId string, userId string, conn *websocket.Conn, readOnly bool) {
 	rm.roomMu.Lock()
 	defer rm.roomMu.Unlock()
 
+	if rm.draining.Load() {
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseServerRestarting, "server restarting"), time.Now().Add(time.Second))
+		_ = conn.Close()
+		return
+	}
+
 	room, exists := rm.rooms[docId]
 	if !exists {
 		room = NewRoom(docId, rm.db, rm.redisClient)
-		room.logger = rm.logger
+		room.logger = rm.logger.With("docId", docId)
+		room.writeTimeout = rm.writeTimeout
 		room.SetOnEmptyCallback(rm.RemoveRoom)
+		room.SetOnSavedCallback(rm.onSnapshotSaved)
 		rm.rooms[docId] = room
-		rm.logger.Info("Created new room", "docId", docId)
+		metrics.Rooms.Inc()
+		room.logger.Info("Created new room")
 	}
 
-	go room.AddClient(conn)
-	rm.logger.Info("Client joined room", "docId", docId)
+	go room.AddClient(conn, userId, readOnly)
+}
+
+// SetOnSnapshotSavedCallback is called with the document ID whenever a room
+// saves a changed snapshot. Set it before the first client joins.
+func (rm *RoomManager) SetOnSnapshotSavedCallback(callback func(string)) {
+	rm.onSnapshotSaved = callback
 }
 
 func (rm *RoomManager) RemoveRoom(docId string) {
@@ -60,11 +96,86 @@ func (rm *RoomManager) RemoveRoom(docId string) {
 
 		if clientCount == 0 {
 			delete(rm.rooms, docId)
+			metrics.Rooms.Dec()
 			rm.logger.Info("Removed empty room", "docId", docId)
 		}
 	}
 }
 
+// PublishComment sends a FrameComment with event as its JSON payload to
+// everyone in the document's room, on every node.
+func (rm *RoomManager) PublishComment(docId string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		rm.logger.Error("Failed to marshal comment event", "error", err)
+		return
+	}
+	msg, err := json.Marshal(RedisMessage{
+		Type:  "broadcast",
+		DocId: docId,
+		Data:  append([]byte{FrameComment}, payload...),
+	})
+	if err != nil {
+		rm.logger.Error("Failed to marshal Redis message", "error", err)
+		return
+	}
+	if err := rm.redisClient.Publish(context.Background(), "room:"+docId, msg).Err(); err != nil {
+		metrics.RedisPublishErrors.Inc()
+		rm.logger.Error("Failed to publish comment event", "docId", docId, "error", err)
+	}
+}
+
+// Draining reports whether Drain has started. New clients should be turned
+// away before their connection is upgraded.
+func (rm *RoomManager) Draining() bool {
+	return rm.draining.Load()
+}
+
+// Drain empties the node before shutdown. It stops taking clients, asks
+// every room for a snapshot and waits until each has saved one or ctx ends,
+// then closes all sockets with CloseServerRestarting.
+func (rm *RoomManager) Drain(ctx context.Context) {
+	rm.roomMu.Lock()
+	rm.draining.Store(true)
+	rooms := make([]*Room, 0, len(rm.rooms))
+	for _, room := range rm.rooms {
+		rooms = append(rooms, room)
+	}
+	rm.roomMu.Unlock()
+
+	requested := time.Now()
+	for _, room := range rooms {
+		room.requestSnapshotFromClients()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for {
+		pending := 0
+		for _, room := range rooms {
+			if !room.savedSince(requested) {
+				pending++
+			}
+		}
+		if pending == 0 {
+			rm.logger.Info("Saved snapshots of all rooms", "rooms", len(rooms))
+			break
+		}
+		select {
+		case <-ctx.Done():
+			rm.logger.Warn("Gave up waiting for snapshots", "pending", pending, "rooms", len(rooms))
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	for _, room := range rooms {
+		room.closeAll(CloseServerRestarting, "server restarting")
+	}
+	rm.leaveCluster()
+}
+
 func (rm *RoomManager) GetRoomCount() int {
 	rm.roomMu.RLock()
 	defer rm.roomMu.RUnlock()
@@ -72,7 +183,7 @@ func (rm *RoomManager) GetRoomCount() int {
 }
 
 func (rm *RoomManager) startPeriodicSnapshotRequests() {
-	ticker := time.NewTicker(30 * time.Second) // Request snapshots every 30 seconds
+	ticker := time.NewTicker(rm.snapshotInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -2,18 +2,144 @@ package utils
 
 import "time"
 
+// TempUserPrefix starts the ID of every temporary account. Their email is
+// set to the ID, so it is not an address.
+const TempUserPrefix = "temp"
+
 type User struct {
-	ID       string `gorm:"primary_key;not null;unique" json:"id"`
-	Email    string `gorm:"not null;unique" json:"email"`
-	Password string `gorm:"not null" json:"password"`
+	ID        string    `gorm:"primary_key;not null;unique" json:"id"`
+	Email     string    `gorm:"not null;unique" json:"email"`
+	Password  string    `gorm:"not null" json:"password"`
 	DeletedAt time.Time `gorm:"default:null" json:"deleted_at"`
+
+	TOTPSecret  string `gorm:"default:null" json:"-"`
+	TOTPEnabled bool   `gorm:"not null;default:false" json:"totp_enabled"`
+
+	SessionsValidAfter time.Time `gorm:"default:null" json:"-"` // session tokens issued earlier are rejected
+
+	Admin    bool `gorm:"not null;default:false" json:"admin"`
+	Disabled bool `gorm:"not null;default:false" json:"disabled"` // set by an operator, blocks logins, sessions and API keys
 }
 
 type Document struct {
-	ID      string    `gorm:"primary_key;not null;unique" json:"id"`
-	UserID  string    `gorm:"not null" json:"user_id"`
-	Content string    `gorm:"type:text;not null" json:"content"`
-	Updated time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated"`
-	Created time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
-	Access  string    `gorm:"type:jsonb;not null" json:"access"`
+	ID       string    `gorm:"primary_key;not null;unique" json:"id"`
+	UserID   string    `gorm:"not null" json:"user_id"`
+	FolderID *string   `gorm:"default:null;index" json:"folder_id"`
+	Title    string    `gorm:"not null;default:''" json:"title"`
+	Content  string    `gorm:"type:text;not null" json:"content"`
+	Updated  time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated"`
+	Created  time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
+	Access   string    `gorm:"type:jsonb;not null" json:"access"`
+
+	SearchText string `gorm:"type:text;not null;default:''" json:"-"` // plain text of the last snapshot, feeds search_vector
+
+	TrashedAt *time.Time `gorm:"default:null;index" json:"trashed_at"` // set while the document sits in its owner's trash
+
+	Template string `gorm:"not null;default:'';index" json:"template"` // "", "personal" or "global"
+}
+
+type APIKey struct {
+	ID         string     `gorm:"primary_key;not null;unique" json:"id"`
+	UserID     string     `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	Hash       string     `gorm:"not null;unique" json:"-"`
+	Scopes     string     `gorm:"type:jsonb;not null" json:"scopes"`
+	ExpiresAt  *time.Time `gorm:"default:null" json:"expires_at"`
+	LastUsedAt *time.Time `gorm:"default:null" json:"last_used_at"`
+	Created    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
+}
+
+type RecoveryCode struct {
+	ID     uint       `gorm:"primaryKey" json:"id"`
+	UserID string     `gorm:"not null;index" json:"user_id"`
+	Hash   string     `gorm:"not null" json:"-"`
+	UsedAt *time.Time `gorm:"default:null" json:"used_at"`
+}
+
+type Folder struct {
+	ID       string    `gorm:"primary_key;not null;unique" json:"id"`
+	UserID   string    `gorm:"not null;index" json:"user_id"`
+	ParentID *string   `gorm:"default:null;index" json:"parent_id"`
+	Name     string    `gorm:"not null" json:"name"`
+	Access   string    `gorm:"type:jsonb;not null" json:"access"` // same format as Document.Access, inherited by everything inside
+	Updated  time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated"`
+	Created  time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
+}
+
+// CommentThread is a discussion anchored to a range of a document.
+type CommentThread struct {
+	ID         string     `gorm:"primary_key;not null;unique" json:"id"`
+	DocumentID string     `gorm:"not null;index" json:"document_id"`
+	UserID     string     `gorm:"not null" json:"user_id"`
+	Anchor     string     `gorm:"type:jsonb;not null" json:"anchor"` // Yjs relative positions of the range, opaque to the server
+	ResolvedAt *time.Time `gorm:"default:null" json:"resolved_at"`
+	ResolvedBy *string    `gorm:"default:null" json:"resolved_by"`
+	Created    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
+
+	Comments []Comment `gorm:"foreignKey:ThreadID;constraint:OnDelete:CASCADE" json:"comments,omitempty"`
+}
+
+type Comment struct {
+	ID       string     `gorm:"primary_key;not null;unique" json:"id"`
+	ThreadID string     `gorm:"not null;index" json:"thread_id"`
+	UserID   string     `gorm:"not null" json:"user_id"`
+	Body     string     `gorm:"type:text;not null" json:"body"`
+	EditedAt *time.Time `gorm:"default:null" json:"edited_at"`
+	Created  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
+}
+
+type Notification struct {
+	ID         string     `gorm:"primary_key;not null;unique" json:"id"`
+	UserID     string     `gorm:"not null;index" json:"user_id"`
+	Type       string     `gorm:"not null" json:"type"` // "mention" or "share"
+	ActorID    string     `gorm:"not null" json:"actor_id"`
+	DocumentID *string    `gorm:"default:null" json:"document_id"`
+	FolderID   *string    `gorm:"default:null" json:"folder_id"`
+	ThreadID   *string    `gorm:"default:null" json:"thread_id"`
+	Message    string     `gorm:"not null" json:"message"`
+	ReadAt     *time.Time `gorm:"default:null" json:"read_at"`
+	EmailedAt  *time.Time `gorm:"default:null" json:"-"` // set once the notification went out in a digest, or its user has no address
+	Created    time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created"`
+}
+
+// Webhook posts document events to URL. With DocumentID set it fires for that
+// document only, otherwise for every document the user owns.
+type Webhook struct {
+	ID         string    `gorm:"primary_key;not null;unique" json:"id"`
+	UserID     string    `gorm:"not null;index" json:"user_id"`
+	DocumentID *string   `gorm:"default:null;index" json:"document_id"`
+	URL        string    `gorm:"not null" json:"url"`
+	Secret     string    `gorm:"not null" json:"-"` // HMAC-SHA256 key for the signature header
+	Events     string    `gorm:"type:jsonb;not null" json:"events"`
+	Created    time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created"`
+}
+
+type WebhookDelivery struct {
+	ID            string     `gorm:"primary_key;not null;unique" json:"id"`
+	WebhookID     string     `gorm:"not null;index" json:"webhook_id"`
+	Event         string     `gorm:"not null" json:"event"`
+	Payload       string     `gorm:"type:text;not null" json:"payload"`
+	Status        string     `gorm:"not null;index" json:"status"` // "pending", "succeeded" or "failed"
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	ResponseCode  int        `gorm:"not null;default:0" json:"response_code"`
+	Error         string     `gorm:"type:text;not null;default:''" json:"error"`
+	NextAttemptAt *time.Time `gorm:"default:null;index" json:"next_attempt_at"`
+	DeliveredAt   *time.Time `gorm:"default:null" json:"delivered_at"`
+	Created       time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created"`
+}
+
+// AuditEvent records who did what. Rows are never updated or deleted, a
+// trigger added by the migration rejects both.
+type AuditEvent struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Action     string    `gorm:"not null;index" json:"action"`              // e.g. "auth.login", "document.shared"
+	ActorID    string    `gorm:"not null;default:'';index" json:"actor_id"` // empty for the system
+	DocumentID *string   `gorm:"default:null;index" json:"document_id"`
+	TargetID   *string   `gorm:"default:null" json:"target_id"`             // user, folder or key acted upon
+	Outcome    string    `gorm:"not null;default:'success'" json:"outcome"` // "success" or "failure"
+	IP         string    `gorm:"not null;default:''" json:"ip"`
+	UserAgent  string    `gorm:"not null;default:''" json:"user_agent"`
+	RequestID  string    `gorm:"not null;default:''" json:"request_id"`
+	Data       string    `gorm:"type:jsonb;not null;default:'{}'" json:"data"`
+	Created    time.Time `gorm:"default:CURRENT_TIMESTAMP;index" json:"created"`
 }
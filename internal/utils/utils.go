@@ -3,9 +3,6 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"fmt"
-	"os"
-	"strconv"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -18,23 +15,11 @@ func RandomString(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes)[:length], nil
 }
 
-func NewRedisClient() (*redis.Client, error) {
-	Addr := os.Getenv("REDIS_ADDR")
-	if Addr == "" {
-		return nil, fmt.Errorf("REDIS_ADDR environment variable not set")
-	}
-	Password := os.Getenv("REDIS_PW")
-	if Password == "" {
-		fmt.Printf("REDIS_PW environment variable not set")
-	}
-	DB, err := strconv.Atoi(os.Getenv("REDIS_DB"))
-	if err != nil {
-		return nil, fmt.Errorf("REDIS_DB environment variable not set or is invalid")
-	}
+func NewRedisClient(addr string, password string, db int) *redis.Client {
 	return redis.NewClient(
 		&redis.Options{
-			Addr:     Addr,
-			Password: Password,
-			DB:       DB,
-		}), nil
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		})
 }
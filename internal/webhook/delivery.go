@@ -0,0 +1,395 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"livescribble/internal/utils"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+
+	deliveryTimeout  = 10 * time.Second
+	deliveryLease    = 2 * time.Minute // a claimed delivery is retried after this if its node dies
+	deliveryBatch    = 20
+	pollInterval     = 5 * time.Second
+	deliveryLogLimit = 100
+	logRetention     = 30 * 24 * time.Hour
+
+	maxErrorLength = 500
+)
+
+// retryBackoff is the wait before each retry. A delivery that still fails
+// after the last one is marked failed and only goes out again on redelivery.
+var retryBackoff = []time.Duration{
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+}
+
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// deniedPrefixes are non-public ranges the net.IP checks in publicAddress
+// do not cover.
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, reaches any IPv4 address
+}
+
+// publicAddress reports whether a webhook may connect to ip. IPv4-mapped
+// IPv6 addresses are checked as the IPv4 address they stand for.
+func publicAddress(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	for _, prefix := range deniedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// newClient is an HTTP client that does not follow redirects and, unless
+// allowPrivate is set, refuses to connect to non-public addresses. The check
+// runs on the resolved address so DNS cannot be used to get around it.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(net.ParseIP(host)) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: deliveryTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Sign is the X-LiveScribble-Signature of a delivery: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret, prefixed "sha256=".
+// Receivers should recompute it and reject stale timestamps.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Handler) queue(webhookID string, event string, payload string, at time.Time) error {
+	id, err := utils.RandomString(10)
+	if err != nil {
+		return err
+	}
+	return h.db.Create(&utils.WebhookDelivery{
+		ID:            id,
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        StatusPending,
+		NextAttemptAt: &at,
+		Created:       time.Now(),
+	}).Error
+}
+
+// wakeUp makes the worker look for due deliveries now instead of at its next
+// poll.
+func (h *Handler) wakeUp() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// StartDeliveries sends due deliveries until the process exits and prunes
+// the delivery log once an hour. It also raises document.updated once a
+// document's debounce has run out. Any number of nodes can run it, each
+// delivery and update is claimed by one. It blocks, run it in a goroutine.
+func (h *Handler) StartDeliveries() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+
+	for {
+		for {
+			popped, err := h.emitDueUpdates()
+			if err != nil {
+				h.logger.Error("Failed to raise document updates", "error", err)
+			}
+			if popped < deliveryBatch {
+				break
+			}
+		}
+		for {
+			claimed, err := h.deliverDue()
+			if err != nil {
+				h.logger.Error("Failed to send webhook deliveries", "error", err)
+			}
+			if claimed < deliveryBatch {
+				break
+			}
+		}
+		if time.Since(lastPrune) > time.Hour {
+			lastPrune = time.Now()
+			if err := h.db.Where("created < ? AND status <> ?", time.Now().Add(-logRetention), StatusPending).
+				Delete(&utils.WebhookDelivery{}).Error; err != nil {
+				h.logger.Error("Failed to prune webhook deliveries", "error", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-h.wake:
+		}
+	}
+}
+
+// deliverDue claims a batch of due deliveries by pushing their next attempt
+// past the lease, then sends them concurrently.
+func (h *Handler) deliverDue() (int, error) {
+	var deliveries []utils.WebhookDelivery
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(utils.WebhookDelivery{}).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", StatusPending, time.Now()).
+			Order("next_attempt_at").Limit(deliveryBatch).Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+		ids := make([]string, 0, len(deliveries))
+		for _, d := range deliveries {
+			ids = append(ids, d.ID)
+		}
+		return tx.Model(utils.WebhookDelivery{}).Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(deliveryLease)).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range deliveries {
+		wg.Add(1)
+		go func(d *utils.WebhookDelivery) {
+			defer wg.Done()
+			h.deliver(d)
+		}(&deliveries[i])
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// deliver makes one attempt and records its outcome.
+func (h *Handler) deliver(d *utils.WebhookDelivery) {
+	var hook utils.Webhook
+	if err := h.db.Model(utils.Webhook{}).Where("id = ?", d.WebhookID).First(&hook).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			h.logger.Error("Failed to load webhook", "error", err, "webhookId", d.WebhookID)
+			return
+		}
+		d.Status = StatusFailed
+		d.Error = "webhook deleted"
+		d.NextAttemptAt = nil
+		h.saveAttempt(d)
+		return
+	}
+
+	d.Attempts++
+	d.ResponseCode, d.Error = h.post(&hook, d)
+	now := time.Now()
+	switch {
+	case d.Error == "":
+		d.Status = StatusSucceeded
+		d.DeliveredAt = &now
+		d.NextAttemptAt = nil
+	case d.Attempts > len(retryBackoff):
+		d.Status = StatusFailed
+		d.NextAttemptAt = nil
+	default:
+		next := now.Add(retryBackoff[d.Attempts-1])
+		d.NextAttemptAt = &next
+	}
+	h.saveAttempt(d)
+}
+
+// post sends the delivery and returns the response status and, unless it
+// was a 2xx, what went wrong.
+func (h *Handler) post(hook *utils.Webhook, d *utils.WebhookDelivery) (int, string) {
+	body := []byte(d.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, truncate(err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "LiveScribble-Webhook/1")
+	req.Header.Set("X-LiveScribble-Event", d.Event)
+	req.Header.Set("X-LiveScribble-Delivery", d.ID)
+	req.Header.Set("X-LiveScribble-Timestamp", timestamp)
+	req.Header.Set("X-LiveScribble-Signature", Sign(hook.Secret, timestamp, body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, truncate(err.Error())
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, ""
+}
+
+func (h *Handler) saveAttempt(d *utils.WebhookDelivery) {
+	err := h.db.Model(d).
+		Select("status", "attempts", "response_code", "error", "next_attempt_at", "delivered_at").
+		Updates(d).Error
+	if err != nil {
+		h.logger.Error("Failed to record webhook delivery", "error", err, "deliveryId", d.ID)
+	}
+}
+
+// ListDeliveries is a webhook's delivery log, newest first. status narrows
+// it to pending, succeeded or failed deliveries.
+func (h *Handler) ListDeliveries(ctx *gin.Context) {
+	hook, ok := h.loadWebhook(ctx)
+	if !ok {
+		return
+	}
+	query := h.db.Model(utils.WebhookDelivery{}).Where("webhook_id = ?", hook.ID)
+	switch status := ctx.Query("status"); status {
+	case "":
+	case StatusPending, StatusSucceeded, StatusFailed:
+		query = query.Where("status = ?", status)
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "status must be pending, succeeded or failed",
+		})
+		return
+	}
+
+	deliveries := make([]utils.WebhookDelivery, 0)
+	if err := query.Order("created DESC").Limit(deliveryLogLimit).Find(&deliveries).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list webhook deliveries", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving deliveries",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+	})
+}
+
+// Redeliver queues a fresh delivery of an earlier payload, whatever became
+// of the original.
+func (h *Handler) Redeliver(ctx *gin.Context) {
+	hook, ok := h.loadWebhook(ctx)
+	if !ok {
+		return
+	}
+	var original utils.WebhookDelivery
+	err := h.db.Model(utils.WebhookDelivery{}).
+		Where("id = ? AND webhook_id = ?", ctx.Param("delivery_id"), hook.ID).
+		First(&original).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"message": "delivery not found",
+			})
+		} else {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to load webhook delivery", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error redelivering",
+			})
+		}
+		return
+	}
+	if err := h.queue(hook.ID, original.Event, original.Payload, time.Now()); err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to queue webhook delivery", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error redelivering",
+		})
+		return
+	}
+	h.wakeUp()
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "delivery queued",
+	})
+}
+
+func (h *Handler) loadWebhook(ctx *gin.Context) (*utils.Webhook, bool) {
+	var hook utils.Webhook
+	err := h.db.Model(utils.Webhook{}).
+		Where("id = ? AND user_id = ?", ctx.Param("webhook_id"), ctx.GetString("current_user")).
+		First(&hook).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"message": "webhook not found",
+			})
+		} else {
+			h.logger.ErrorContext(ctx.Request.Context(), "Failed to load webhook", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message": "error retrieving webhook",
+			})
+		}
+		return nil, false
+	}
+	return &hook, true
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+	return s
+}
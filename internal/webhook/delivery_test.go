@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"document.created"}`)
+	// computed independently with Python's hmac module
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		want      string
+	}{
+		{"delivery", "secret", "1700000000", body, "sha256=758f2ed0e4246adee918edccbcc08156a0553e6fa495fed2f3d7f80f81524c45"},
+		{"other secret", "other", "1700000000", body, "sha256=00022933be920061f0d1d5b91efd3b12541ae89a3f3ca3d1d9491d61c4e7a9bb"},
+		{"empty body", "secret", "1700000000", nil, "sha256=4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign(tt.secret, tt.timestamp, tt.body); got != tt.want {
+				t.Errorf("Sign() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// the timestamp is signed too, so a body cannot be replayed under a
+	// fresh one
+	if Sign("secret", "1700000000", body) == Sign("secret", "1700000001", body) {
+		t.Error("Sign ignores the timestamp")
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"192.0.0.170", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"::1", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::5db8:d822", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := publicAddress(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("publicAddress(%s) = %t, want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+	if publicAddress(nil) {
+		t.Error("publicAddress(nil) = true")
+	}
+}
@@ -0,0 +1,319 @@
+// Package webhook posts document events to user-registered URLs. Every
+// event is stored as a delivery first, then sent by a background worker
+// that signs the body, retries failures with backoff and keeps the outcome
+// for the delivery log.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"livescribble/internal/document"
+	"livescribble/internal/utils"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	maxWebhooksPerUser = 20
+
+	// updateDebounce is how long document.updated waits for more saves.
+	// Every save restarts the wait, so a burst of saves is folded into one
+	// event sent once the document has been quiet this long.
+	updateDebounce = 5 * time.Minute
+
+	// pendingUpdates is a sorted set of documents with a document.updated
+	// waiting to go out, scored by when it is due in unix milliseconds
+	pendingUpdates = "webhook:updated"
+)
+
+// popDueUpdates removes and returns the documents whose document.updated is
+// due. Doing both in one script means a save landing in between cannot be
+// lost, and only one node gets each document.
+var popDueUpdates = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+if #due > 0 then
+	redis.call('ZREM', KEYS[1], unpack(due))
+end
+return due
+`)
+
+type Handler struct {
+	db          *gorm.DB
+	redisClient *redis.Client
+	logger      *slog.Logger
+	client      *http.Client
+	wake        chan struct{}
+}
+
+// NewHandler creates the handler. Unless allowPrivate is set, deliveries to
+// loopback, private and link-local addresses are refused so webhooks cannot
+// be pointed at the server's own network.
+func NewHandler(db *gorm.DB, redisClient *redis.Client, logger *slog.Logger, allowPrivate bool) *Handler {
+	return &Handler{
+		db:          db,
+		redisClient: redisClient,
+		logger:      logger,
+		client:      newClient(allowPrivate),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+	DocumentID string   `json:"document_id"` // empty subscribes to every document the caller owns
+}
+
+// Payload is the JSON body of every delivery.
+type Payload struct {
+	Event    string          `json:"event"`
+	Created  time.Time       `json:"created"`
+	ActorID  string          `json:"actor_id,omitempty"`
+	Document PayloadDocument `json:"document"`
+	Data     interface{}     `json:"data,omitempty"`
+}
+
+type PayloadDocument struct {
+	ID       string  `json:"id"`
+	Title    string  `json:"title"`
+	UserID   string  `json:"user_id"`
+	FolderID *string `json:"folder_id"`
+}
+
+// CreateWebhook registers a URL for some events. The signing secret is only
+// returned here.
+func (h *Handler) CreateWebhook(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var req WebhookRequest
+	if err := json.Unmarshal([]byte(ctx.PostForm("request")), &req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "missing request",
+		})
+		return
+	}
+	if !validURL(req.URL) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "url must be an absolute http or https URL",
+		})
+		return
+	}
+	if len(req.Events) == 0 || !validEvents(req.Events) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "events must be some of " + strings.Join(document.HookEvents, ", "),
+		})
+		return
+	}
+	hook := utils.Webhook{
+		UserID: currentUser,
+		URL:    req.URL,
+		Events: string(mustJSON(req.Events)),
+	}
+	if req.DocumentID != "" {
+		if _, _, err := document.Authorize(h.db, req.DocumentID, currentUser); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, document.ErrNoAccess) {
+				ctx.JSON(http.StatusNotFound, gin.H{
+					"message": "document not found",
+				})
+			} else {
+				ctx.JSON(http.StatusInternalServerError, gin.H{
+					"message": "error creating webhook",
+				})
+			}
+			return
+		}
+		hook.DocumentID = &req.DocumentID
+	}
+
+	var count int64
+	if err := h.db.Model(utils.Webhook{}).Where("user_id = ?", currentUser).Count(&count).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to count webhooks", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating webhook",
+		})
+		return
+	}
+	if count >= maxWebhooksPerUser {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "webhook limit reached",
+		})
+		return
+	}
+
+	var err error
+	if hook.ID, err = utils.RandomString(10); err == nil {
+		if hook.Secret, err = utils.RandomString(32); err == nil {
+			err = h.db.Create(&hook).Error
+		}
+	}
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to create webhook", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error creating webhook",
+		})
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{
+		"webhook": hook,
+		"secret":  hook.Secret,
+	})
+}
+
+func (h *Handler) ListWebhooks(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	hooks := make([]utils.Webhook, 0)
+	if err := h.db.Model(utils.Webhook{}).Where("user_id = ?", currentUser).Order("created").Find(&hooks).Error; err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to list webhooks", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error retrieving webhooks",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"webhooks": hooks,
+	})
+}
+
+// DeleteWebhook removes a webhook along with its delivery log.
+func (h *Handler) DeleteWebhook(ctx *gin.Context) {
+	currentUser := ctx.GetString("current_user")
+
+	var deleted int64
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ?", ctx.Param("webhook_id"), currentUser).Delete(&utils.Webhook{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return tx.Where("webhook_id = ?", ctx.Param("webhook_id")).Delete(&utils.WebhookDelivery{}).Error
+	})
+	if err != nil {
+		h.logger.ErrorContext(ctx.Request.Context(), "Failed to delete webhook", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"message": "error deleting webhook",
+		})
+		return
+	}
+	if deleted == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "webhook not found",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "webhook deleted",
+	})
+}
+
+// Emit queues a delivery of the event to every webhook subscribed to it:
+// the owner's account-wide webhooks and the document's own webhooks whose
+// creator can still open it. Failures are logged, they never fail the
+// action that raised the event.
+func (h *Handler) Emit(event string, doc *utils.Document, actorID string, data interface{}) {
+	var hooks []utils.Webhook
+	err := h.db.Model(utils.Webhook{}).
+		Where("events @> ?::jsonb", string(mustJSON([]string{event}))).
+		Where(h.db.Where("document_id = ?", doc.ID).Or("document_id IS NULL AND user_id = ?", doc.UserID)).
+		Find(&hooks).Error
+	if err != nil {
+		h.logger.Error("Failed to find webhooks", "error", err, "event", event)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload := string(mustJSON(Payload{
+		Event:   event,
+		Created: time.Now(),
+		ActorID: actorID,
+		Document: PayloadDocument{
+			ID:       doc.ID,
+			Title:    doc.Title,
+			UserID:   doc.UserID,
+			FolderID: doc.FolderID,
+		},
+		Data: data,
+	}))
+	queued := 0
+	for _, hook := range hooks {
+		if hook.UserID != doc.UserID {
+			role, err := document.EffectiveRole(h.db, doc, hook.UserID)
+			if err != nil || role == "" {
+				continue
+			}
+		}
+		if err := h.queue(hook.ID, event, payload, time.Now()); err != nil {
+			h.logger.Error("Failed to queue webhook delivery", "error", err, "webhookId", hook.ID)
+			continue
+		}
+		queued++
+	}
+	if queued > 0 {
+		h.wakeUp()
+	}
+}
+
+// DocumentUpdated schedules document.updated for updateDebounce after a
+// changed snapshot is saved, pushing back one already pending for the
+// document. The payload is built when it is sent, so it has the document as
+// it was after the last save.
+func (h *Handler) DocumentUpdated(docId string) {
+	due := time.Now().Add(updateDebounce).UnixMilli()
+	err := h.redisClient.ZAdd(context.Background(), pendingUpdates, redis.Z{Score: float64(due), Member: docId}).Err()
+	if err != nil {
+		h.logger.Error("Failed to schedule document update", "error", err, "docId", docId)
+	}
+}
+
+// emitDueUpdates raises document.updated for every document that has been
+// quiet for updateDebounce since its last save. It returns how many it took.
+func (h *Handler) emitDueUpdates() (int, error) {
+	docIds, err := popDueUpdates.Run(context.Background(), h.redisClient, []string{pendingUpdates},
+		time.Now().UnixMilli(), deliveryBatch).StringSlice()
+	if err != nil {
+		return 0, err
+	}
+	for _, docId := range docIds {
+		var doc utils.Document
+		err := h.db.Model(utils.Document{}).Select("id, user_id, folder_id, title, access").
+			Where("id = ? AND trashed_at IS NULL", docId).First(&doc).Error
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				h.logger.Error("Failed to load updated document", "error", err, "docId", docId)
+			}
+			continue
+		}
+		h.Emit(document.HookUpdated, &doc, "", nil)
+	}
+	return len(docIds), nil
+}
+
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && len(raw) <= 2000
+}
+
+func validEvents(events []string) bool {
+	for _, event := range events {
+		if !slices.Contains(document.HookEvents, event) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
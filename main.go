@@ -2,69 +2,144 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"livescribble/internal/admin"
+	"livescribble/internal/audit"
 	"livescribble/internal/auth"
+	"livescribble/internal/certs"
+	"livescribble/internal/cli"
+	"livescribble/internal/config"
 	"livescribble/internal/database"
+	"livescribble/internal/document"
+	"livescribble/internal/health"
+	"livescribble/internal/logging"
+	"livescribble/internal/metrics"
+	"livescribble/internal/notification"
+	"livescribble/internal/ratelimit"
 	"livescribble/internal/room"
+	"livescribble/internal/tracing"
 	"livescribble/internal/utils"
+	"livescribble/internal/webhook"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
+	gormtracing "gorm.io/plugin/opentelemetry/tracing"
 )
 
 func main() {
+	// help needs no configuration
+	if len(os.Args) == 2 && os.Args[1] == "help" {
+		cli.Usage(os.Stdout)
+		return
+	}
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if len(cfg.Args) > 0 && cfg.Args[0] != "serve" {
+		if err := cli.Run(cfg, cfg.Args); err != nil {
+			fmt.Fprintln(os.Stderr, "livescribble:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(cfg.Args) > 1 {
+		fmt.Fprintln(os.Stderr, "serve takes no arguments, flags go before the command")
+		os.Exit(2)
+	}
+	serve(cfg)
+}
+
+// serve runs the HTTP and WebSocket server until SIGTERM or SIGINT.
+func serve(cfg *config.Config) {
 	// Setup Logging
-	logFile, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	errorLogger, logFile, err := logging.New(cfg.Log.Level, cfg.Log.Format, cfg.Log.File, cfg.Log.Stdout)
 	if err != nil {
-		log.Fatalln("Failed to open log file")
+		log.Fatalln(err)
 	}
-	defer func(logFile *os.File) {
+	defer func(logFile io.Closer) {
 		err := logFile.Close()
 		if err != nil {
 			log.Fatalln("Failed to close errorLogger file")
 		}
 	}(logFile)
+	slog.SetDefault(errorLogger)
+	gin.DefaultWriter = logging.Writer(errorLogger, slog.LevelDebug, "[GIN-debug]")
+	gin.DefaultErrorWriter = logging.Writer(errorLogger, slog.LevelError, "[GIN-debug] [ERROR]")
 
-	multiWriter := io.MultiWriter(logFile, os.Stdout)
-	errorLogger := slog.New(slog.NewTextHandler(multiWriter, nil))
+	// -print-config shows the same on demand
+	errorLogger.Debug("Effective configuration", "config", cfg.Redacted())
 
-	var enableTempUser bool
-	if os.Getenv("ENABLE_TEMP_USER") == "true" {
-		enableTempUser = true
-	} else {
-		enableTempUser = false
-	}
 	// WebSocket upgrader
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true //TODO:restrict
-		},
+		ReadBufferSize:  cfg.WebSocket.ReadBufferSize,
+		WriteBufferSize: cfg.WebSocket.WriteBufferSize,
+		CheckOrigin:     auth.CheckOrigin(cfg.CORS.AllowedOrigins, cfg.CORS.AllowAllOrigins),
+	}
+	// Set up tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter, cfg.Tracing.File)
+	if err != nil {
+		errorLogger.Error(fmt.Sprintf("error setting up tracing: %v", err.Error()))
+		return
 	}
-	// 	Get JWT
-	jwt := os.Getenv("JWT_KEY")
-	if jwt == "" {
-		errorLogger.Error("No JWT_KEY found in environment")
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			errorLogger.Error(fmt.Sprintf("error flushing traces: %v", err.Error()))
+		}
+	}()
+	// 	Load JWT signing keys
+	keyConfigs := make([]auth.KeyConfig, 0, len(cfg.Auth.JWTKeys))
+	for _, key := range cfg.Auth.JWTKeys {
+		keyConfigs = append(keyConfigs, auth.KeyConfig(key))
+	}
+	jwtKeys, err := auth.LoadKeySet(keyConfigs, cfg.Auth.JWTKey, cfg.Auth.JWTSigningKid)
+	if err != nil {
+		errorLogger.Error(fmt.Sprintf("error loading jwt keys: %v", err.Error()))
 		return
 	}
+	// Load the TLS certificate, served by the binary itself when configured
+	var certReloader *certs.Reloader
+	if cfg.TLS.Enabled() {
+		certReloader, err = certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, errorLogger)
+		if err != nil {
+			errorLogger.Error(fmt.Sprintf("error loading tls certificate: %v", err.Error()))
+			return
+		}
+	}
 	// connect to Postgres
 	db := database.NewDatabaseManager()
-	err = db.Connect()
+	err = db.Connect(cfg.Database.URL, logging.GormLogger(errorLogger, cfg.Log.SlowQuery.Duration))
 	if err != nil {
 		errorLogger.Error(fmt.Sprintf("error connecting to database: %v", err.Error()))
 		return
 	}
 
+	if err := db.DB.Use(gormtracing.NewPlugin(gormtracing.WithoutMetrics())); err != nil {
+		errorLogger.Error(fmt.Sprintf("error tracing database: %v", err.Error()))
+	}
+
 	defer func(db *database.Manager) {
 		err := db.Close()
 		if err != nil {
@@ -76,139 +151,140 @@ func main() {
 
 	var ctxt = context.Background()
 	// connect to Redis
-	redisClient, err := utils.NewRedisClient()
-	if err != nil {
-		errorLogger.Error(fmt.Sprintf("error connecting to redis: %v", err.Error()))
-		log.Fatalf("%s", fmt.Sprintf("error connecting to redis: %v", err.Error()))
+	redisClient := utils.NewRedisClient(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB)
+	if err := redisotel.InstrumentTracing(redisClient); err != nil {
+		errorLogger.Error(fmt.Sprintf("error tracing redis: %v", err.Error()))
 	}
+	defer func() {
+		if err := redisClient.Close(); err != nil {
+			errorLogger.Error(fmt.Sprintf("error closing redis: %v", err.Error()))
+		}
+	}()
 	if _, err := redisClient.Ping(ctxt).Result(); err != nil {
 		errorLogger.Error(fmt.Sprintf("error pinging redis: %v", err.Error()))
 		log.Fatalf("%s", fmt.Sprintf("error pinging redis: %v", err.Error()))
 	}
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-	
-	var allowedOrigins []string
-	originsJSON := os.Getenv("ALLOWED_ORIGINS")
-	if originsJSON != "" {
-		if err := json.Unmarshal([]byte(originsJSON), &allowedOrigins); err != nil {
-			errorLogger.Error("allowed origins not set for cors")
-			allowedOrigins = []string{}
-		}
+	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		errorLogger.Error(fmt.Sprintf("error setting trusted proxies: %v", err.Error()))
+		return
 	}
-	r.Use(auth.CORSMiddleware(allowedOrigins))
-	authHandler := auth.NewHandler(db.DB, []byte(jwt), errorLogger)
+
+	r.Use(logging.RequestIDMiddleware(), logging.AccessLog(errorLogger), logging.Recovery(errorLogger))
+	r.Use(otelgin.Middleware(tracing.ServiceName))
+	r.Use(metrics.Middleware())
+	r.Use(auth.CORSMiddleware(cfg.CORS.AllowedOrigins, cfg.CORS.AllowAllOrigins))
+	limiter := ratelimit.NewLimiter(redisClient, errorLogger)
+	lockout := ratelimit.NewAccountLockout(limiter, cfg.RateLimit.LockoutFailures, cfg.RateLimit.LockoutWindow.Duration, cfg.RateLimit.LockoutDuration.Duration)
+	auditLog := audit.NewLog(db.DB, errorLogger)
 
 	// Initialize room manager
-	roomManager := room.NewRoomManager(db.DB, errorLogger, redisClient)
+	roomManager := room.NewRoomManager(db.DB, errorLogger, redisClient, cfg.WebSocket.WriteTimeout.Duration, cfg.WebSocket.SnapshotInterval.Duration)
+	authHandler := auth.NewHandler(db.DB, redisClient, jwtKeys, errorLogger, lockout, auditLog, roomManager, cfg.TLS.SecureCookies)
+
+	smtp := cfg.Notifications
+	mailer := notification.NewMailer(smtp.SMTPAddr, smtp.SMTPFrom, smtp.SMTPUsername, smtp.SMTPPassword, errorLogger)
+	notificationHandler := notification.NewHandler(db.DB, redisClient, errorLogger, mailer)
+	go notificationHandler.StartDigests(time.Duration(cfg.Notifications.DigestHours) * time.Hour)
+
+	webhookHandler := webhook.NewHandler(db.DB, redisClient, errorLogger, cfg.Webhooks.AllowPrivate)
+	roomManager.SetOnSnapshotSavedCallback(webhookHandler.DocumentUpdated)
+	go webhookHandler.StartDeliveries()
+
+	adminHandler := admin.NewHandler(db.DB, errorLogger, roomManager, auditLog)
 
-	r.POST("/login", authHandler.Login)
-	r.POST("/register", authHandler.Register)
-	if enableTempUser {
-		r.POST("/newtempuser", authHandler.CreateTempUser)
+	documentHandler := document.NewHandler(db.DB, errorLogger, roomManager, notificationHandler, webhookHandler, auditLog, time.Duration(cfg.Documents.TrashRetentionDays)*24*time.Hour)
+	go documentHandler.StartTrashPurge()
+
+	r.POST("/login", limiter.Middleware("login", cfg.RateLimit.Login, cfg.RateLimit.LoginWindow.Duration), authHandler.Login)
+	r.POST("/login/2fa", limiter.Middleware("login-2fa", cfg.RateLimit.Login2FA, cfg.RateLimit.Login2FAWindow.Duration), authHandler.LoginTOTP)
+	r.POST("/register", limiter.Middleware("register", cfg.RateLimit.Register, cfg.RateLimit.RegisterWindow.Duration), authHandler.Register)
+	if cfg.Server.EnableTempUser {
+		r.POST("/newtempuser", limiter.Middleware("newtempuser", cfg.RateLimit.TempUser, cfg.RateLimit.TempUserWindow.Duration), authHandler.CreateTempUser)
 	}
+	r.GET("/.well-known/jwks.json", jwtKeys.JWKS)
+	checker := health.NewChecker(2*time.Second, errorLogger)
+	checker.Add("postgres", db.Ping)
+	checker.Add("redis", func(ctx context.Context) error {
+		return redisClient.Ping(ctx).Err()
+	})
+	r.GET("/livez", checker.Live)
+	r.GET("/readyz", checker.Ready)
 	r.GET("/health", func(context *gin.Context) {
 		context.JSON(http.StatusOK, gin.H{})
 	})
 	protected := r.Group("/protected")
-	protected.Use(auth.MiddleWare([]byte(jwt), db.DB))
+	protected.Use(auth.MiddleWare(jwtKeys, db.DB))
+	// the account, its keys, notifications and webhooks need a login
+	// session, API keys only reach the document API
+	session := protected.Group("", auth.RequireSession())
 	{
-		protected.GET("/document/:doc_id", func(ctx *gin.Context) {
-			requestedDocId := ctx.Param("doc_id")
-			currentUser := ctx.GetString("current_user")
-			var document utils.Document
-			err := db.DB.Model(utils.Document{}).Where("id = ?", requestedDocId).First(&document).Error
-			if err != nil || (document.UserID != currentUser && strings.Contains(document.Access,currentUser)) {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					ctx.JSON(http.StatusNotFound, gin.H{
-						"message": "document not found",
-					})
-				} else {
-					ctx.JSON(http.StatusInternalServerError, gin.H{
-						"message": "error retrieving document",
-					})
-				}
-				return
-			}
-			ctx.JSON(http.StatusOK, gin.H{
-				"document": document,
-			})
-		})
-		protected.GET("/documents", func(ctx *gin.Context) {
-			currentUser := ctx.GetString("current_user")
-			var document []utils.Document
-			err := db.DB.Model(utils.Document{}).Where("user_id = ?", currentUser,).Find(&document).Error//TODO:switch this to access too
-			if err != nil {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					ctx.JSON(http.StatusNotFound, gin.H{
-						"message": "document not found",
-					})
-				} else {
-					ctx.JSON(http.StatusInternalServerError, gin.H{
-						"message": "error retrieving document",
-					})
-				}
-				return
-			}
-			ctx.JSON(http.StatusOK, gin.H{
-				"document": document,
-			})
-		})
-		// Create a new document
-		protected.POST("/create-document", func(ctx *gin.Context) {
-			currentUser := ctx.GetString("current_user")
-
-			new_document_id, err := generateDocumentId()
-			if err != nil {
-				ctx.JSON(http.StatusInternalServerError, gin.H{
-					"message": "error creating document",
-				})
-				return
-			}
-			document := utils.Document{
-				ID:      new_document_id,
-				UserID:  currentUser,
-				Content: "",
-				Access:  "[]",
-			}
+		session.GET("/api-keys", authHandler.ListAPIKeys)
+		session.POST("/api-keys", authHandler.CreateAPIKey)
+		session.DELETE("/api-keys/:key_id", authHandler.DeleteAPIKey)
+		session.POST("/2fa/enroll", authHandler.EnrollTOTP)
+		session.POST("/2fa/verify", authHandler.VerifyTOTP)
+		session.POST("/2fa/disable", authHandler.DisableTOTP)
+		session.POST("/account/password", authHandler.ChangePassword)
+		session.POST("/account/email", authHandler.ChangeEmail)
+		session.POST("/account/delete", authHandler.DeleteAccount)
+		session.GET("/account/export", authHandler.ExportAccount)
 
-			err = db.DB.Create(&document).Error
-			if err != nil {
-				ctx.JSON(http.StatusInternalServerError, gin.H{
-					"message": "error creating document",
-				})
-				return
-			}
+		session.GET("/notifications", notificationHandler.ListNotifications)
+		session.GET("/notifications/stream", notificationHandler.Stream)
+		session.POST("/notifications/read-all", notificationHandler.MarkAllRead)
+		session.POST("/notifications/:notification_id/read", notificationHandler.MarkRead)
+		session.POST("/notifications/:notification_id/unread", notificationHandler.MarkUnread)
 
-			ctx.JSON(http.StatusCreated, gin.H{
-				"document": document,
-			})
-		})
-		protected.POST("delete-document", func(ctx *gin.Context) {
-			currentUser := ctx.GetString("current_user")
-			document_id := ctx.PostForm("document_id")
+		session.GET("/webhooks", webhookHandler.ListWebhooks)
+		session.POST("/webhooks", webhookHandler.CreateWebhook)
+		session.DELETE("/webhooks/:webhook_id", webhookHandler.DeleteWebhook)
+		session.GET("/webhooks/:webhook_id/deliveries", webhookHandler.ListDeliveries)
+		session.POST("/webhooks/:webhook_id/deliveries/:delivery_id/redeliver", webhookHandler.Redeliver)
+	}
+	{
+		protected.GET("/document/:doc_id", documentHandler.GetDocument)
+		protected.GET("/documents", documentHandler.ListDocuments)
+		protected.GET("/search", documentHandler.Search)
+		protected.POST("/document/:doc_id/share", documentHandler.ShareDocument)
+		protected.POST("/document/:doc_id/move", documentHandler.MoveDocument)
 
-			err := db.DB.Model(utils.User{}).Where("id = ? AND user_id", &document_id, &currentUser).Delete(&utils.Document{}).Error
-			if err != nil {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					ctx.JSON(http.StatusOK, gin.H{
-						"message": "cannot Find Document",
-					})
-				} else {
-					ctx.JSON(http.StatusOK, gin.H{
-						"message": "error deleting document",
-					})
-				}
-				return
-			}
-			ctx.JSON(http.StatusOK, gin.H{
-				"message": "document deleted successfully",
-			})
-		})
+		protected.GET("/folders", documentHandler.ListFolders)
+		protected.POST("/folders", documentHandler.CreateFolder)
+		protected.GET("/folders/:folder_id", documentHandler.GetFolder)
+		protected.POST("/folders/:folder_id", documentHandler.UpdateFolder)
+		protected.DELETE("/folders/:folder_id", documentHandler.DeleteFolder)
+		protected.POST("/folders/:folder_id/share", documentHandler.ShareFolder)
+		// Create a new document
+		protected.POST("/create-document", documentHandler.CreateDocument)
+		protected.GET("/document/:doc_id/export", documentHandler.ExportDocument)
+		protected.POST("/document/:doc_id/duplicate", documentHandler.DuplicateDocument)
+		protected.POST("/import", documentHandler.ImportDocuments)
+		protected.POST("/document/:doc_id/template", documentHandler.SetTemplate)
+		protected.GET("/templates", documentHandler.ListTemplates)
+		protected.GET("/document/:doc_id/comments", documentHandler.ListComments)
+		protected.POST("/document/:doc_id/comments", documentHandler.CreateThread)
+		protected.POST("/document/:doc_id/comments/:thread_id/reply", documentHandler.ReplyToThread)
+		protected.POST("/document/:doc_id/comments/:thread_id/resolve", documentHandler.ResolveThread)
+		protected.POST("/document/:doc_id/comments/:thread_id/reopen", documentHandler.ReopenThread)
+		protected.POST("/document/:doc_id/comments/:thread_id/:comment_id", documentHandler.EditComment)
+		protected.DELETE("/document/:doc_id/comments/:thread_id/:comment_id", documentHandler.DeleteComment)
+		protected.POST("/delete-document", documentHandler.TrashDocument)
+		protected.GET("/trash", documentHandler.ListTrash)
+		protected.GET("/document/:doc_id/audit", auditLog.DocumentEvents)
+		protected.POST("/trash/:doc_id/restore", documentHandler.RestoreDocument)
+		protected.DELETE("/trash/:doc_id", documentHandler.PurgeDocument)
 		protected.GET("/ws/:doc_id", func(ctx *gin.Context) {
 			docId := ctx.Param("doc_id")
 			currentUser := ctx.GetString("current_user")
 
+			if roomManager.Draining() {
+				ctx.JSON(http.StatusServiceUnavailable, gin.H{
+					"message": "server restarting",
+				})
+				return
+			}
 			if len(docId) == 0 || len(docId) > 50 {
 				ctx.JSON(http.StatusBadRequest, gin.H{
 					"message": "invalid document ID",
@@ -216,10 +292,12 @@ func main() {
 				return
 			}
 			// Verify user has access to the document
-			var document utils.Document
-			err := db.DB.Model(utils.Document{}).Where("id = ?", docId).First(&document).Error
-			if err != nil || (document.UserID != currentUser && strings.Contains(document.Access,currentUser)) {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
+			_, role, err := document.Authorize(db.DB, docId, currentUser)
+			if err != nil {
+				if errors.Is(err, document.ErrNoAccess) {
+					auditLog.Record(ctx, audit.Event{Action: audit.ActionDocumentJoin, DocumentID: docId, Failed: true})
+				}
+				if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, document.ErrNoAccess) {
 					ctx.JSON(http.StatusNotFound, gin.H{
 						"message": "document not found",
 					})
@@ -232,27 +310,111 @@ func main() {
 			}
 
 			// Upgrade HTTP connection to WebSocket
+			_, span := tracing.Tracer().Start(ctx.Request.Context(), "websocket.upgrade")
+			span.SetAttributes(attribute.String("document.id", docId), attribute.String("document.role", role))
 			conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+			span.End()
 			if err != nil {
-				errorLogger.Error("Failed to upgrade connection", "error", err, "docId", docId, "userId", currentUser)
+				errorLogger.ErrorContext(ctx.Request.Context(), "Failed to upgrade connection", "error", err, "docId", docId, "userId", currentUser)
 				return
 			}
 
-			roomManager.JoinRoom(docId, conn)
+			auditLog.Record(ctx, audit.Event{Action: audit.ActionDocumentJoin, DocumentID: docId, Data: gin.H{"role": role}})
+			roomManager.JoinRoom(docId, currentUser, conn, !document.CanEdit(role))
 		})
 	}
 
-	err = r.Run(":8081")
-	if err != nil {
-		errorLogger.Error(fmt.Sprintf("error starting server: %v", err.Error()))
-		log.Fatalf("%s", fmt.Sprintf("error starting server: %v", err.Error()))
+	adminRoutes := protected.Group("/admin")
+	adminRoutes.Use(auth.RequireSession(), auth.RequireAdmin(db.DB))
+	{
+		adminRoutes.GET("/audit", auditLog.Export)
+		adminRoutes.GET("/rooms", adminHandler.ListRooms)
+		adminRoutes.GET("/rooms/:doc_id", adminHandler.GetRoom)
+		adminRoutes.POST("/rooms/:doc_id/kick", adminHandler.Kick)
+		adminRoutes.POST("/rooms/:doc_id/snapshot", adminHandler.RequestSnapshot)
+		adminRoutes.POST("/rooms/:doc_id/close", adminHandler.CloseRoom)
 	}
-	fmt.Println("Running Server at 8081")
-}
 
-func generateDocumentId() (string, error) {
-	return utils.RandomString(10)
+	shutdownTimeout := time.Duration(cfg.Server.ShutdownTimeoutSeconds) * time.Second
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+	// notification streams only end when the client goes, Shutdown would
+	// wait for them
+	server.RegisterOnShutdown(notificationHandler.Shutdown)
+	var redirectServer *http.Server
+	if certReloader != nil {
+		// HTTP/2 is negotiated automatically once the server speaks TLS
+		server.TLSConfig = certReloader.TLSConfig()
+		go certReloader.Watch(signalCtx, cfg.TLS.ReloadInterval.Duration)
+		if cfg.TLS.RedirectAddr != "" {
+			redirectServer = &http.Server{Addr: cfg.TLS.RedirectAddr, Handler: certs.RedirectHandler(cfg.Server.Addr)}
+			go func() {
+				fmt.Println("Redirecting HTTP to HTTPS at " + cfg.TLS.RedirectAddr)
+				if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					errorLogger.Error(fmt.Sprintf("error starting redirect server: %v", err.Error()))
+					stop()
+				}
+			}()
+		}
+	}
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{Addr: cfg.Server.MetricsAddr, Handler: mux}
+		go func() {
+			fmt.Println("Serving metrics at " + cfg.Server.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errorLogger.Error(fmt.Sprintf("error starting metrics server: %v", err.Error()))
+				stop()
+			}
+		}()
+	}
+	go func() {
+		var err error
+		if certReloader != nil {
+			fmt.Println("Running Server with TLS at " + cfg.Server.Addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			fmt.Println("Running Server at " + cfg.Server.Addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errorLogger.Error(fmt.Sprintf("error starting server: %v", err.Error()))
+			stop()
+		}
+	}()
+	<-signalCtx.Done()
+	stop()
+
+	// Fail readiness, save every room and disconnect its clients, then stop
+	// HTTP. Redis, the database and the tracer are closed by the deferred
+	// calls above.
+	errorLogger.Info("Shutting down", "timeout", shutdownTimeout)
+	checker.StartShutdown()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout)
+	roomManager.Drain(drainCtx)
+	cancelDrain()
+
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelHTTP()
+	if err := server.Shutdown(httpCtx); err != nil {
+		errorLogger.Error(fmt.Sprintf("error stopping server: %v", err.Error()))
+	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(httpCtx); err != nil {
+			errorLogger.Error(fmt.Sprintf("error stopping redirect server: %v", err.Error()))
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(httpCtx); err != nil {
+			errorLogger.Error(fmt.Sprintf("error stopping metrics server: %v", err.Error()))
+		}
+	}
 }
+
 func containsKeyword(list []string, keyword string) bool {
 	for _, item := range list {
 		if strings.Contains(item, keyword) {